@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"github.com/grantek/fkmd/device"
+	"github.com/grantek/fkmd/mdcart"
 	"io"
 )
 
@@ -164,69 +165,21 @@ NameLoop:
 }
 
 func RamAvailable(d *device.Device) bool {
-	var (
-		first_word uint16
-		tmp        uint16
-		err        error
-	)
-
 	d.WriteWord(0xA13000, 0xffff) //bank switch RAM in
-	first_word, err = d.ReadWord(0x200000)
-	d.WriteWord(0x200000, uint16(first_word^0xffff))
-	tmp, err = d.ReadWord(0x200000)
-	if err != nil {
-		panic(err)
-	}
-	d.WriteWord(0x200000, first_word)
-	tmp ^= 0xffff
-	if (first_word & 0x00ff) != (tmp & 0x00ff) { //Save RAM is 8-bit so we don't care what the second byte of the word is
-		return false
-	}
+	return mdcart.RamAvailableAt(d, 0x200000, 0x00ff)
+}
 
-	return true
+// RamLayout returns where the cart's save RAM is and how it's wired, see
+// mdcart.RamLayout. It leaves RAM switched in.
+func RamLayout(d *device.Device) (mdcart.RAMLayout, string) {
+	return mdcart.RamLayout(d)
 }
 
+// GetRamSize returns the size of the cart's save RAM in bytes, 0 if it has
+// none. See RamLayout.
 func GetRamSize(d *device.Device) int {
-	var (
-		ram_size       int64
-		first_word     uint16
-		first_word_tmp uint16
-		tmp            uint16
-		tmp2           uint16
-		ram_type       uint16 = 0x00ff
-		err            error
-	)
-
-	//This commented-out write was in the original code
-	//Device.writeWord(0xA13000, 0x0001);
-
-	if RamAvailable(d) == false { //RAM is banskswitched in here?
-		return 0
-	}
-
-	first_word, err = d.ReadWord(0x200000)
-
-	for ram_size = 256; ram_size < 0x100000; ram_size *= 2 {
-		tmp, err = d.ReadWord(0x200000 + ram_size)
-		d.WriteWord(0x200000+ram_size, tmp^0xffff)
-		tmp2, err = d.ReadWord(0x200000 + ram_size)
-		first_word_tmp, err = d.ReadWord(0x200000)
-		if err != nil {
-			panic(err)
-		}
-		d.WriteWord(0x200000+ram_size, tmp)
-		tmp2 ^= 0xffff
-		if (tmp & 0xff) != (tmp2 & 0xff) {
-			break
-		}
-		if (first_word & ram_type) != (first_word_tmp & ram_type) {
-			break
-		}
-	}
-
-	//Save RAM is 8-bit on a 16-bit system, this returns the real size in bytes
-	return int(ram_size / 2)
-
+	l, _ := RamLayout(d)
+	return int(l.Size)
 }
 
 func checkRomSize(d *device.Device, base_addr int, max_len int) int {
@@ -5,6 +5,9 @@ import (
 	"io"
 	"errors"
 
+	"github.com/grantek/fkmd/flashchip"
+	"github.com/grantek/fkmd/mdcart"
+	"github.com/grantek/fkmd/transport"
 	"github.com/jacobsa/go-serial/serial"
 )
 
@@ -21,9 +24,13 @@ const (
 	PAR_INC    byte = 128
 )
 
+// ErrNoFlash is returned by FlashID when the cart doesn't answer autoselect.
+var ErrNoFlash = mdcart.ErrNoFlash
+
 type Device struct {
-	fd  io.ReadWriteCloser
-	opt serial.OpenOptions
+	fd   io.ReadWriteCloser
+	opt  serial.OpenOptions
+	open transport.Opener
 }
 
 func New() *Device {
@@ -35,8 +42,20 @@ func (d *Device) SetOptions(options serial.OpenOptions) {
 	d.opt = options
 }
 
+// SetOpener makes Connect use o to open the device instead of serial.Open.
+func (d *Device) SetOpener(o transport.Opener) {
+	d.open = o
+}
+
+func (d *Device) opener() transport.Opener {
+	if d.open == nil {
+		return transport.Serial
+	}
+	return d.open
+}
+
 func (d *Device) Connect() error {
-	f, err := serial.Open(d.opt)
+	f, err := d.opener()(d.opt)
 	d.fd = f
 	if err != nil {
 		return err
@@ -50,7 +69,7 @@ func (d *Device) Connect() error {
 		//port.WriteTimeout = 2000;
 		//port.ReadTimeout = 2000;
 		d.opt.InterCharacterTimeout = 2000
-		f, err := serial.Open(d.opt)
+		f, err := d.opener()(d.opt)
 		d.fd = f
 		if err != nil {
 			return err
@@ -228,7 +247,7 @@ func (d *Device) ReadWord(addr int64) (uint16, error) {
 
 // we can only write to the lower byte of a word-aligned address
 // since cartridge RAM is 8-bit
-func (d *Device) WriteByte(addr int, data byte) (err error) {
+func (d *Device) WriteByteAt(addr int, data byte) (err error) {
 	cmd := make([]byte, 8)
 	addr /= 2
 
@@ -331,6 +350,21 @@ func (d *Device) FlashErase(addr int64) error {
 	return err
 }
 
+// Erase the sector holding addr, see mdcart.FlashEraseSector
+func (d *Device) FlashEraseSector(addr int64) error {
+	return mdcart.FlashEraseSector(d, addr)
+}
+
+// FlashID reads the flash chip's IDs, see mdcart.FlashID.
+func (d *Device) FlashID() (manufacturer byte, device uint16, err error) {
+	return mdcart.FlashID(d)
+}
+
+// FlashChip identifies the flash chip, see mdcart.FlashChip.
+func (d *Device) FlashChip() (*flashchip.Chip, error) {
+	return mdcart.FlashChip(d)
+}
+
 func (d *Device) FlashRY() error {
 	cmd := make([]byte, 2)
 	buf := make([]byte, 2)
@@ -344,15 +378,15 @@ func (d *Device) FlashRY() error {
 }
 
 func (d *Device) FlashUnlockBypass() {
-	d.WriteByte(0x555*2, 0xaa)
-	d.WriteByte(0x2aa*2, 0x55)
-	d.WriteByte(0x555*2, 0x20)
+	d.WriteByteAt(0x555*2, 0xaa)
+	d.WriteByteAt(0x2aa*2, 0x55)
+	d.WriteByteAt(0x555*2, 0x20)
 }
 
 func (d *Device) FlashResetBypass() {
 	d.WriteWord(0, 0xf0)
-	d.WriteByte(0, 0x90)
-	d.WriteByte(0, 0x00)
+	d.WriteByteAt(0, 0x90)
+	d.WriteByteAt(0, 0x00)
 }
 
 func (d *Device) RamEnable() error {
@@ -5,8 +5,10 @@ import (
 	//    "errors"
 	"flag"
 	"fmt"
+	"github.com/grantek/fkmd/krikzz_fkmd_sim"
 	"github.com/jacobsa/go-serial/serial"
 	"io"
+	"io/ioutil"
 	"os"
 	"testing"
 )
@@ -79,7 +81,7 @@ func usage() {
 
 func setup(m *testing.M) int {
 	port := flag.String("port", "/dev/ttyUSB0", "serial port to use (/dev/ttyUSB0, etc)")
-	testfile := flag.String("testfile", "", "expected ROM dump from device")
+	testfile := flag.String("testfile", "", "expected ROM dump from device (default: use simulated device)")
 	baud := new(uint)
 	*baud = 9600
 	//even := new(bool); *even = false
@@ -108,8 +110,7 @@ func setup(m *testing.M) int {
 	}
 
 	if *testfile == "" {
-		fmt.Println("Must specify testfile")
-		usage()
+		return setupSim(m)
 	}
 
 	options := serial.OpenOptions{
@@ -148,6 +149,34 @@ func setup(m *testing.M) int {
 	return m.Run()
 }
 
+// setupSim runs the tests against a simulated Flashkit, with the ROM image
+// saved to a temporary file for comparison.
+func setupSim(m *testing.M) int {
+	var err error
+	sim := krikzz_fkmd_sim.New(krikzz_fkmd_sim.SampleROM(0x80000, "TEST ROM"), 0x2000)
+	d = New()
+	d.SetOpener(sim.Open)
+	if err = d.Connect(); err != nil {
+		fmt.Println("Error opening simulated device: ", err)
+		return -1
+	}
+	defer d.Disconnect()
+
+	mf, err = ioutil.TempFile("", "device_test")
+	if err != nil {
+		fmt.Println("Error creating test file: ", err)
+		return -1
+	}
+	defer os.Remove(mf.Name())
+	defer mf.Close()
+	if _, err = mf.Write(sim.ROM); err != nil {
+		fmt.Println("Error writing test file: ", err)
+		return -1
+	}
+
+	return m.Run()
+}
+
 func TestMain(m *testing.M) {
 	os.Exit(setup(m))
 }
@@ -224,3 +253,54 @@ func TestFullRead(t *testing.T) {
 	t.Log("Read and matched", romlen, "bytes")
 
 }
+
+// TestFlashWrite follows the erase, program and verify sequence of WriteRom
+// in fkmd.go.
+func TestFlashWrite(t *testing.T) {
+	s := krikzz_fkmd_sim.NewFlash(krikzz_fkmd_sim.SampleROM(0x40000, "OLD ROM"), 0)
+	fd := New()
+	fd.fd = s
+	image := krikzz_fkmd_sim.SampleROM(0x20000, "NEW ROM")
+	for i := range image[0x200:] {
+		image[0x200+i] ^= 0xa5
+	}
+
+	fd.FlashResetBypass()
+	for i := int64(0); i < int64(len(image)); i += 65536 {
+		if err := fd.FlashErase(i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fd.FlashUnlockBypass()
+	fd.Seek(0, io.SeekStart)
+	for i := 0; i < len(image); i += 4096 {
+		if err := fd.FlashWrite(image[i : i+4096]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fd.FlashResetBypass()
+
+	if s.Flash.Bypass {
+		t.Error("flash left in unlock bypass mode")
+	}
+	if s.Flash.SectorErases != 2 {
+		t.Errorf("erased %d sectors, want 2", s.Flash.SectorErases)
+	}
+	if s.Flash.FailedBits != 0 {
+		t.Errorf("%d bits programmed without an erase", s.Flash.FailedBits)
+	}
+
+	buf := make([]byte, len(image))
+	fd.Seek(0, io.SeekStart)
+	if _, err := fd.Read(buf); err != nil {
+		t.Fatal(err)
+	}
+	for i, v := range image {
+		if buf[i] != v {
+			t.Fatalf("verify mismatch at %#x: read %#x, want %#x", i, buf[i], v)
+		}
+	}
+	if w, _ := fd.ReadWord(0x20000); w != uint16(s.ROM[0x20000])<<8|uint16(s.ROM[0x20001]) || s.ROM[0x20000] == 0xff && s.ROM[0x20001] == 0xff {
+		t.Errorf("data past the erased sectors changed: %#x", w)
+	}
+}
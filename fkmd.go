@@ -13,6 +13,9 @@ import (
 
 	"github.com/grantek/fkmd/cart"
 	"github.com/grantek/fkmd/device"
+	"github.com/grantek/fkmd/flashchip"
+	"github.com/grantek/fkmd/mdcart"
+	"github.com/grantek/fkmd/transport"
 	"github.com/jacobsa/go-serial/serial"
 	//"github.com/grantek/fkmd/krikzz_fkmd"
 )
@@ -60,13 +63,14 @@ func ReadRom(d *device.Device, romfile string, autoname bool, rangestart, rangee
 		romsize = int64(cart.GetRomSize(d))
 	}
 	d.Seek(rangestart, io.SeekStart)
+	var rom []byte
 	buf := make([]byte, blocksize)
 	for i := int64(0); i < romsize; i += int64(blocksize) {
 		_, err = d.Read(buf)
 		if err != nil {
 			panic(err)
 		}
-		f.Write(buf)
+		rom = append(rom, buf...)
 		if f != os.Stdout {
 			fmt.Printf(".")
 		}
@@ -74,6 +78,19 @@ func ReadRom(d *device.Device, romfile string, autoname bool, rangestart, rangee
 	if f != os.Stdout {
 		fmt.Println()
 	}
+
+	//only a whole ROM can be checked against its header
+	if rangeend == 0 {
+		var blocks []int
+		rom, blocks, err = mdcart.VerifyDump(d, rom, 3)
+		if len(blocks) > 0 {
+			fmt.Fprintf(os.Stderr, "Blocks of %d bytes that changed between reads (check the cart contacts): %v\n", mdcart.BLOCK_SIZE, blocks)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+		}
+	}
+	f.Write(rom)
 }
 
 func ReadRam(d *device.Device, ramfile string, autoname bool, rangestart, rangeend int64) {
@@ -84,12 +101,15 @@ func ReadRam(d *device.Device, ramfile string, autoname bool, rangestart, rangee
 		err     error
 		n       int
 	)
-	ramsize = cart.GetRamSize(d)
-	if ramsize == 0 {
+	ram, note := cart.RamLayout(d)
+	if note != "" {
+		fmt.Fprintln(os.Stderr, "Warning:", note)
+	}
+	if ram.Size == 0 {
 		fmt.Println("RAM not detected for reading")
 		return
 	}
-	ramsize = ramsize * 2
+	ramsize = int(ram.Span(ram.Size))
 	if autoname {
 		romname, _ = cart.GetRomName(d)
 		re := regexp.MustCompile("  *")
@@ -114,7 +134,7 @@ func ReadRam(d *device.Device, ramfile string, autoname bool, rangestart, rangee
 
 	d.RamEnable()
 	defer d.RamDisable()
-	d.Seek(0x200000, io.SeekStart)
+	d.Seek(ram.Addr, io.SeekStart)
 	buf := make([]byte, ramsize)
 
 	n, err = d.Read(buf)
@@ -142,10 +162,14 @@ func WriteRam(d *device.Device, ramfile string) error {
 		v       byte
 	)
 
-	ramsize = cart.GetRamSize(d)
-	if ramsize == 0 {
+	ram, note := cart.RamLayout(d)
+	if note != "" {
+		fmt.Fprintln(os.Stderr, "Warning:", note)
+	}
+	if ram.Size == 0 {
 		return errors.New("RAM not detected for writing")
 	}
+	ramsize = int(ram.Span(ram.Size))
 	if ramfile == "-" {
 		f = os.Stdin
 	} else {
@@ -160,9 +184,9 @@ func WriteRam(d *device.Device, ramfile string) error {
 		defer f.Close()
 	}
 
-	buf := make([]byte, ramsize*2)
+	buf := make([]byte, ramsize)
 	nextbyte := make([]byte, 1)
-	for i = 0; i < ramsize*2; {
+	for i = 0; i < ramsize; {
 		j, err = f.Read(buf)
 		i += j
 		if err != nil {
@@ -174,30 +198,30 @@ func WriteRam(d *device.Device, ramfile string) error {
 	}
 	j, err = f.Read(nextbyte)
 	if err == nil || j > 0 {
-		return errors.New(fmt.Sprintf("error: read data beyond %d bytes from ramfile \"%s\": %x", ramsize*2, ramfile, nextbyte[0]))
+		return errors.New(fmt.Sprintf("error: read data beyond %d bytes from ramfile \"%s\": %x", ramsize, ramfile, nextbyte[0]))
 	}
 
 	d.RamEnable()
 	defer d.RamDisable()
-	d.Seek(0x200000, io.SeekStart)
+	d.Seek(ram.Addr, io.SeekStart)
 
 	n, err = d.Write(buf)
 	if err != nil {
 		panic(err)
 	}
 	fmt.Println("Verify...")
-	buf2 := make([]byte, ramsize*2)
-	d.Seek(0x200000, io.SeekStart)
+	buf2 := make([]byte, ramsize)
+	d.Seek(ram.Addr, io.SeekStart)
 	n, err = d.Read(buf2)
-	if n < ramsize*2 {
+	if n < ramsize {
 		panic(errors.New("short RAM read"))
 	}
 	if err != nil {
 		panic(err)
 	}
 	for i, v = range buf {
-		// skip over high bytes of 16-bit reads
-		if i%2 != 0 && buf2[i] != v {
+		// skip over the bytes of each word that 8-bit RAM isn't on
+		if ram.Wired(i) && buf2[i] != v {
 			return errors.New(fmt.Sprintf("Failed verification at byte %d", i))
 		}
 	}
@@ -258,11 +282,36 @@ func WriteRom(d *device.Device, romfile string) error {
 		romsize = (romsize/0x10000)*0x10000 + 0x10000
 	}
 
+	chip, err := d.FlashChip()
+	if err == device.ErrNoFlash {
+		fmt.Println("Warning: flash chip not identified, erasing in 64KiB sectors:", err)
+		chip = &flashchip.Chip{}
+	} else if err != nil {
+		return errors.New(fmt.Sprintf("Error identifying flash chip: %v", err))
+	} else if !chip.Known() {
+		fmt.Printf("Warning: %v, erasing in 64KiB sectors\n", chip)
+	} else {
+		fmt.Println("Flash chip:", chip)
+		if chip.Commands != flashchip.AMD {
+			return errors.New(fmt.Sprintf("Error: flash chip %v uses the %v command set, only AMD is supported", chip, chip.Commands))
+		}
+		if fblen > int64(chip.Size) {
+			return errors.New(fmt.Sprintf("Error: %s is %d bytes, larger than the %d byte flash chip %v", romfile, fblen, chip.Size, chip))
+		}
+	}
+
 	fmt.Println("Flash erase...")
 	d.FlashResetBypass()
 
-	for i = 0; i < romsize; i += 65536 {
-		d.FlashErase(i)
+	for _, sector := range chip.SectorsIn(0, int(romsize)) {
+		if chip.Known() {
+			err = d.FlashEraseSector(int64(sector.Addr))
+		} else {
+			err = d.FlashErase(int64(sector.Addr))
+		}
+		if err != nil {
+			return errors.New(fmt.Sprintf("Error erasing flash at 0x%X: %v", sector.Addr, err))
+		}
 		fmt.Printf("*")
 	}
 	fmt.Printf("\n")
@@ -274,7 +323,9 @@ func WriteRom(d *device.Device, romfile string) error {
 		if i+blocklen > fblen {
 			blocklen = fblen - i
 		}
-		d.FlashWrite(filebuf[i : i+blocklen])
+		if err = d.FlashWrite(filebuf[i : i+blocklen]); err != nil {
+			return errors.New(fmt.Sprintf("Error writing flash at 0x%X: %v", i, err))
+		}
 		fmt.Printf("*")
 	}
 	d.FlashResetBypass()
@@ -309,7 +360,7 @@ func main() {
 	)
 
 	//options
-	port := flag.String("port", "/dev/ttyUSB0", "serial port to use (/dev/ttyUSB0, etc)")
+	port := flag.String("port", "/dev/ttyUSB0", "serial port to use (/dev/ttyUSB0, etc), or tcp://host:port for a network bridge")
 
 	//serial options, shouldn't be needed
 	/*
@@ -429,6 +480,7 @@ func main() {
 
 	var d = device.New()
 	d.SetOptions(options)
+	d.SetOpener(transport.ForPort(*port))
 	err = d.Connect()
 
 	if err != nil {
@@ -442,13 +494,17 @@ func main() {
 		s, _ := cart.GetRomName(d)
 		fmt.Println("ROM name:", s)
 		fmt.Println("ROM size:", cart.GetRomSize(d))
-		ramsize := cart.GetRamSize(d)
-		if ramsize > 0 {
+		ram, note := cart.RamLayout(d)
+		if ram.Size > 0 {
 			fmt.Println("RAM available: yes")
-			fmt.Println("RAM size:", ramsize)
+			fmt.Println("RAM size:", ram.Size)
+			fmt.Println("RAM layout:", ram)
 		} else {
 			fmt.Println("RAM available: no")
 		}
+		if note != "" {
+			fmt.Println("Warning:", note)
+		}
 	}
 
 	if *readrom {
@@ -467,6 +523,9 @@ func main() {
 	}
 
 	if *writerom {
-		WriteRom(d, *romfile)
+		err = WriteRom(d, *romfile)
+		if err != nil {
+			fmt.Println(err)
+		}
 	}
 }
@@ -0,0 +1,260 @@
+// Package flashchip describes the flash chips found on flash carts, by the
+// manufacturer and device IDs they give in autoselect mode, so writers can
+// plan erases from a chip's real sector layout.
+package flashchip
+
+import (
+	"fmt"
+	"strings"
+)
+
+// CommandSet is the command protocol a chip uses.
+type CommandSet int
+
+const (
+	AMD      CommandSet = iota // unlock cycles at 0x555 and 0x2AA
+	AMD_5555                   // unlock cycles at 0x5555 and 0x2AAA, eg. SST
+	INTEL                      // no unlock cycles, block erase with 0x20 0xD0
+)
+
+func (c CommandSet) String() string {
+	switch c {
+	case AMD:
+		return "AMD"
+	case AMD_5555:
+		return "AMD (0x5555)"
+	case INTEL:
+		return "Intel"
+	}
+	return fmt.Sprintf("CommandSet(%d)", int(c))
+}
+
+// BootBlock is where a boot sector chip has its small sectors.
+type BootBlock int
+
+const (
+	BOOT_NONE   BootBlock = iota // uniform sectors
+	BOOT_BOTTOM                  // small sectors at the lowest addresses
+	BOOT_TOP                     // small sectors at the highest addresses
+)
+
+func (b BootBlock) String() string {
+	switch b {
+	case BOOT_NONE:
+		return "uniform"
+	case BOOT_BOTTOM:
+		return "bottom boot"
+	case BOOT_TOP:
+		return "top boot"
+	}
+	return fmt.Sprintf("BootBlock(%d)", int(b))
+}
+
+// DEFAULT_SECTOR_SIZE is assumed for chips that aren't in the database, as
+// writers did before there was one.
+const DEFAULT_SECTOR_SIZE = 0x10000
+
+// Region is Count sectors of Size bytes, as in a CFI erase block region.
+type Region struct {
+	Size  int
+	Count int
+}
+
+// Sector is an erasable sector, Size bytes from byte address Addr.
+type Sector struct {
+	Addr int
+	Size int
+}
+
+// Chip is a flash chip's identity and geometry. Size and addresses are in
+// bytes, and device IDs as read in the bus width the chip is used at: 8-bit
+// on Game Boy carts, 16-bit (0x22xx for most) on Mega Drive carts.
+type Chip struct {
+	Manufacturer byte
+	Device       uint16
+	Name         string
+	Size         int
+	Regions      []Region // sectors from address 0, nil if not known
+	Commands     CommandSet
+	Boot         BootBlock
+}
+
+// Known reports whether the chip's geometry is known.
+func (c *Chip) Known() bool {
+	return c.Regions != nil
+}
+
+// ManufacturerName returns the name for the chip's manufacturer ID.
+func (c *Chip) ManufacturerName() string {
+	return Manufacturers[c.Manufacturer]
+}
+
+func (c *Chip) String() string {
+	if !c.Known() {
+		name := c.ManufacturerName()
+		if name == "" {
+			name = fmt.Sprintf("manufacturer 0x%02X", c.Manufacturer)
+		}
+		return fmt.Sprintf("unknown %s chip 0x%04X", name, c.Device)
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %s, %s", c.ManufacturerName(), c.Name, sizeString(c.Size))
+	if c.Boot != BOOT_NONE {
+		fmt.Fprintf(&b, " %s", c.Boot)
+	}
+	return b.String()
+}
+
+func sizeString(n int) string {
+	if n >= 1024*1024 {
+		return fmt.Sprintf("%gMiB", float64(n)/(1024*1024))
+	}
+	return fmt.Sprintf("%dKiB", n/1024)
+}
+
+// Sectors lists every sector of the chip in address order.
+func (c *Chip) Sectors() []Sector {
+	var sectors []Sector
+	addr := 0
+	for _, r := range c.Regions {
+		for i := 0; i < r.Count; i++ {
+			sectors = append(sectors, Sector{Addr: addr, Size: r.Size})
+			addr += r.Size
+		}
+	}
+	return sectors
+}
+
+// SectorAt returns the sector holding byte address addr. Addresses past the
+// end of the chip are mirrored, as carts decode them. Unknown chips are
+// taken to have uniform DEFAULT_SECTOR_SIZE sectors.
+func (c *Chip) SectorAt(addr int) Sector {
+	if !c.Known() || c.Size <= 0 {
+		return Sector{Addr: addr - addr%DEFAULT_SECTOR_SIZE, Size: DEFAULT_SECTOR_SIZE}
+	}
+	base := addr - addr%c.Size
+	off := addr - base
+	start := 0
+	for _, r := range c.Regions {
+		if off < start+r.Size*r.Count {
+			n := (off - start) / r.Size
+			return Sector{Addr: base + start + n*r.Size, Size: r.Size}
+		}
+		start += r.Size * r.Count
+	}
+	// regions shorter than Size: treat the rest as one sector
+	return Sector{Addr: base + start, Size: c.Size - start}
+}
+
+// BootSector returns the sector a boot block lock protects: the last sector
+// of a top boot chip, otherwise the first, where flash carts keep their menu
+// or loader.
+func (c *Chip) BootSector() Sector {
+	if c.Known() && c.Boot == BOOT_TOP {
+		return c.SectorAt(c.Size - 1)
+	}
+	return c.SectorAt(0)
+}
+
+// SectorsIn returns the sectors that have to be erased to write the bytes
+// from start up to end.
+func (c *Chip) SectorsIn(start int, end int) []Sector {
+	var sectors []Sector
+	for addr := start; addr < end; {
+		s := c.SectorAt(addr)
+		sectors = append(sectors, s)
+		addr = s.Addr + s.Size
+	}
+	return sectors
+}
+
+// Lookup returns the chip with the given IDs from Chips, or a Chip with
+// only the IDs set if it isn't known.
+func Lookup(manufacturer byte, device uint16) *Chip {
+	for _, c := range Chips {
+		if c.Manufacturer == manufacturer && c.Device == device {
+			c := c
+			return &c
+		}
+	}
+	return &Chip{Manufacturer: manufacturer, Device: device}
+}
+
+// uniform and boot sector layouts of the common sizes
+var (
+	uniform64K = func(size int) []Region { return []Region{{0x10000, size / 0x10000}} }
+	uniform4K  = func(size int) []Region { return []Region{{0x1000, size / 0x1000}} }
+
+	// Am29LV160 style: 16K, 8K, 8K, 32K, then 64K sectors
+	bottom160 = []Region{{0x4000, 1}, {0x2000, 2}, {0x8000, 1}, {0x10000, 31}}
+	top160    = []Region{{0x10000, 31}, {0x8000, 1}, {0x2000, 2}, {0x4000, 1}}
+	// Am29LV320 style: 8 8K sectors, then 64K sectors
+	bottom8K = func(size int) []Region { return []Region{{0x2000, 8}, {0x10000, size/0x10000 - 1}} }
+	top8K    = func(size int) []Region { return []Region{{0x10000, size/0x10000 - 1}, {0x2000, 8}} }
+)
+
+// Chips is the database of known chips, from their datasheets.
+var Chips = []Chip{
+	// 8-bit parts common on Game Boy flash carts
+	{0x01, 0x20, "Am29F010", 0x20000, []Region{{0x4000, 8}}, AMD, BOOT_NONE},
+	{0x01, 0xa4, "Am29F040", 0x80000, uniform64K(0x80000), AMD, BOOT_NONE},
+	{0x01, 0xd5, "Am29F080", 0x100000, uniform64K(0x100000), AMD, BOOT_NONE},
+	{0x01, 0xad, "Am29F016", 0x200000, uniform64K(0x200000), AMD, BOOT_NONE},
+	{0x01, 0x41, "Am29F032", 0x400000, uniform64K(0x400000), AMD, BOOT_NONE},
+	{0x04, 0xd5, "MBM29F080", 0x100000, uniform64K(0x100000), AMD, BOOT_NONE},
+	{0x04, 0xad, "MBM29F016", 0x200000, uniform64K(0x200000), AMD, BOOT_NONE},
+	{0xad, 0xd5, "HY29F080", 0x100000, uniform64K(0x100000), AMD, BOOT_NONE},
+	{0xc2, 0xa4, "MX29F040", 0x80000, uniform64K(0x80000), AMD, BOOT_NONE},
+	{0xbf, 0xb5, "SST39SF010A", 0x20000, uniform4K(0x20000), AMD_5555, BOOT_NONE},
+	{0xbf, 0xb6, "SST39SF020A", 0x40000, uniform4K(0x40000), AMD_5555, BOOT_NONE},
+	{0xbf, 0xb7, "SST39SF040", 0x80000, uniform4K(0x80000), AMD_5555, BOOT_NONE},
+
+	// 16-bit parts common on Mega Drive flash carts, word mode IDs
+	{0x01, 0x2249, "Am29LV160DB", 0x200000, bottom160, AMD, BOOT_BOTTOM},
+	{0x01, 0x22c4, "Am29LV160DT", 0x200000, top160, AMD, BOOT_TOP},
+	{0x01, 0x22f9, "Am29LV320DB", 0x400000, bottom8K(0x400000), AMD, BOOT_BOTTOM},
+	{0x01, 0x22f6, "Am29LV320DT", 0x400000, top8K(0x400000), AMD, BOOT_TOP},
+	{0x04, 0x2249, "MBM29LV160BE", 0x200000, bottom160, AMD, BOOT_BOTTOM},
+	{0x04, 0x22c4, "MBM29LV160TE", 0x200000, top160, AMD, BOOT_TOP},
+	{0xc2, 0x2249, "MX29LV160DB", 0x200000, bottom160, AMD, BOOT_BOTTOM},
+	{0xc2, 0x22c4, "MX29LV160DT", 0x200000, top160, AMD, BOOT_TOP},
+	{0xc2, 0x22a8, "MX29LV320EB", 0x400000, bottom8K(0x400000), AMD, BOOT_BOTTOM},
+	{0xc2, 0x22a7, "MX29LV320ET", 0x400000, top8K(0x400000), AMD, BOOT_TOP},
+	{0xc2, 0x22cb, "MX29LV640EB", 0x800000, bottom8K(0x800000), AMD, BOOT_BOTTOM},
+	{0xc2, 0x22c9, "MX29LV640ET", 0x800000, top8K(0x800000), AMD, BOOT_TOP},
+	{0x89, 0x0016, "28F320J3", 0x400000, []Region{{0x20000, 32}}, INTEL, BOOT_NONE},
+	{0x89, 0x0017, "28F640J3", 0x800000, []Region{{0x20000, 64}}, INTEL, BOOT_NONE},
+}
+
+// Manufacturers maps JEDEC manufacturer IDs to names.
+var Manufacturers = map[byte]string{
+	0x01: "AMD",
+	0x02: "AMI",
+	0xe5: "Analog Devices",
+	0x1f: "Atmel",
+	0x31: "Catalyst",
+	0x34: "Cypress",
+	0x04: "Fujitsu",
+	0xE0: "Goldstar",
+	0x07: "Hitachi",
+	0xad: "Hyundai",
+	0xc1: "Infineon",
+	0x89: "Intel",
+	0xd5: "Intg. Silicon Systems",
+	0xc2: "Macronix",
+	0x29: "Microchip",
+	0x2c: "Micron",
+	0x1c: "Mitsubishi",
+	0x10: "Nec",
+	0x15: "Philips Semiconductors",
+	0xce: "Samsung",
+	0x62: "Sanyo",
+	0x20: "SGS Thomson",
+	0xb0: "Sharp",
+	0xbf: "SST",
+	0x97: "Texas Instruments",
+	0x98: "Toshiba",
+	0xda: "Winbond",
+	0x19: "Xicor",
+	0xc9: "Xilinx",
+}
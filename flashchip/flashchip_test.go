@@ -0,0 +1,98 @@
+package flashchip
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestChips(t *testing.T) {
+	seen := map[[2]int]bool{}
+	for _, c := range Chips {
+		id := [2]int{int(c.Manufacturer), int(c.Device)}
+		if seen[id] {
+			t.Errorf("%s: IDs 0x%02X 0x%04X already in Chips", c.Name, c.Manufacturer, c.Device)
+		}
+		seen[id] = true
+		if c.ManufacturerName() == "" {
+			t.Errorf("%s: no name for manufacturer 0x%02X", c.Name, c.Manufacturer)
+		}
+		total := 0
+		for _, s := range c.Sectors() {
+			if s.Addr != total {
+				t.Fatalf("%s: sector at %#x, want %#x", c.Name, s.Addr, total)
+			}
+			total += s.Size
+		}
+		if total != c.Size {
+			t.Errorf("%s: sectors cover %#x bytes, want %#x", c.Name, total, c.Size)
+		}
+	}
+}
+
+func TestLookup(t *testing.T) {
+	c := Lookup(0xc2, 0x22a8)
+	if !c.Known() || c.Name != "MX29LV320EB" || c.Boot != BOOT_BOTTOM {
+		t.Errorf("Lookup(0xC2, 0x22A8): got %+v", c)
+	}
+	if got, want := c.String(), "Macronix MX29LV320EB, 4MiB bottom boot"; got != want {
+		t.Errorf("String: got %q, want %q", got, want)
+	}
+	c.Name = "changed"
+	if Lookup(0xc2, 0x22a8).Name != "MX29LV320EB" {
+		t.Error("Lookup returned a chip sharing Chips' storage")
+	}
+
+	c = Lookup(0xc2, 0x1234)
+	if c.Known() || c.Manufacturer != 0xc2 || c.Device != 0x1234 {
+		t.Errorf("Lookup(0xC2, 0x1234): got %+v", c)
+	}
+	if got, want := c.String(), "unknown Macronix chip 0x1234"; got != want {
+		t.Errorf("String: got %q, want %q", got, want)
+	}
+}
+
+func TestSectorsIn(t *testing.T) {
+	tests := []struct {
+		chip       *Chip
+		start, end int
+		want       []Sector
+	}{
+		{Lookup(0x01, 0x2249), 0, 0x14000, []Sector{
+			{0, 0x4000}, {0x4000, 0x2000}, {0x6000, 0x2000}, {0x8000, 0x8000}, {0x10000, 0x10000},
+		}},
+		{Lookup(0x01, 0x22c4), 0x1f0000, 0x200000, []Sector{
+			{0x1f0000, 0x8000}, {0x1f8000, 0x2000}, {0x1fa000, 0x2000}, {0x1fc000, 0x4000},
+		}},
+		{Lookup(0xc2, 0x22a8), 0x400000, 0x404000, []Sector{ // mirrored
+			{0x400000, 0x2000}, {0x402000, 0x2000},
+		}},
+		{Lookup(0xbf, 0xb5), 0x800, 0x2800, []Sector{
+			{0, 0x1000}, {0x1000, 0x1000}, {0x2000, 0x1000},
+		}},
+		{&Chip{}, 0x8000, 0x30000, []Sector{
+			{0, 0x10000}, {0x10000, 0x10000}, {0x20000, 0x10000},
+		}},
+	}
+	for _, tt := range tests {
+		if got := tt.chip.SectorsIn(tt.start, tt.end); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%v SectorsIn(%#x, %#x): got %v, want %v", tt.chip, tt.start, tt.end, got, tt.want)
+		}
+	}
+}
+
+func TestBootSector(t *testing.T) {
+	tests := []struct {
+		chip *Chip
+		want Sector
+	}{
+		{Lookup(0x01, 0xad), Sector{0, 0x10000}},         // uniform
+		{Lookup(0x01, 0x2249), Sector{0, 0x4000}},        // bottom boot
+		{Lookup(0x01, 0x22c4), Sector{0x1fc000, 0x4000}}, // top boot
+		{&Chip{}, Sector{0, DEFAULT_SECTOR_SIZE}},
+	}
+	for _, tt := range tests {
+		if got := tt.chip.BootSector(); got != tt.want {
+			t.Errorf("%v BootSector: got %v, want %v", tt.chip, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package gbcart
+
+import (
+	"fmt"
+	"image"
+)
+
+// Game Boy Camera save RAM layout, from Pan Docs.
+const (
+	CAMERA_RAM_SIZE     = 128 * 1024
+	CAMERA_PHOTOS       = 30
+	CAMERA_STATE_OFFSET = 0x11b2 // one byte per slot: album position, or 0xFF if deleted
+	CAMERA_PHOTO_OFFSET = 0x2000 // slot 0, the rest follow
+	CAMERA_PHOTO_SIZE   = 0x1000 // image, then thumbnail and photo info
+
+	CAMERA_WIDTH  = 128
+	CAMERA_HEIGHT = 112
+
+	CAMERA_DELETED = 0xff
+)
+
+// Shades maps 2bpp colour numbers to grey levels, 0 the lightest.
+var Shades = [4]uint8{0xff, 0xaa, 0x55, 0x00}
+
+// Photo is one of the camera's photo slots.
+type Photo struct {
+	Slot  int // 0-29, where it's stored in RAM
+	Album int // position in the album from 0, -1 if deleted
+	Image *image.Gray
+}
+
+// Deleted reports whether the slot is free. Its image is whatever was
+// there last, often an old photo.
+func (p *Photo) Deleted() bool {
+	return p.Album < 0
+}
+
+// CameraPhotos decodes the photo slots in the save RAM of a Game Boy Camera,
+// including deleted ones. A slot whose album position is out of range is
+// taken as deleted.
+func CameraPhotos(ram []byte) ([]Photo, error) {
+	if len(ram) != CAMERA_RAM_SIZE {
+		return nil, fmt.Errorf("camera RAM: %d bytes, want %d", len(ram), CAMERA_RAM_SIZE)
+	}
+	photos := make([]Photo, CAMERA_PHOTOS)
+	for i := range photos {
+		off := CAMERA_PHOTO_OFFSET + i*CAMERA_PHOTO_SIZE
+		photos[i] = Photo{
+			Slot:  i,
+			Album: -1,
+			Image: DecodeTiles(ram[off:], CAMERA_WIDTH/8, CAMERA_HEIGHT/8),
+		}
+		if state := ram[CAMERA_STATE_OFFSET+i]; state < CAMERA_PHOTOS {
+			photos[i].Album = int(state)
+		}
+	}
+	return photos, nil
+}
+
+// DecodeTiles decodes w by h 8x8 tiles of 2bpp Game Boy graphics, stored a
+// row of tiles at a time. Each row of a tile is two bytes, the low bits of
+// its 8 pixels then the high bits, leftmost pixel in the top bit.
+func DecodeTiles(b []byte, w int, h int) *image.Gray {
+	img := image.NewGray(image.Rect(0, 0, w*8, h*8))
+	for t := 0; t < w*h; t++ {
+		tile := b[t*16 : t*16+16]
+		x0, y0 := t%w*8, t/w*8
+		for y := 0; y < 8; y++ {
+			lo, hi := tile[2*y], tile[2*y+1]
+			for x := 0; x < 8; x++ {
+				c := lo>>(7-x)&1 | (hi>>(7-x)&1)<<1
+				img.Pix[(y0+y)*img.Stride+x0+x] = Shades[c]
+			}
+		}
+	}
+	return img
+}
@@ -0,0 +1,263 @@
+package gbcart
+
+import (
+	"fmt"
+	"strings"
+)
+
+// MBC is a memory bank controller family.
+type MBC int
+
+const (
+	ROM_ONLY MBC = iota // no MBC, 32KiB of ROM
+	MBC1
+	MBC1M // MBC1 multicart, wired differently, same header codes as MBC1
+	MBC2
+	MMM01
+	MBC3
+	MBC5
+	MBC6
+	MBC7
+	POCKET_CAMERA
+	TAMA5
+	HUC3
+	HUC1
+)
+
+var mbcNames = []string{"ROM", "MBC1", "MBC1M", "MBC2", "MMM01", "MBC3", "MBC5", "MBC6", "MBC7", "POCKET CAMERA", "BANDAI TAMA5", "HuC3", "HuC1"}
+
+func (m MBC) String() string {
+	if int(m) < len(mbcNames) {
+		return mbcNames[m]
+	}
+	return fmt.Sprintf("MBC(%d)", int(m))
+}
+
+// MarshalText names the MBC in JSON.
+func (m MBC) MarshalText() ([]byte, error) {
+	return []byte(m.String()), nil
+}
+
+// CartType is the cartridge type at 0x147, split into what it describes.
+type CartType struct {
+	Code    byte
+	MBC     MBC
+	RAM     bool // external RAM, sized by the RAM size code
+	Battery bool // RAM (and timer) kept with the power off
+	Timer   bool // MBC3 real time clock
+	Rumble  bool
+	Sensor  bool // MBC7 accelerometer
+	Known   bool // Code is a cart type documented in Pan Docs
+}
+
+// cartTypes lists the documented cart types, from Pan Docs. 0x1F is the
+// Pocket Camera in the GB CPU Manual, later carts use 0xFC.
+var cartTypes = []CartType{
+	{Code: 0x00, MBC: ROM_ONLY},
+	{Code: 0x01, MBC: MBC1},
+	{Code: 0x02, MBC: MBC1, RAM: true},
+	{Code: 0x03, MBC: MBC1, RAM: true, Battery: true},
+	{Code: 0x05, MBC: MBC2},
+	{Code: 0x06, MBC: MBC2, Battery: true},
+	{Code: 0x08, MBC: ROM_ONLY, RAM: true},
+	{Code: 0x09, MBC: ROM_ONLY, RAM: true, Battery: true},
+	{Code: 0x0b, MBC: MMM01},
+	{Code: 0x0c, MBC: MMM01, RAM: true},
+	{Code: 0x0d, MBC: MMM01, RAM: true, Battery: true},
+	{Code: 0x0f, MBC: MBC3, Timer: true, Battery: true},
+	{Code: 0x10, MBC: MBC3, Timer: true, RAM: true, Battery: true},
+	{Code: 0x11, MBC: MBC3},
+	{Code: 0x12, MBC: MBC3, RAM: true},
+	{Code: 0x13, MBC: MBC3, RAM: true, Battery: true},
+	{Code: 0x19, MBC: MBC5},
+	{Code: 0x1a, MBC: MBC5, RAM: true},
+	{Code: 0x1b, MBC: MBC5, RAM: true, Battery: true},
+	{Code: 0x1c, MBC: MBC5, Rumble: true},
+	{Code: 0x1d, MBC: MBC5, Rumble: true, RAM: true},
+	{Code: 0x1e, MBC: MBC5, Rumble: true, RAM: true, Battery: true},
+	{Code: 0x1f, MBC: POCKET_CAMERA, RAM: true, Battery: true},
+	{Code: 0x20, MBC: MBC6, RAM: true, Battery: true},
+	{Code: 0x22, MBC: MBC7, Sensor: true, Rumble: true, RAM: true, Battery: true},
+	{Code: 0xfc, MBC: POCKET_CAMERA, RAM: true, Battery: true},
+	{Code: 0xfd, MBC: TAMA5},
+	{Code: 0xfe, MBC: HUC3, RAM: true, Battery: true, Timer: true},
+	{Code: 0xff, MBC: HUC1, RAM: true, Battery: true},
+}
+
+// LookupCartType returns the CartType for the code at 0x147. Unknown codes
+// give a CartType with only Code set and Known false.
+func LookupCartType(code byte) CartType {
+	for _, t := range cartTypes {
+		if t.Code == code {
+			t.Known = true
+			return t
+		}
+	}
+	return CartType{Code: code}
+}
+
+// String names the cart type the way Pan Docs does, eg.
+// "MBC5+RUMBLE+RAM+BATTERY".
+func (t CartType) String() string {
+	if !t.Known {
+		return fmt.Sprintf("Unknown (0x%02X)", t.Code)
+	}
+	switch {
+	case t.MBC == ROM_ONLY && !t.RAM:
+		return "ROM ONLY"
+	case t.MBC == POCKET_CAMERA || t.MBC == HUC3:
+		// named alone, their RAM, battery and clock are implied
+		return t.MBC.String()
+	}
+	parts := []string{t.MBC.String()}
+	if t.Timer {
+		parts = append(parts, "TIMER")
+	}
+	if t.Sensor {
+		parts = append(parts, "SENSOR")
+	}
+	if t.Rumble {
+		parts = append(parts, "RUMBLE")
+	}
+	if t.RAM {
+		parts = append(parts, "RAM")
+	}
+	if t.Battery {
+		parts = append(parts, "BATTERY")
+	}
+	return strings.Join(parts, "+")
+}
+
+// RamBytes returns the size of the RAM a cart of this type has for a RAM
+// size code, 0 for types without external RAM whatever the code says. MBC2
+// has MBC2_RAM_SIZE built in, with a RAM size code of 0.
+func (t CartType) RamBytes(code byte) (int, bool) {
+	switch {
+	case t.MBC == MBC2:
+		return MBC2_RAM_SIZE, true
+	case t.Known && !t.RAM:
+		return 0, true
+	}
+	return RamSize(code)
+}
+
+// RamSizeString formats RamBytes, "" if the code is unknown.
+func (t CartType) RamSizeString(code byte) string {
+	n, ok := t.RamBytes(code)
+	if !ok {
+		return ""
+	}
+	return SizeString(n)
+}
+
+// MBC2 RAM is 512 4-bit cells, saved one to a byte.
+const MBC2_RAM_SIZE = 512
+
+// NormalizeMBC2RAM sets the upper 4 bits of each byte of b, which MBC2 RAM
+// doesn't store, to 1s as the cart reads them, so saves compare equal
+// whatever wrote them.
+func NormalizeMBC2RAM(b []byte) {
+	for i := range b {
+		b[i] |= 0xf0
+	}
+}
+
+// Sizes returns the ROM and RAM sizes in bytes of a cart with type typ and
+// size codes romCode and ramCode, or an error naming a code it doesn't know.
+// The sizes it does know are still returned.
+func Sizes(typ byte, romCode byte, ramCode byte) (rom int, ram int, err error) {
+	var bad []string
+	rom, ok := RomSize(romCode)
+	if !ok {
+		bad = append(bad, fmt.Sprintf("ROM size code 0x%02X", romCode))
+	}
+	t := LookupCartType(typ)
+	if ram, ok = t.RamBytes(ramCode); !ok {
+		bad = append(bad, fmt.Sprintf("RAM size code 0x%02X", ramCode))
+	}
+	if !t.Known {
+		bad = append(bad, fmt.Sprintf("cart type 0x%02X", typ))
+	}
+	if bad != nil {
+		err = fmt.Errorf("unknown %s", strings.Join(bad, ", "))
+	}
+	return rom, ram, err
+}
+
+// RomSize returns the ROM size for the code at 0x148: 32KiB << code, or
+// 72, 80 or 96 banks for the unofficial 0x52-0x54.
+func RomSize(code byte) (int, bool) {
+	switch {
+	case code <= 0x08:
+		return 0x8000 << code, true
+	case code >= 0x52 && code <= 0x54:
+		return []int{72, 80, 96}[code-0x52] * BANK_SIZE, true
+	}
+	return 0, false
+}
+
+// RamSize returns the RAM size for the code at 0x149.
+func RamSize(code byte) (int, bool) {
+	sizes := []int{0, 2 * 1024, 8 * 1024, 32 * 1024, 128 * 1024, 64 * 1024}
+	if int(code) < len(sizes) {
+		return sizes[code], true
+	}
+	return 0, false
+}
+
+// SizeString formats a size in bytes as "512B", "32KB" or "1.5MB".
+func SizeString(n int) string {
+	switch {
+	case n >= 1024*1024:
+		return fmt.Sprintf("%gMB", float64(n)/(1024*1024))
+	case n > 0 && n < 1024:
+		return fmt.Sprintf("%dB", n)
+	}
+	return fmt.Sprintf("%dKB", n/1024)
+}
+
+// sizeMap tabulates a size function over every code it knows.
+func sizeMap(size func(byte) (int, bool)) map[byte]int {
+	m := map[byte]int{}
+	for code := 0; code < 0x100; code++ {
+		if n, ok := size(byte(code)); ok {
+			m[byte(code)] = n
+		}
+	}
+	return m
+}
+
+func stringMap(sizes map[byte]int) map[byte]string {
+	m := map[byte]string{}
+	for code, n := range sizes {
+		m[code] = SizeString(n)
+	}
+	return m
+}
+
+// Size tables by code, kept for callers that index them.
+var (
+	RomSizeBytes = sizeMap(RomSize)
+	RamSizeBytes = sizeMap(RamSize)
+	RomSizes     = stringMap(RomSizeBytes)
+	RamSizes     = stringMap(RamSizeBytes)
+)
+
+// IsMBC1M reports whether rom, a 1MiB MBC1 image, is a multicart: the
+// MBC1M wiring puts each game in 256KiB, and the later games have their own
+// header and logo at the start of their first bank.
+func IsMBC1M(rom []byte) bool {
+	if len(rom) != 0x100000 {
+		return false
+	}
+	h, err := ParseHeader(rom)
+	if err != nil || LookupCartType(h.CartType).MBC != MBC1 {
+		return false
+	}
+	for _, off := range []int{0x40000, 0x80000, 0xc0000} {
+		if hh, err := ParseHeader(rom[off:]); err == nil && hh.LogoCorrect() {
+			return true
+		}
+	}
+	return false
+}
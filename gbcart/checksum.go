@@ -0,0 +1,210 @@
+package gbcart
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/grantek/fkmd/memcart"
+)
+
+// BANK_SIZE is the size of a switchable ROM bank, the unit bad reads are
+// tracked in.
+const BANK_SIZE = 0x4000
+
+// HeaderChecksum returns the checksum of 0x134-0x14C the boot ROM checks
+// against 0x14D.
+func HeaderChecksum(rom []byte) byte {
+	var h byte
+	for _, v := range rom[0x134:0x14d] {
+		h = h - v - 1
+	}
+	return h
+}
+
+// GlobalChecksum returns the sum of every byte of rom except the global
+// checksum at 0x14E-0x14F itself.
+func GlobalChecksum(rom []byte) uint16 {
+	var g uint16
+	for i, v := range rom {
+		if i != 0x14e && i != 0x14f {
+			g += uint16(v)
+		}
+	}
+	return g
+}
+
+// ChecksumError describes checksums in a ROM image that don't match its
+// header.
+type ChecksumError struct {
+	HeaderGot, HeaderWant byte
+	GlobalGot, GlobalWant uint16
+}
+
+func (e *ChecksumError) Error() string {
+	var s []string
+	if e.HeaderGot != e.HeaderWant {
+		s = append(s, fmt.Sprintf("header checksum 0x%02X, header says 0x%02X", e.HeaderGot, e.HeaderWant))
+	}
+	if e.GlobalGot != e.GlobalWant {
+		s = append(s, fmt.Sprintf("global checksum 0x%04X, header says 0x%04X", e.GlobalGot, e.GlobalWant))
+	}
+	return "bad " + joinAnd(s)
+}
+
+func joinAnd(s []string) string {
+	if len(s) == 2 {
+		return s[0] + " and " + s[1]
+	}
+	return s[0]
+}
+
+// Verify computes the header and global checksums of rom, and returns a
+// *ChecksumError if either doesn't match h.
+func (h *Header) Verify(rom []byte) error {
+	e := &ChecksumError{
+		HeaderGot:  HeaderChecksum(rom),
+		HeaderWant: h.HeaderChecksum,
+		GlobalGot:  GlobalChecksum(rom),
+		GlobalWant: h.GlobalChecksum,
+	}
+	if e.HeaderGot != e.HeaderWant || e.GlobalGot != e.GlobalWant {
+		return e
+	}
+	return nil
+}
+
+// DiffBanks returns the index of each BANK_SIZE bank that differs between a
+// and b.
+func DiffBanks(a []byte, b []byte) []int {
+	var banks []int
+	for off := 0; off < len(a) || off < len(b); off += BANK_SIZE {
+		if !bytes.Equal(bank(a, off), bank(b, off)) {
+			banks = append(banks, off/BANK_SIZE)
+		}
+	}
+	return banks
+}
+
+func bank(b []byte, off int) []byte {
+	if off >= len(b) {
+		return nil
+	}
+	if off+BANK_SIZE > len(b) {
+		return b[off:]
+	}
+	return b[off : off+BANK_SIZE]
+}
+
+// Vote builds a ROM image from several reads of it, taking each bank from
+// the first version of it that at least two reads agree on. Banks no two
+// reads agree on are taken from the last read and returned as bad.
+func Vote(reads [][]byte) ([]byte, []int) {
+	last := reads[len(reads)-1]
+	rom := make([]byte, len(last))
+	var bad []int
+	for off := 0; off < len(rom); off += BANK_SIZE {
+		var agreed []byte
+		for i := 0; i < len(reads) && agreed == nil; i++ {
+			for j := i + 1; j < len(reads); j++ {
+				if bytes.Equal(bank(reads[i], off), bank(reads[j], off)) {
+					agreed = bank(reads[i], off)
+					break
+				}
+			}
+		}
+		if agreed == nil {
+			agreed = bank(last, off)
+			bad = append(bad, off/BANK_SIZE)
+		}
+		copy(rom[off:], agreed)
+	}
+	return rom, bad
+}
+
+// VerifyDump checks the checksums of rom, a dump of bank 0 of mc. If they
+// fail it reads the bank again, up to rereads times, and votes on each
+// 16KiB bank until the checksums pass. It returns the best image it has,
+// the banks that differed between reads and an error if the checksums
+// still fail. If every read agrees the dump is likely good and the header's
+// checksums wrong, which the error says.
+func VerifyDump(mc memcart.MemCart, rom []byte, rereads int) ([]byte, []int, error) {
+	h, err := ParseHeader(rom)
+	if err != nil {
+		return rom, nil, err
+	}
+	if err = h.Verify(rom); err == nil {
+		return rom, nil, nil
+	}
+	reads := [][]byte{rom}
+	flagged := map[int]bool{}
+	for i := 0; i < rereads; i++ {
+		var buf bytes.Buffer
+		if _, rerr := memcart.ReadBank(mc, 0, &buf, len(rom)); rerr != nil {
+			return rom, sortedBanks(flagged), fmt.Errorf("%v, re-reading: %v", err, rerr)
+		}
+		for _, b := range DiffBanks(rom, buf.Bytes()) {
+			flagged[b] = true
+		}
+		reads = append(reads, buf.Bytes())
+		voted, bad := Vote(reads)
+		if len(bad) > 0 {
+			continue
+		}
+		if err = h.Verify(voted); err == nil {
+			return voted, sortedBanks(flagged), nil
+		}
+		if len(flagged) == 0 && len(reads) > 2 {
+			// three identical reads, don't keep trying
+			break
+		}
+	}
+	if len(flagged) == 0 {
+		return rom, nil, fmt.Errorf("%v, but %d reads agree: the header may be wrong", err, len(reads))
+	}
+	voted, _ := Vote(reads)
+	return voted, sortedBanks(flagged), err
+}
+
+func sortedBanks(m map[int]bool) []int {
+	var banks []int
+	for b := 0; len(banks) < len(m); b++ {
+		if m[b] {
+			banks = append(banks, b)
+		}
+	}
+	return banks
+}
+
+// MirrorSize returns the smallest power of two number of bytes, of 2 banks
+// or more, that rom repeats with, or len(rom) if it doesn't. Reading past
+// the end of a cart wraps the bank number, so a dump larger than the ROM
+// is made of copies of it. Like the Mega Drive size probe, it compares a
+// sample of banks at power of two offsets into each would-be copy, banks
+// n+1, n+2, n+4 and so on against banks 1, 2, 4. Bank 0 is never compared:
+// its copies are read through the switchable bank, which on MBC1 can't
+// select banks 0x20, 0x40 and 0x60. A size below min, eg. the header's, is
+// only returned if the banks that repeat aren't all blank, since the
+// padding of a ROM repeats itself too.
+func MirrorSize(rom []byte, min int) int {
+	for n := 2 * BANK_SIZE; n < len(rom); n *= 2 {
+		mirrored, blank := true, true
+		for off := BANK_SIZE; off < n && n+off < len(rom) && mirrored; off *= 2 {
+			mirrored = bytes.Equal(bank(rom, n+off), bank(rom, off))
+			blank = blank && isBlank(bank(rom, off))
+		}
+		if mirrored && (n >= min || !blank) {
+			return n
+		}
+	}
+	return len(rom)
+}
+
+// isBlank reports whether b is all one value, eg. 0xFF padding.
+func isBlank(b []byte) bool {
+	for _, v := range b {
+		if v != b[0] {
+			return false
+		}
+	}
+	return true
+}
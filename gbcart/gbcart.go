@@ -0,0 +1,249 @@
+// Package gbcart parses the header of Game Boy ROM images, documented at
+// gbdev.io/pandocs/The_Cartridge_Header.html.
+package gbcart
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	HDR_OFFSET = 0x100
+	HDR_LEN    = 0x50
+
+	LOGO_OFFSET  = 0x104
+	TITLE_OFFSET = 0x134
+	TITLE_LEN    = 16
+)
+
+// Logo is the bitmap at 0x104 the Game Boy boot ROM checks.
+var Logo = [48]byte{
+	0xce, 0xed, 0x66, 0x66, 0xcc, 0x0d, 0x00, 0x0b, 0x03, 0x73, 0x00, 0x83,
+	0x00, 0x0c, 0x00, 0x0d, 0x00, 0x08, 0x11, 0x1f, 0x88, 0x89, 0x00, 0x0e,
+	0xdc, 0xcc, 0x6e, 0xe6, 0xdd, 0xdd, 0xd9, 0x99, 0xbb, 0xbb, 0x67, 0x63,
+	0x6e, 0x0e, 0xec, 0xcc, 0xdd, 0xdc, 0x99, 0x9f, 0xbb, 0xb9, 0x33, 0x3e,
+}
+
+var Destinations = map[byte]string{
+	0x00: "Japan",
+	0x01: "Overseas",
+}
+
+// GBCartInfo is human-readable version of DeviceCartInfo, or of a Header.
+// Manufacturer, ChipID, FlashChip and BBL describe the flash chip and only
+// come from the device.
+type GBCartInfo struct {
+	Manufacturer      string
+	ChipID            byte
+	FlashChip         string `json:",omitempty"` // from the flashchip database, if known
+	BBL               bool
+	LogoCorrect       bool
+	CGB               bool
+	SGB               bool
+	ROMSize           string
+	RAMSize           string
+	CRC16             uint16
+	CartType          string // Type as a string
+	Type              CartType
+	GameNamePrintable string
+
+	// Only known from the ROM header.
+	Title            string `json:",omitempty"`
+	ManufacturerCode string `json:",omitempty"`
+	Licensee         string `json:",omitempty"`
+	Destination      string `json:",omitempty"`
+	Version          byte   `json:",omitempty"`
+	HeaderChecksum   byte   `json:",omitempty"`
+}
+
+// Diff returns a line for each field that g and o both know and that
+// differs, eg. to compare what the device reported with a dumped header.
+func (g *GBCartInfo) Diff(o *GBCartInfo) []string {
+	var diffs []string
+	check := func(name string, a, b interface{}) {
+		if a != b {
+			diffs = append(diffs, fmt.Sprintf("%s: %v != %v", name, a, b))
+		}
+	}
+	check("GameNamePrintable", g.GameNamePrintable, o.GameNamePrintable)
+	check("LogoCorrect", g.LogoCorrect, o.LogoCorrect)
+	check("CGB", g.CGB, o.CGB)
+	check("SGB", g.SGB, o.SGB)
+	// compare the header codes, as MBC1M is inferred from the ROM and has
+	// MBC1's code
+	if g.Type.Code != o.Type.Code {
+		check("CartType", g.CartType, o.CartType)
+	}
+	check("ROMSize", g.ROMSize, o.ROMSize)
+	check("RAMSize", g.RAMSize, o.RAMSize)
+	check("CRC16", g.CRC16, o.CRC16)
+	return diffs
+}
+
+// Header holds the raw fields of the cartridge header at 0x100-0x14F.
+type Header struct {
+	Logo             [48]byte
+	TitleBytes       [TITLE_LEN]byte // 0x134-0x143, overlapping the next two on later carts
+	ManufacturerCode string          // 0x13F-0x142, "" if not present
+	CGBFlag          byte            // 0x143
+	NewLicensee      string          // 0x144-0x145, used if OldLicensee is 0x33
+	SGBFlag          byte            // 0x146
+	CartType         byte            // 0x147
+	ROMSize          byte            // 0x148
+	RAMSize          byte            // 0x149
+	Destination      byte            // 0x14A
+	OldLicensee      byte            // 0x14B
+	Version          byte            // 0x14C
+	HeaderChecksum   byte            // 0x14D
+	GlobalChecksum   uint16          // 0x14E-0x14F, big-endian
+}
+
+// ParseHeader reads the header of a ROM image. rom needs to hold at least
+// the first 0x150 bytes.
+func ParseHeader(rom []byte) (*Header, error) {
+	if len(rom) < HDR_OFFSET+HDR_LEN {
+		return nil, fmt.Errorf("ROM too short for a header: %d bytes", len(rom))
+	}
+	h := &Header{}
+	copy(h.Logo[:], rom[LOGO_OFFSET:])
+	copy(h.TitleBytes[:], rom[TITLE_OFFSET:])
+	h.CGBFlag = rom[0x143]
+	if h.CGB() && isCode(rom[0x13f:0x143]) {
+		h.ManufacturerCode = string(rom[0x13f:0x143])
+	}
+	h.NewLicensee = string(rom[0x144:0x146])
+	h.SGBFlag = rom[0x146]
+	h.CartType = rom[0x147]
+	h.ROMSize = rom[0x148]
+	h.RAMSize = rom[0x149]
+	h.Destination = rom[0x14a]
+	h.OldLicensee = rom[0x14b]
+	h.Version = rom[0x14c]
+	h.HeaderChecksum = rom[0x14d]
+	h.GlobalChecksum = uint16(rom[0x14e])<<8 | uint16(rom[0x14f])
+	return h, nil
+}
+
+// isCode reports whether b looks like a manufacturer code, upper case
+// letters and digits.
+func isCode(b []byte) bool {
+	for _, v := range b {
+		if !(v >= 'A' && v <= 'Z' || v >= '0' && v <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// CGB reports whether the cart supports Game Boy Color functions, 0x80 or
+// 0xC0 (CGB only) in the CGB flag.
+func (h *Header) CGB() bool {
+	return h.CGBFlag&0x80 != 0
+}
+
+// SGB reports whether the cart supports Super Game Boy functions.
+func (h *Header) SGB() bool {
+	return h.SGBFlag == 0x03
+}
+
+// LogoCorrect reports whether the logo bitmap would pass the boot ROM check.
+func (h *Header) LogoCorrect() bool {
+	return h.Logo == Logo
+}
+
+// Title returns the game title, which is shorter on carts that use some of
+// its bytes for the manufacturer code or CGB flag.
+func (h *Header) Title() string {
+	b := h.TitleBytes[:]
+	switch {
+	case h.ManufacturerCode != "":
+		b = b[:11]
+	case h.CGB():
+		b = b[:15]
+	}
+	if i := strings.IndexByte(string(b), 0); i >= 0 {
+		b = b[:i]
+	}
+	return strings.TrimSpace(string(b))
+}
+
+// GameNamePrintable returns the title bytes up to the first unprintable one,
+// the way the device reports it.
+func (h *Header) GameNamePrintable() string {
+	return PrintableName(h.TitleBytes[:])
+}
+
+// PrintableName returns b up to the first byte that isn't printable ASCII,
+// such as the 0 padding or a CGB flag of 0xC0.
+func PrintableName(b []byte) string {
+	runes := make([]rune, 0, len(b))
+	for _, v := range b {
+		if v >= 0x80 || !strconv.IsPrint(rune(v)) {
+			break
+		}
+		runes = append(runes, rune(v))
+	}
+	return string(runes)
+}
+
+// Licensee returns the publisher's name from the new or old licensee code,
+// or the code itself if it isn't known.
+func (h *Header) Licensee() string {
+	if h.OldLicensee == 0x33 {
+		if name, ok := NewLicensees[h.NewLicensee]; ok {
+			return name
+		}
+		return fmt.Sprintf("%q", h.NewLicensee)
+	}
+	if name, ok := OldLicensees[h.OldLicensee]; ok {
+		return name
+	}
+	return fmt.Sprintf("0x%02X", h.OldLicensee)
+}
+
+// GBCartInfo returns the header in the same form as the device's cart info.
+func (h *Header) GBCartInfo() *GBCartInfo {
+	t := LookupCartType(h.CartType)
+	g := &GBCartInfo{
+		LogoCorrect:       h.LogoCorrect(),
+		CGB:               h.CGB(),
+		SGB:               h.SGB(),
+		ROMSize:           RomSizes[h.ROMSize],
+		RAMSize:           t.RamSizeString(h.RAMSize),
+		CRC16:             h.GlobalChecksum,
+		CartType:          t.String(),
+		Type:              t,
+		GameNamePrintable: h.GameNamePrintable(),
+		Title:             h.Title(),
+		ManufacturerCode:  h.ManufacturerCode,
+		Licensee:          h.Licensee(),
+		Destination:       Destinations[h.Destination],
+		Version:           h.Version,
+		HeaderChecksum:    h.HeaderChecksum,
+	}
+	return g
+}
+
+// ErrNoHeader is returned by Parse for data that can't be a ROM image.
+var ErrNoHeader = errors.New("no Game Boy header: logo doesn't match")
+
+// Parse reads the header of rom and returns its GBCartInfo. It fails with
+// ErrNoHeader if the logo is wrong, as the boot ROM would. A whole MBC1
+// image is checked for being an MBC1M multicart.
+func Parse(rom []byte) (*GBCartInfo, error) {
+	h, err := ParseHeader(rom)
+	if err != nil {
+		return nil, err
+	}
+	g := h.GBCartInfo()
+	if !h.LogoCorrect() {
+		return g, ErrNoHeader
+	}
+	if IsMBC1M(rom) {
+		g.Type.MBC = MBC1M
+		g.CartType = g.Type.String()
+	}
+	return g, nil
+}
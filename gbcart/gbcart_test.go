@@ -0,0 +1,380 @@
+package gbcart_test
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/grantek/fkmd/gbcart"
+	"github.com/grantek/fkmd/gbcf_sim"
+	"github.com/grantek/fkmd/memcart"
+)
+
+func TestParse(t *testing.T) {
+	rom := gbcf_sim.SampleROM(0x20000, "TESTCART", 0x1b, 0x03)
+	rom[0x146] = 0x03
+	rom[0x144], rom[0x145] = '0', '1'
+	rom[0x14c] = 2
+	g, err := gbcart.Parse(rom)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &gbcart.GBCartInfo{
+		LogoCorrect:       true,
+		SGB:               true,
+		ROMSize:           "128KB",
+		RAMSize:           "32KB",
+		CRC16:             uint16(rom[0x14e])<<8 | uint16(rom[0x14f]),
+		CartType:          "MBC5+RAM+BATTERY",
+		Type:              gbcart.CartType{Code: 0x1b, MBC: gbcart.MBC5, RAM: true, Battery: true, Known: true},
+		GameNamePrintable: "TESTCART",
+		Title:             "TESTCART",
+		Licensee:          "Nintendo R&D1",
+		Destination:       "Overseas",
+		Version:           2,
+		HeaderChecksum:    rom[0x14d],
+	}
+	if !reflect.DeepEqual(g, want) {
+		t.Errorf("Parse: got %+v, want %+v", g, want)
+	}
+}
+
+func TestParseCGB(t *testing.T) {
+	rom := make([]byte, 0x8000)
+	copy(rom[0x104:], gbcart.Logo[:])
+	copy(rom[0x134:], "POKEMON YELAPSE\xc0")
+	rom[0x14a] = 0x00
+	rom[0x14b] = 0x01
+	h, err := gbcart.ParseHeader(rom)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Title() != "POKEMON YEL" || h.ManufacturerCode != "APSE" || !h.CGB() {
+		t.Errorf("ParseHeader: got title %q, manufacturer %q, CGB %v", h.Title(), h.ManufacturerCode, h.CGB())
+	}
+	g := h.GBCartInfo()
+	if g.GameNamePrintable != "POKEMON YELAPSE" || g.Licensee != "Nintendo" || g.Destination != "Japan" {
+		t.Errorf("GBCartInfo: got %+v", g)
+	}
+
+	// lower case in the last bytes is part of a 15 byte title
+	copy(rom[0x134:], "ZELDA DX Engl\x00\x00\x80")
+	h, _ = gbcart.ParseHeader(rom)
+	if h.Title() != "ZELDA DX Engl" || h.ManufacturerCode != "" {
+		t.Errorf("ParseHeader: got title %q, manufacturer %q", h.Title(), h.ManufacturerCode)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	if _, err := gbcart.Parse(make([]byte, 0x14f)); err == nil {
+		t.Error("Parse of a short ROM succeeded")
+	}
+	if _, err := gbcart.Parse(make([]byte, 0x8000)); err != gbcart.ErrNoHeader {
+		t.Errorf("Parse without a logo: got %v, want ErrNoHeader", err)
+	}
+}
+
+func TestCartType(t *testing.T) {
+	for _, tt := range []struct {
+		code byte
+		name string
+	}{
+		{0x00, "ROM ONLY"},
+		{0x09, "ROM+RAM+BATTERY"},
+		{0x0d, "MMM01+RAM+BATTERY"},
+		{0x10, "MBC3+TIMER+RAM+BATTERY"},
+		{0x1e, "MBC5+RUMBLE+RAM+BATTERY"},
+		{0x20, "MBC6+RAM+BATTERY"},
+		{0x22, "MBC7+SENSOR+RUMBLE+RAM+BATTERY"},
+		{0xfc, "POCKET CAMERA"},
+		{0xfe, "HuC3"},
+		{0xff, "HuC1+RAM+BATTERY"},
+		{0x04, "Unknown (0x04)"},
+	} {
+		if got := gbcart.LookupCartType(tt.code).String(); got != tt.name {
+			t.Errorf("LookupCartType(0x%02X): got %q, want %q", tt.code, got, tt.name)
+		}
+	}
+	if ct := gbcart.LookupCartType(0x0f); ct.MBC != gbcart.MBC3 || !ct.Timer || ct.RAM {
+		t.Errorf("LookupCartType(0x0F): got %+v", ct)
+	}
+}
+
+func TestSizes(t *testing.T) {
+	for _, tt := range []struct {
+		typ, rom, ram byte
+		romBytes      int
+		ramBytes      int
+		ok            bool
+	}{
+		{0x03, 0x00, 0x02, 32 * 1024, 8 * 1024, true},
+		{0x1b, 0x05, 0x03, 1024 * 1024, 32 * 1024, true},
+		{0x1b, 0x08, 0x05, 8 * 1024 * 1024, 64 * 1024, true},
+		{0x1b, 0x52, 0x04, 72 * 16 * 1024, 128 * 1024, true},
+		// no RAM on the cart, whatever the RAM size says
+		{0x01, 0x04, 0x03, 512 * 1024, 0, true},
+		// MBC2 RAM is built in
+		{0x06, 0x01, 0x00, 64 * 1024, 512, true},
+		{0x1b, 0x09, 0x02, 0, 8 * 1024, false},
+		{0x1b, 0x01, 0x06, 64 * 1024, 0, false},
+		{0x04, 0x01, 0x00, 64 * 1024, 0, false},
+	} {
+		rom, ram, err := gbcart.Sizes(tt.typ, tt.rom, tt.ram)
+		if rom != tt.romBytes || ram != tt.ramBytes || (err == nil) != tt.ok {
+			t.Errorf("Sizes(0x%02X, 0x%02X, 0x%02X): got %d, %d, %v", tt.typ, tt.rom, tt.ram, rom, ram, err)
+		}
+	}
+	if s := gbcart.LookupCartType(0x06).RamSizeString(0); s != "512B" {
+		t.Errorf("MBC2 RAM size: got %q, want 512B", s)
+	}
+	if gbcart.RomSizes[0x05] != "1MB" || gbcart.RomSizeBytes[0x05] != 1024*1024 || gbcart.RomSizes[0x08] != "8MB" {
+		t.Errorf("RomSizes: got %q, %d, %q", gbcart.RomSizes[0x05], gbcart.RomSizeBytes[0x05], gbcart.RomSizes[0x08])
+	}
+}
+
+func TestMBC1M(t *testing.T) {
+	rom := gbcf_sim.SampleROM(0x100000, "MULTICART", 0x01, 0x00)
+	g, err := gbcart.Parse(rom)
+	if err != nil || g.Type.MBC != gbcart.MBC1 {
+		t.Fatalf("Parse: got %v, %v", g.Type, err)
+	}
+	copy(rom[0x40104:], gbcart.Logo[:])
+	if g, _ = gbcart.Parse(rom); g.Type.MBC != gbcart.MBC1M || g.CartType != "MBC1M" {
+		t.Errorf("Parse of a multicart: got %v", g.Type)
+	}
+	if d := gbcf_sim.New(rom, nil).CartInfo.GBCartInfo().Diff(g); d != nil {
+		t.Errorf("device info and multicart header differ: %q", d)
+	}
+}
+
+func TestRTCAdd(t *testing.T) {
+	r := gbcart.RTC{S: 50, M: 59, H: 23, DL: 0xff, DH: gbcart.RTC_DH_DAY}
+	if got, want := r.Add(15*time.Second), (gbcart.RTC{S: 5, DH: gbcart.RTC_DH_CARRY}); got != want {
+		t.Errorf("Add past day 511: got %v, want %v", got, want)
+	}
+	r = gbcart.RTC{DL: 0xff}
+	if got, want := r.Add(24*time.Hour), (gbcart.RTC{DH: gbcart.RTC_DH_DAY}); got != want {
+		t.Errorf("Add to day 256: got %v, want %v", got, want)
+	}
+	r.DH |= gbcart.RTC_DH_HALT
+	if got := r.Add(time.Hour); got != r {
+		t.Errorf("Add to a halted clock: got %v, want %v", got, r)
+	}
+}
+
+func TestRTCFooter(t *testing.T) {
+	f := &gbcart.RTCFooter{
+		Time:      gbcart.RTC{S: 1, M: 2, H: 3, DL: 4, DH: 0x41},
+		Latched:   gbcart.RTC{S: 5, M: 6, H: 7, DL: 8, DH: 0x80},
+		Timestamp: time.Unix(1700000000, 0),
+	}
+	b, err := f.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b) != gbcart.RTC_FOOTER_LEN || b[16] != 0x41 || b[17] != 0 || b[40] != 0x00 || b[41] != 0xf1 {
+		t.Errorf("MarshalBinary: got % x", b)
+	}
+	ram := bytes.Repeat([]byte{0xaa}, 8*1024)
+	got, g, err := gbcart.SplitSave(append(ram, b...), len(ram))
+	if err != nil || !bytes.Equal(got, ram) || !reflect.DeepEqual(g, f) {
+		t.Errorf("SplitSave: got %d bytes, %+v, %v", len(got), g, err)
+	}
+	// 32-bit timestamp
+	got, g, err = gbcart.SplitSave(append(ram, b[:gbcart.RTC_FOOTER_LEN_OLD]...), len(ram))
+	if err != nil || len(got) != len(ram) || !g.Timestamp.Equal(f.Timestamp) {
+		t.Errorf("SplitSave of a 44 byte footer: got %d bytes, %+v, %v", len(got), g, err)
+	}
+	if got, g, _ = gbcart.SplitSave(ram, len(ram)); len(got) != len(ram) || g != nil {
+		t.Errorf("SplitSave without a footer: got %d bytes, %+v", len(got), g)
+	}
+}
+
+func TestCameraPhotos(t *testing.T) {
+	ram := make([]byte, gbcart.CAMERA_RAM_SIZE)
+	for i := 0; i < gbcart.CAMERA_PHOTOS; i++ {
+		ram[gbcart.CAMERA_STATE_OFFSET+i] = gbcart.CAMERA_DELETED
+	}
+	ram[gbcart.CAMERA_STATE_OFFSET+3] = 0
+	ram[gbcart.CAMERA_STATE_OFFSET+29] = 1
+	// slot 3: first tile's top row is colours 0-3 twice, second tile black
+	slot := ram[gbcart.CAMERA_PHOTO_OFFSET+3*gbcart.CAMERA_PHOTO_SIZE:]
+	slot[0], slot[1] = 0x55, 0x33
+	for i := 16; i < 32; i++ {
+		slot[i] = 0xff
+	}
+	photos, err := gbcart.CameraPhotos(ram)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(photos) != 30 || photos[3].Album != 0 || photos[29].Album != 1 || !photos[0].Deleted() {
+		t.Fatalf("CameraPhotos: got %d photos, slot 3 album %d, slot 29 album %d", len(photos), photos[3].Album, photos[29].Album)
+	}
+	img := photos[3].Image
+	if b := img.Bounds(); b.Dx() != 128 || b.Dy() != 112 {
+		t.Errorf("photo size: got %v", b)
+	}
+	want := []uint8{0xff, 0xaa, 0x55, 0x00, 0xff, 0xaa, 0x55, 0x00, 0x00}
+	if got := img.Pix[:9]; !bytes.Equal(got, want) {
+		t.Errorf("top row: got % x, want % x", got, want)
+	}
+	if got := img.GrayAt(8, 7).Y; got != 0x00 {
+		t.Errorf("second tile: got %#x, want 0", got)
+	}
+	if got := img.GrayAt(0, 8).Y; got != 0xff {
+		t.Errorf("second row of tiles: got %#x, want 0xff", got)
+	}
+	if _, err = gbcart.CameraPhotos(ram[:0x8000]); err == nil {
+		t.Error("CameraPhotos of 32KiB succeeded")
+	}
+}
+
+func TestMirrorSize(t *testing.T) {
+	rom := gbcf_sim.SampleROM(0x10000, "TESTCART", 0x01, 0x00)
+	dump := bytes.Repeat(rom, 4)
+	if got := gbcart.MirrorSize(dump, 0); got != 0x10000 {
+		t.Errorf("MirrorSize of 4 copies of 64KiB: got %#x", got)
+	}
+	if got := gbcart.MirrorSize(dump, 0x20000); got != 0x10000 {
+		t.Errorf("MirrorSize of 4 copies of 64KiB, header 128KiB: got %#x", got)
+	}
+	// MBC1 reads bank 0x21 for bank 0x20
+	copy(dump[0x20000:], rom[0x4000:0x8000])
+	if got := gbcart.MirrorSize(dump, 0); got != 0x10000 {
+		t.Errorf("MirrorSize ignoring bank 0 copies: got %#x", got)
+	}
+	if got := gbcart.MirrorSize(dump[:0x10000], 0); got != 0x10000 {
+		t.Errorf("MirrorSize of one copy: got %#x", got)
+	}
+
+	// 64KiB of ROM, the last 3 banks 0xFF padding
+	rom = gbcf_sim.SampleROM(0x10000, "TESTCART", 0x01, 0x01)
+	for i := 0x4000; i < len(rom); i++ {
+		rom[i] = 0xff
+	}
+	dump = bytes.Repeat(rom, 2)
+	if got := gbcart.MirrorSize(dump, 0x10000); got != 0x10000 {
+		t.Errorf("MirrorSize of padded 64KiB: got %#x", got)
+	}
+	if got := gbcart.MirrorSize(dump, 0); got != 0x8000 {
+		t.Errorf("MirrorSize of padded 64KiB, no header size: got %#x", got)
+	}
+}
+
+func TestDiff(t *testing.T) {
+	rom := gbcf_sim.SampleROM(0x8000, "TESTCART", 0x03, 0x02)
+	dev := gbcf_sim.New(rom, nil).CartInfo.GBCartInfo()
+	g, _ := gbcart.Parse(rom)
+	if d := dev.Diff(g); d != nil {
+		t.Errorf("device info and header differ: %q", d)
+	}
+	rom[0x147] = 0x13
+	g, _ = gbcart.Parse(rom)
+	if d := dev.Diff(g); !reflect.DeepEqual(d, []string{"CartType: MBC1+RAM+BATTERY != MBC3+RAM+BATTERY"}) {
+		t.Errorf("Diff after changing the cart type: got %q", d)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	rom := gbcf_sim.SampleROM(0x10000, "TESTCART", 0x01, 0x00)
+	h, _ := gbcart.ParseHeader(rom)
+	if err := h.Verify(rom); err != nil {
+		t.Fatal(err)
+	}
+	rom[0x8000]++
+	err := h.Verify(rom)
+	if e, ok := err.(*gbcart.ChecksumError); !ok || e.HeaderGot != e.HeaderWant || e.GlobalGot != h.GlobalChecksum+1 {
+		t.Errorf("Verify with a byte of bank 2 changed: got %v", err)
+	}
+	rom[0x134]-- // T to S
+	// the global sum is back where it was, but not the header checksum
+	want := fmt.Sprintf("bad header checksum 0x%02X, header says 0x%02X", h.HeaderChecksum+1, h.HeaderChecksum)
+	if err = h.Verify(rom); err == nil || err.Error() != want {
+		t.Errorf("Verify with a header byte changed: got %v, want %s", err, want)
+	}
+}
+
+func TestDiffBanksVote(t *testing.T) {
+	a := gbcf_sim.SampleROM(0x10000, "", 0, 0)
+	b := append([]byte{}, a...)
+	c := append([]byte{}, a...)
+	b[0x4001] ^= 0x10
+	c[0xc000] ^= 0x01
+	if d := gbcart.DiffBanks(a, b); !reflect.DeepEqual(d, []int{1}) {
+		t.Errorf("DiffBanks: got %v, want [1]", d)
+	}
+	if d := gbcart.DiffBanks(a, a[:0x8000]); !reflect.DeepEqual(d, []int{2, 3}) {
+		t.Errorf("DiffBanks with a short read: got %v, want [2 3]", d)
+	}
+	rom, bad := gbcart.Vote([][]byte{b, c, a})
+	if bad != nil || !reflect.DeepEqual(rom, a) {
+		t.Errorf("Vote: bad banks %v, image matches: %v", bad, reflect.DeepEqual(rom, a))
+	}
+	if _, bad = gbcart.Vote([][]byte{b, c}); !reflect.DeepEqual(bad, []int{1, 3}) {
+		t.Errorf("Vote with two reads: got bad banks %v, want [1 3]", bad)
+	}
+}
+
+// flakyCart is a one bank MemCart that flips a bit of bank 2 for its first
+// reads.
+type flakyCart struct {
+	rom   []byte
+	flaky int // reads left that go wrong
+	r     *bytes.Reader
+}
+
+func (c *flakyCart) NumBanks() int                      { return 1 }
+func (c *flakyCart) CurrentBank() memcart.MemBank       { return c }
+func (c *flakyCart) Name() string                       { return "flaky" }
+func (c *flakyCart) Size() int64                        { return int64(len(c.rom)) }
+func (c *flakyCart) AlwaysWritable() bool               { return false }
+func (c *flakyCart) Write(p []byte) (int, error)        { return 0, io.ErrShortWrite }
+func (c *flakyCart) Read(p []byte) (int, error)         { return c.r.Read(p) }
+func (c *flakyCart) Seek(o int64, w int) (int64, error) { return c.r.Seek(o, w) }
+
+func (c *flakyCart) SwitchBank(int) error {
+	b := append([]byte{}, c.rom...)
+	if c.flaky > 0 {
+		c.flaky--
+		b[0x8123] ^= byte(0x10 << uint(c.flaky%2))
+	}
+	c.r = bytes.NewReader(b)
+	return nil
+}
+
+func TestVerifyDump(t *testing.T) {
+	rom := gbcf_sim.SampleROM(0x10000, "TESTCART", 0x01, 0x00)
+	for _, c := range []struct {
+		flaky   int
+		rereads int
+		banks   []int
+		err     bool
+	}{
+		{0, 3, nil, false},
+		{1, 3, []int{2}, false},
+		{2, 3, []int{2}, false}, // two bad reads that differ, then two good
+		{3, 2, []int{2}, true},
+	} {
+		mc := &flakyCart{rom: rom, flaky: c.flaky}
+		var buf bytes.Buffer
+		memcart.ReadBank(mc, 0, &buf, len(rom))
+		got, banks, err := gbcart.VerifyDump(mc, buf.Bytes(), c.rereads)
+		if (err != nil) != c.err || !reflect.DeepEqual(banks, c.banks) {
+			t.Errorf("%d bad reads: got banks %v, %v", c.flaky, banks, err)
+		}
+		if !c.err && !bytes.Equal(got, rom) {
+			t.Errorf("%d bad reads: wrong image", c.flaky)
+		}
+	}
+
+	// every read agrees, the header is wrong
+	bad := append([]byte{}, rom...)
+	bad[0x14f]++
+	_, banks, err := gbcart.VerifyDump(&flakyCart{rom: bad}, bad, 3)
+	if err == nil || banks != nil {
+		t.Errorf("VerifyDump with a wrong header: got banks %v, %v", banks, err)
+	}
+}
@@ -0,0 +1,150 @@
+package gbcart
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+const (
+	RTC_LEN = 5 // S, M, H, DL, DH
+
+	// RTC_FOOTER_LEN is the size of the clock state emulators (VBA-M, BGB,
+	// mGBA, SameBoy) append to the RAM in .sav files. Some older ones write
+	// the timestamp as 32 bits, RTC_FOOTER_LEN_OLD.
+	RTC_FOOTER_LEN     = 48
+	RTC_FOOTER_LEN_OLD = 44
+
+	RTC_DH_DAY   = 0x01 // bit 8 of the day counter
+	RTC_DH_HALT  = 0x40
+	RTC_DH_CARRY = 0x80 // day counter overflowed
+)
+
+// RTC holds the MBC3 clock registers.
+type RTC struct {
+	S, M, H byte
+	DL      byte // day counter, low 8 bits
+	DH      byte // day counter bit 8, halt and day carry
+}
+
+// ParseRTC reads the registers in the order they're selected, 0x08-0x0C.
+func ParseRTC(b []byte) (RTC, error) {
+	if len(b) < RTC_LEN {
+		return RTC{}, fmt.Errorf("RTC registers: need %d bytes, got %d", RTC_LEN, len(b))
+	}
+	return RTC{S: b[0], M: b[1], H: b[2], DL: b[3], DH: b[4]}, nil
+}
+
+// Bytes returns the registers in the order ParseRTC reads them.
+func (r RTC) Bytes() []byte {
+	return []byte{r.S, r.M, r.H, r.DL, r.DH}
+}
+
+// Days returns the 9-bit day counter.
+func (r RTC) Days() int {
+	return int(r.DH&RTC_DH_DAY)<<8 | int(r.DL)
+}
+
+// Halted reports whether the clock is stopped.
+func (r RTC) Halted() bool {
+	return r.DH&RTC_DH_HALT != 0
+}
+
+// Add returns the clock d later, as if it had been running. The day counter
+// wraps after 511 and sets the carry, as the MBC3 does. A halted clock
+// doesn't move.
+func (r RTC) Add(d time.Duration) RTC {
+	if r.Halted() || d <= 0 {
+		return r
+	}
+	secs := int64(r.S) + 60*int64(r.M) + 3600*int64(r.H) + 86400*int64(r.Days())
+	secs += int64(d / time.Second)
+	days := secs / 86400
+	out := RTC{
+		S:  byte(secs % 60),
+		M:  byte(secs / 60 % 60),
+		H:  byte(secs / 3600 % 24),
+		DL: byte(days),
+		DH: r.DH &^ RTC_DH_DAY,
+	}
+	if days >= 512 {
+		out.DH |= RTC_DH_CARRY
+		days %= 512
+		out.DL = byte(days)
+	}
+	out.DH |= byte(days>>8) & RTC_DH_DAY
+	return out
+}
+
+func (r RTC) String() string {
+	s := fmt.Sprintf("day %d %02d:%02d:%02d", r.Days(), r.H, r.M, r.S)
+	if r.Halted() {
+		s += " halted"
+	}
+	if r.DH&RTC_DH_CARRY != 0 {
+		s += " carry"
+	}
+	return s
+}
+
+// RTCFooter is the clock state appended to a .sav: the running registers,
+// the latched registers and when they were saved. Each register is stored
+// little-endian in 4 bytes, then the Unix time in 8.
+type RTCFooter struct {
+	Time      RTC
+	Latched   RTC
+	Timestamp time.Time
+}
+
+// MarshalBinary returns the RTC_FOOTER_LEN byte footer.
+func (f *RTCFooter) MarshalBinary() ([]byte, error) {
+	b := make([]byte, RTC_FOOTER_LEN)
+	for i, v := range append(f.Time.Bytes(), f.Latched.Bytes()...) {
+		binary.LittleEndian.PutUint32(b[4*i:], uint32(v))
+	}
+	binary.LittleEndian.PutUint64(b[40:], uint64(f.Timestamp.Unix()))
+	return b, nil
+}
+
+// UnmarshalBinary reads a footer of RTC_FOOTER_LEN or RTC_FOOTER_LEN_OLD
+// bytes.
+func (f *RTCFooter) UnmarshalBinary(b []byte) error {
+	var ts int64
+	switch len(b) {
+	case RTC_FOOTER_LEN:
+		ts = int64(binary.LittleEndian.Uint64(b[40:]))
+	case RTC_FOOTER_LEN_OLD:
+		ts = int64(binary.LittleEndian.Uint32(b[40:]))
+	default:
+		return fmt.Errorf("RTC footer: %d bytes, want %d or %d", len(b), RTC_FOOTER_LEN, RTC_FOOTER_LEN_OLD)
+	}
+	regs := make([]byte, 2*RTC_LEN)
+	for i := range regs {
+		regs[i] = byte(binary.LittleEndian.Uint32(b[4*i:]))
+	}
+	f.Time, _ = ParseRTC(regs)
+	f.Latched, _ = ParseRTC(regs[RTC_LEN:])
+	f.Timestamp = time.Unix(ts, 0)
+	return nil
+}
+
+// Now returns the clock as it would be at t, having run since Timestamp.
+func (f *RTCFooter) Now(t time.Time) RTC {
+	return f.Time.Add(t.Sub(f.Timestamp))
+}
+
+// SplitSave splits a .sav for a cart with ramsize bytes of RAM into the RAM
+// and the RTC footer, if it has one. Files of other sizes are returned
+// whole, for the caller to warn about.
+func SplitSave(sav []byte, ramsize int) ([]byte, *RTCFooter, error) {
+	switch len(sav) - ramsize {
+	case RTC_FOOTER_LEN, RTC_FOOTER_LEN_OLD:
+	default:
+		return sav, nil, nil
+	}
+	f := &RTCFooter{}
+	if err := f.UnmarshalBinary(sav[ramsize:]); err != nil {
+		return sav, nil, err
+	}
+	return sav[:ramsize], f, nil
+}
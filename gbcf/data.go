@@ -32,36 +32,3 @@ var crc16Table = [256]uint16{
 	0xDF7C, 0xAF9B, 0xBFBA, 0x8FD9, 0x9FF8, 0x6E17, 0x7E36, 0x4E55, 0x5E74,
 	0x2E93, 0x3EB2, 0x0ED1, 0x1EF0,
 }
-
-/* array of producers names and codes */
-var manufacturers = map[byte]string{
-	0x01: "AMD",
-	0x02: "AMI",
-	0xe5: "Analog Devices",
-	0x1f: "Atmel",
-	0x31: "Catalyst",
-	0x34: "Cypress",
-	0x04: "Fujitsu",
-	0xE0: "Goldstar",
-	0x07: "Hitachi",
-	0xad: "Hyundai",
-	0xc1: "Infineon",
-	0x89: "Intel",
-	0xd5: "Intg. Silicon Systems",
-	0xc2: "Macronix",
-	0x29: "Microchip",
-	0x2c: "Micron",
-	0x1c: "Mitsubishi",
-	0x10: "Nec",
-	0x15: "Philips Semiconductors",
-	0xce: "Samsung",
-	0x62: "Sanyo",
-	0x20: "SGS Thomson",
-	0xb0: "Sharp",
-	0xbf: "SST",
-	0x97: "Texas Instruments",
-	0x98: "Toshiba",
-	0xda: "Winbond",
-	0x19: "Xicor",
-	0xc9: "Xilinx",
-}
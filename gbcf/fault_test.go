@@ -0,0 +1,128 @@
+package gbcf_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/grantek/fkmd/gbcf"
+	"github.com/grantek/fkmd/gbcf_sim"
+	"github.com/grantek/fkmd/transport"
+)
+
+// newFaultySim returns a GBCF driver connected to a simulated device through
+// f.
+func newFaultySim(t *testing.T, f *transport.Faults) (*gbcf.GBCF, *gbcf_sim.GBCF) {
+	rom := gbcf_sim.SampleROM(0x8000, "TESTCART", 0x03, 0x02)
+	s := gbcf_sim.New(rom, make([]byte, 8*1024))
+	d := &gbcf.GBCF{}
+	d.SetOpener(transport.Inject(s.Open, f))
+	if err := d.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	return d, s
+}
+
+func TestReadStatusFaults(t *testing.T) {
+	for _, c := range []struct {
+		fault transport.Fault
+		want  string
+	}{
+		{transport.Fault{Kind: transport.FAULT_CORRUPT, Offset: 20, Mask: 0x01}, "CRC error in received packet."},
+		{transport.Fault{Kind: transport.FAULT_TRUNCATE, Offset: 40}, "Short packet: read 40 bytes."},
+		{transport.Fault{Kind: transport.FAULT_DELAY, Offset: 10}, "Short packet: read 10 bytes."},
+		{transport.Fault{Kind: transport.FAULT_TRUNCATE, Offset: 0}, "EOF"},
+	} {
+		d, _ := newFaultySim(t, &transport.Faults{Faults: []transport.Fault{c.fault}})
+		_, _, err := d.ReadStatus()
+		if err == nil || err.Error() != c.want {
+			t.Errorf("ReadStatus with %+v: got %v, want %q", c.fault, err, c.want)
+		}
+	}
+}
+
+func TestReadRAMRecovery(t *testing.T) {
+	for _, c := range []struct {
+		fault transport.Fault
+		want  gbcf.ErrorCounts
+	}{
+		{transport.Fault{Kind: transport.FAULT_CORRUPT, Offset: 10*gbcf.PACKETSIZE + 30}, gbcf.ErrorCounts{BadPackets: 1}},
+		{transport.Fault{Kind: transport.FAULT_TRUNCATE, Offset: 3*gbcf.PACKETSIZE + 50}, gbcf.ErrorCounts{Timeouts: 1}},
+		{transport.Fault{Kind: transport.FAULT_DELAY, Offset: 3*gbcf.PACKETSIZE + 50}, gbcf.ErrorCounts{Timeouts: 1}},
+		{transport.Fault{Kind: transport.FAULT_DROP, Offset: 5*gbcf.PACKETSIZE + 50}, gbcf.ErrorCounts{Timeouts: 1}},
+		// the device misses the ACK for packet 5 and sends it again
+		{transport.Fault{Kind: transport.FAULT_DROP, Write: true, Offset: gbcf.PACKETSIZE + 5}, gbcf.ErrorCounts{Timeouts: 1, Resyncs: 1}},
+	} {
+		d, s := newFaultySim(t, &transport.Faults{Faults: []transport.Fault{c.fault}})
+		b := make([]byte, 8*1024)
+		if err := d.ReadRAM(b); err != nil {
+			t.Errorf("ReadRAM with %+v: %v", c.fault, err)
+			continue
+		}
+		if !bytes.Equal(b, s.RAM) {
+			t.Errorf("ReadRAM with %+v: data mismatch", c.fault)
+		}
+		if d.Errors() != c.want {
+			t.Errorf("ReadRAM with %+v: recovered from %v, want %v", c.fault, d.Errors(), c.want)
+		}
+	}
+}
+
+func TestReadROMRandomFaults(t *testing.T) {
+	d, s := newFaultySim(t, &transport.Faults{Faults: []transport.Fault{
+		{Kind: transport.FAULT_CORRUPT, Offset: -1, Probability: 0.001},
+	}})
+	b := make([]byte, 0x8000)
+	if err := d.ReadROM(b); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, s.ROM) {
+		t.Error("ReadROM with corrupt packets: data mismatch")
+	}
+	if d.Errors().BadPackets == 0 {
+		t.Error("ReadROM with corrupt packets: no errors counted")
+	}
+	t.Log("recovered from", d.Errors())
+}
+
+func TestWriteRAMRecovery(t *testing.T) {
+	for _, c := range []struct {
+		fault transport.Fault
+		want  gbcf.ErrorCounts
+	}{
+		{transport.Fault{Kind: transport.FAULT_CORRUPT, Write: true, Offset: 3*gbcf.PACKETSIZE + 10}, gbcf.ErrorCounts{Resent: 1}},
+		// the ACK for packet 2 is lost, the device sees the packet twice
+		{transport.Fault{Kind: transport.FAULT_DROP, Offset: 3}, gbcf.ErrorCounts{Timeouts: 1, Resent: 1}},
+	} {
+		d, s := newFaultySim(t, &transport.Faults{Faults: []transport.Fault{c.fault}})
+		b := gbcf_sim.SampleROM(8*1024, "", 0, 0)
+		if err := d.WriteRAM(b); err != nil {
+			t.Errorf("WriteRAM with %+v: %v", c.fault, err)
+			continue
+		}
+		if !bytes.Equal(b, s.RAM) {
+			t.Errorf("WriteRAM with %+v: data mismatch", c.fault)
+		}
+		if d.Errors() != c.want {
+			t.Errorf("WriteRAM with %+v: recovered from %v, want %v", c.fault, d.Errors(), c.want)
+		}
+	}
+}
+
+func TestRetryLimit(t *testing.T) {
+	for _, retries := range []int{0, 3} {
+		f := &transport.Faults{}
+		d, _ := newFaultySim(t, f)
+		// already at the lowest speed, so the transfer isn't tried again
+		if err := d.SetSpeed(gbcf.LOW); err != nil {
+			t.Fatal(err)
+		}
+		f.Faults = []transport.Fault{{Kind: transport.FAULT_CORRUPT, Offset: -1, Probability: 1}}
+		d.SetRetries(retries)
+		if err := d.ReadRAM(make([]byte, 8*1024)); err == nil {
+			t.Errorf("ReadRAM with every byte corrupt and %d retries succeeded", retries)
+		}
+		if got := d.Errors().BadPackets; got != retries+1 {
+			t.Errorf("ReadRAM with %d retries: %d bad packets, want %d", retries, got, retries+1)
+		}
+	}
+}
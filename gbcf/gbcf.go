@@ -10,83 +10,21 @@ import (
 	"strconv"
 	"strings"
 	"time"
-	//"github.com/grantek/fkmd/gbcart"
+
+	"github.com/grantek/fkmd/flashchip"
+	"github.com/grantek/fkmd/gbcart"
 	"github.com/grantek/fkmd/memcart"
+	"github.com/grantek/fkmd/transport"
 	"github.com/jacobsa/go-serial/serial"
 )
 
-// array of cart types - source GB CPU Manual
-var carts = map[byte]string{
-	0x00: "ROM ONLY",
-	0x01: "ROM+MBC1",
-	0x02: "ROM+MBC1+RAM",
-	0x03: "ROM+MBC1+RAM+BATT",
-	0x05: "ROM+MBC2",
-	0x06: "ROM+MBC2+BATTERY",
-	0x08: "ROM+RAM",
-	0x09: "ROM+RAM+BATTERY",
-	0x11: "ROM+MBC3",
-	0x0b: "ROM+MMMO1",
-	0x0c: "ROM+MMMO1+SRAM",
-	0x0d: "ROM+MMMO1+SRAM+BATT",
-	0x0f: "ROM+MBC3+TIMER+BATT",
-	0x10: "ROM+MBC3+TIMER+RAM+BAT",
-	0x12: "ROM+MBC3+RAM",
-	0x13: "ROM+MBC3+RAM+BATT",
-	0x19: "ROM+MBC5",
-	0x1a: "ROM+MBC5+RAM",
-	0x1b: "ROM+MBC5+RAM+BATT",
-	0x1c: "ROM+MBC5+RUMBLE",
-	0x1d: "ROM+MBC5+RUMBLE+SRAM",
-	0x1e: "ROM+MBC5+RUMBLE+SRAM+BATT",
-	0x1f: "Pocket Camera",
-	0xfd: "Bandai TAMA5",
-	0xfe: "Hudson HuC-3",
-}
-
-var RomSizes = map[byte]string{
-	0x00: "32KB",
-	0x01: "64KB",
-	0x02: "128KB",
-	0x03: "256KB",
-	0x04: "512KB",
-	0x05: "1MB",
-	0x06: "2MB",
-	0x07: "4MB", // Not in original code, not sure if device will detect this.
-	0x52: "1.1MB",
-	0x53: "1.2MB",
-	0x54: "1.5MB",
-}
-
-var RamSizes = map[byte]string{
-	0x00: "0KB",
-	0x01: "2KB",
-	0x02: "8KB",
-	0x03: "32KB",
-	0x04: "128KB",
-}
-
-var RomSizeBytes = map[byte]int{
-	0x00: 32768,
-	0x01: 65536,
-	0x02: 131072,
-	0x03: 262144,
-	0x04: 524288,
-	0x05: 524288,
-	0x06: 2097152,
-	0x07: 4194304,
-	0x52: 1179648,
-	0x53: 1310720,
-	0x54: 1572864,
-}
-
-var RamSizeBytes = map[byte]int{
-	0x00: 0,
-	0x01: 2048,
-	0x02: 8192,
-	0x03: 32768,
-	0x04: 131072,
-}
+// The header tables live in gbcart, these names are kept for existing users.
+var (
+	RomSizes     = gbcart.RomSizes
+	RamSizes     = gbcart.RamSizes
+	RomSizeBytes = gbcart.RomSizeBytes
+	RamSizeBytes = gbcart.RamSizeBytes
+)
 
 //go:generate stringer -type=ControlByte
 // ControlByte uses generated stringer for value validation
@@ -102,8 +40,13 @@ const (
 const (
 	SERIAL_TIMEOUT = 3 * time.Second
 	DELETE_TIMEOUT = 60 * time.Second
+	RETRIES        = 10 // per packet, as in the original driver
 	PACKETSIZE     = 72
 	FRAMESIZE      = 64
+
+	// Drop to a lower speed after a transfer that had to recover more than
+	// one packet in FALLBACK_RATE.
+	FALLBACK_RATE = 100
 )
 
 const (
@@ -159,10 +102,11 @@ const (
 	ALG16 = 0x00
 	ALG12 = 0x01
 
-	// speed_type, appears to be local to original code.
-	// LOW      = 0x00 // 125000 baud
-	// STANDARD = 0x01 // 185000 baud, default
-	// HIGH     = 0x02 // 375000 baud
+	// speed_type, appears to be local to original code: it only sets the
+	// baud rate the port is opened at.
+	LOW      = 0x00 // 125000 baud
+	STANDARD = 0x01 // 185000 baud, default
+	HIGH     = 0x02 // 375000 baud
 
 	// enum mbc_t
 	MBCAUTO = 0x00
@@ -174,6 +118,59 @@ const (
 	RUMBLE  = 0x06
 )
 
+// MBCs maps the names accepted by ParseMBC to their mbc_t.
+var MBCs = map[string]byte{
+	"auto":    MBCAUTO,
+	"mbc1":    MBC1,
+	"mbc2":    MBC2,
+	"mbc3":    MBC3,
+	"romonly": ROMONLY,
+	"mbc5":    MBC5,
+	"rumble":  RUMBLE,
+}
+
+// Algorithms maps the names accepted by ParseAlgorithm to their alg_t, the
+// number of address bits used for flash commands.
+var Algorithms = map[string]byte{
+	"16": ALG16,
+	"12": ALG12,
+}
+
+// SpeedBauds maps each speed_type to its baud rate.
+var SpeedBauds = map[byte]uint{
+	LOW:      125000,
+	STANDARD: 185000,
+	HIGH:     375000,
+}
+
+// ParseSpeed returns the speed_type named by s, "low", "standard" or "high",
+// or given by its baud rate.
+func ParseSpeed(s string) (byte, error) {
+	for speed, name := range []string{"low", "standard", "high"} {
+		if strings.ToLower(s) == name || s == strconv.Itoa(int(SpeedBauds[byte(speed)])) {
+			return byte(speed), nil
+		}
+	}
+	return 0, fmt.Errorf("Unknown speed %q, should be one of low, standard, high, 125000, 185000, 375000", s)
+}
+
+// ParseMBC returns the mbc_t named by s, eg. "auto" or "MBC5".
+func ParseMBC(s string) (byte, error) {
+	if mbc, ok := MBCs[strings.ToLower(s)]; ok {
+		return mbc, nil
+	}
+	return 0, fmt.Errorf("Unknown MBC %q, should be one of auto, mbc1, mbc2, mbc3, romonly, mbc5, rumble", s)
+}
+
+// ParseAlgorithm returns the alg_t named by s, "16" or "12", with an optional
+// "alg" prefix.
+func ParseAlgorithm(s string) (byte, error) {
+	if alg, ok := Algorithms[strings.TrimPrefix(strings.ToLower(s), "alg")]; ok {
+		return alg, nil
+	}
+	return 0, fmt.Errorf("Unknown flash algorithm %q, should be 16 or 12", s)
+}
+
 // DeviceCartInfo stores the cart-related parts of STATUS(READ_ID)
 type DeviceCartInfo struct {
 	// Flash chip data.
@@ -193,27 +190,43 @@ type DeviceCartInfo struct {
 
 func (dci *DeviceCartInfo) GBCartInfo() *GBCartInfo {
 	g := &GBCartInfo{}
-	g.Manufacturer = manufacturers[dci.ManufacturerID]
+	chip := dci.FlashChip()
+	g.Manufacturer = chip.ManufacturerName()
 	g.LogoCorrect = dci.LogoCorrect
 	g.ChipID = dci.ChipID
-	g.CartType = carts[dci.TypeID]
+	if chip.Known() {
+		g.FlashChip = chip.String()
+	}
+	g.Type = gbcart.LookupCartType(dci.TypeID)
+	g.CartType = g.Type.String()
 	g.BBL = dci.BBL
 	g.CGB = dci.CGB
 	g.SGB = dci.SGB
 	g.CRC16 = dci.CRC16
-	runes := make([]rune, 0, len(dci.GameNameBytes))
-	for _, b := range dci.GameNameBytes {
-		if !strconv.IsPrint(rune(b)) {
-			break
-		}
-		runes = append(runes, rune(b))
-	}
-	g.GameNamePrintable = string(runes)
+	g.GameNamePrintable = gbcart.PrintableName(dci.GameNameBytes)
 	g.ROMSize = RomSizes[dci.ROMSize]
-	g.RAMSize = RamSizes[dci.RAMSize]
+	g.RAMSize = g.Type.RamSizeString(dci.RAMSize)
 	return g
 }
 
+// FlashChip looks up the cart's flash chip by the IDs the device read.
+func (dci *DeviceCartInfo) FlashChip() *flashchip.Chip {
+	return flashchip.Lookup(dci.ManufacturerID, uint16(dci.ChipID))
+}
+
+// LockedRegion returns the boot sector of the cart's flash chip, and whether
+// the device reports its boot block locked. Unknown chips are taken to lock
+// their first 64KiB.
+func (dci *DeviceCartInfo) LockedRegion() (flashchip.Sector, bool) {
+	return dci.FlashChip().BootSector(), dci.BBL
+}
+
+// Sizes returns the ROM and RAM sizes of the cart in bytes, RAM being 0 for
+// cart types without any. See gbcart.Sizes.
+func (dci *DeviceCartInfo) Sizes() (rom int, ram int, err error) {
+	return gbcart.Sizes(dci.TypeID, dci.ROMSize, dci.RAMSize)
+}
+
 // FirmwareVersion represents the device version sent by STATUS(NREAD_ID)
 type FirmwareVersion struct {
 	// BCD, formatted by original code as ("%d%d.%d%d", v11,v12,v21,v22)
@@ -224,14 +237,40 @@ type FirmwareVersion struct {
 }
 
 type GBCF struct {
-	fd  io.ReadWriteCloser
-	opt serial.OpenOptions
+	fd      io.ReadWriteCloser
+	opt     serial.OpenOptions
+	open    transport.Opener
+	retries *int
+	errors  ErrorCounts
+	alg     byte // flash algorithm, ALG16 by default
+	mbc     byte // MBC override, MBCAUTO by default
+}
+
+// ErrorCounts counts the errors a transfer recovered from.
+type ErrorCounts struct {
+	Timeouts   int // Reads that timed out or returned a short packet
+	BadPackets int // Packets with a bad CRC or an unexpected control or command byte
+	Resent     int // Packets sent again after a NAK or a missing ACK
+	Resyncs    int // Repeated packets skipped by their page/packet index
+}
+
+func (e ErrorCounts) Total() int {
+	return e.Timeouts + e.BadPackets + e.Resent + e.Resyncs
+}
+
+func (e ErrorCounts) String() string {
+	return fmt.Sprintf("%d timeouts, %d bad packets, %d packets resent, %d resyncs",
+		e.Timeouts, e.BadPackets, e.Resent, e.Resyncs)
 }
 
 //Just open the serial device for low-level debugging
 func (d *GBCF) Connect() error {
-	f, err := serial.Open(d.opt)
+	if d.opt.BaudRate == 0 {
+		d.opt.BaudRate = SpeedBauds[STANDARD]
+	}
+	f, err := d.opener()(d.opt)
 	d.fd = f
+	d.errors = ErrorCounts{}
 	return err
 }
 
@@ -251,18 +290,23 @@ func (d *GBCF) GBCartInfo() (*GBCartInfo, error) {
 	return dci.GBCartInfo(), nil
 }
 
-//Perform initialisation and return a MemCart
+//Perform initialisation and return a MemCart sized from the cart header
 func (d *GBCF) MemCart() (memcart.MemCart, error) {
-	//var gbc gbcart
 	if err := d.Connect(); err != nil {
 		return nil, err
 	}
-	/*if err := d.Handshake(); err != nil {
-	return nil, err
-
-	*/
-
-	return nil, nil //d.Gbcart()
+	_, dci, err := d.ReadStatus()
+	if err != nil {
+		return nil, err
+	}
+	rom, ram, err := dci.Sizes()
+	if err != nil {
+		return nil, err
+	}
+	if rom == 0 {
+		return nil, fmt.Errorf("unknown ROM size in cart header")
+	}
+	return d.GBCart(int64(rom), int64(ram)), nil
 }
 
 func (d *GBCF) ReadDeviceStatus() (*FirmwareVersion, error) {
@@ -270,8 +314,8 @@ func (d *GBCF) ReadDeviceStatus() (*FirmwareVersion, error) {
 		Control:    DATA,
 		Command:    STATUS,
 		Subcommand: NREAD_ID,
-		Algorithm:  ALG16,
-		MBC:        MBCAUTO,
+		Algorithm:  d.alg,
+		MBC:        d.mbc,
 	}
 	p, err := pc.Packet()
 	if err != nil {
@@ -291,90 +335,29 @@ func (d *GBCF) ReadDeviceStatus() (*FirmwareVersion, error) {
 }
 
 // readRAM reads all of RAM up to len(b), and returns an error if b is not
-// completely filled.
+// completely filled. MBC2 RAM, gbcart.MBC2_RAM_SIZE bytes, is read as 2KiB
+// and the first of its mirrors kept, with the upper 4 bits of each byte set.
 func (d *GBCF) ReadRAM(b []byte) error {
 	want := len(b)
 	pgc := 1
 	switch {
+	case want == gbcart.MBC2_RAM_SIZE:
+		b2k := make([]byte, 2*1024)
+		if err := d.ReadRAM(b2k); err != nil {
+			return err
+		}
+		copy(b, b2k)
+		gbcart.NormalizeMBC2RAM(b)
+		return nil
 	case want == 2*1024:
 	case want > 0 && want%(8*1024) == 0:
 		pgc = want / (8 * 1024)
 	default:
-		return fmt.Errorf("readRAM: invalid buffer size %d bytes, should be 2KiB or N*8KiB", want)
+		return fmt.Errorf("readRAM: invalid buffer size %d bytes, should be 512 (MBC2), 2KiB or N*8KiB", want)
 	}
-	pc := &PacketConfig{
-		Control:    DATA,
-		Command:    CONFIG,
-		Subcommand: RRAM,
-		Algorithm:  ALG16,
-		MBC:        MBCAUTO,
-		PageCount:  pgc,
-	}
-	p, err := pc.Packet()
-	if err != nil {
-		return err
-	}
-	if err := d.SendPacket(p); err != nil {
-		return err
-	}
-	fin := false
-	n := 0
-	for fin == false {
-		page := (n / FRAMESIZE) / 128 // 8kiB RAM page / 64B packet payload
-		packet := (n / FRAMESIZE) % 128
-		p, err = d.ReceivePacket()
-		if err != nil {
-			// TODO: original code has 10 retries on serial TIMEOUT.
-			return err
-		}
-		switch pt := p.Control(); pt {
-		case DATA:
-		case END:
-			if n == want {
-				fmt.Printf("DEBUG: got END with full buffer at %d\n", n)
-				return nil
-			}
-			fallthrough
-		default:
-			return fmt.Errorf("readRAM: unexpected control byte  %q: got %d bytes, want %d", pt, n, want)
-		}
-		if err := p.Check(); err != nil {
-			return err
-		}
-		cm := p.Command()
-		if cm != NORMAL_DATA && cm != LAST_DATA {
-			return fmt.Errorf("readRAM: unexpected command byte %q: got %d bytes, want %d", cm, n, want)
-		}
-		pk := int(p.bytes[3])
-		pg := int(p.bytes[4])*256 + int(p.bytes[5])
-		if packet != pk || page != pg {
-			return fmt.Errorf("readRAM: packet out of sequence: got %d,%d bytes, want %d,%d", pk, pg, packet, page)
-		}
-		if n+FRAMESIZE == want {
-			if want == 2*1024 {
-				d.SendControl(END)
-				fin = true
-			}
-			if cm == LAST_DATA {
-				fmt.Printf("DEBUG: got LAST_DATA at %d\n", n)
-				fin = true
-			} else {
-				fmt.Printf("DEBUG: filled buffer with NORMAL_DATA command at %d\n", n)
-				d.SendControl(ACK)
-			}
-		} else {
-			if packet == 127 {
-				//TODO: check if a different response is needed
-				d.SendControl(ACK)
-			} else {
-				d.SendControl(ACK)
-			}
-		}
-		copy(b[n:n+FRAMESIZE], p.Frame())
-		n = n + FRAMESIZE
-		fmt.Printf("DEBUG: buffer: %d page: %d packet: %d pk: %d pg: %d\n", n, page, packet, pk, pg)
-	}
-	return nil
+	return d.withFallback(len(b), func() error {
+		return d.readPages("readRAM", RRAM, b, pgc, 128) // 8kiB RAM page / 64B packet payload
+	})
 }
 
 // readROM reads all of ROM up to len(b), and returns an error if b is not
@@ -388,12 +371,49 @@ func (d *GBCF) ReadROM(b []byte) error {
 	default:
 		return fmt.Errorf("readROM: invalid buffer size %d bytes, N*16KiB", want)
 	}
+	return d.withFallback(len(b), func() error {
+		return d.readPages("readROM", RROM, b, pgc, 256) // 16kiB ROM page / 64B packet payload
+	})
+}
+
+// GetRomSize finds the size of the ROM by reading it until it mirrors, for
+// carts whose header is wrong. It starts from hint bytes, the size the header
+// gives, and reads twice the size it's checking, doubling it until the ROM
+// repeats or MAX_ROM_SIZE. Only power of two sizes are found, and padding
+// that repeats doesn't make it smaller than hint, see gbcart.MirrorSize. The
+// device can only read ROM from the start, so it also returns the ROM it
+// read, to save dumping it again.
+func (d *GBCF) GetRomSize(hint int) (int, []byte, error) {
+	size := 2 * ROM_PAGE_SIZE
+	for size < hint && size < MAX_ROM_SIZE {
+		size *= 2
+	}
+	var b []byte
+	for size < MAX_ROM_SIZE {
+		b = make([]byte, 2*size)
+		if err := d.ReadROM(b); err != nil {
+			return 0, nil, err
+		}
+		if n := gbcart.MirrorSize(b, hint); n < len(b) {
+			return n, b[:n], nil
+		}
+		size *= 2
+	}
+	return MAX_ROM_SIZE, b, nil
+}
+
+// readPages sends the CONFIG packet for sub, then receives pgc pages of ppp
+// packets into b. A bad or missing packet is NAKed so the device sends it
+// again, up to the retry limit, and a packet repeated because the device
+// missed our ACK is skipped.
+func (d *GBCF) readPages(name string, sub SubcommandByte, b []byte, pgc int, ppp int) error {
+	want := len(b)
 	pc := &PacketConfig{
 		Control:    DATA,
 		Command:    CONFIG,
-		Subcommand: RROM,
-		Algorithm:  ALG16,
-		MBC:        MBCAUTO,
+		Subcommand: sub,
+		Algorithm:  d.alg,
+		MBC:        d.mbc,
 		PageCount:  pgc,
 	}
 	p, err := pc.Packet()
@@ -403,57 +423,65 @@ func (d *GBCF) ReadROM(b []byte) error {
 	if err := d.SendPacket(p); err != nil {
 		return err
 	}
-	fin := false
 	n := 0
-	for fin == false {
-		page := (n / FRAMESIZE) / 256 // 16kiB ROM page / 64B packet payload
-		packet := (n / FRAMESIZE) % 256
-		p, err = d.ReceivePacket()
-		if err != nil {
-			// TODO: original code has 10 retries on serial TIMEOUT.
-			return err
-		}
-		switch pt := p.Control(); pt {
-		case DATA:
-		case END:
-			if n == want {
-				fmt.Printf("DEBUG: got END with full buffer at %d\n", n)
-				return nil
-			}
-			fallthrough
-		default:
-			return fmt.Errorf("readROM: unexpected control byte  %q: got %d bytes, want %d", pt, n, want)
+	tries := 0
+	for n < want {
+		page := (n / FRAMESIZE) / ppp
+		packet := (n / FRAMESIZE) % ppp
+		if tries > d.Retries() {
+			return fmt.Errorf("%s: giving up at page %d packet %d after %d retries: %v", name, page, packet, d.Retries(), err)
 		}
-		if err := p.Check(); err != nil {
-			return err
+		tries++
+		p, err = d.ReceivePacket()
+		switch {
+		case err != nil:
+			d.errors.Timeouts++
+		case p.Control() == END:
+			return fmt.Errorf("%s: unexpected END: got %d bytes, want %d", name, n, want)
+		case p.Control() == NAK && n == 0:
+			return fmt.Errorf("%s: device refused %s", name, sub.Name(CONFIG))
+		case p.Control() != DATA:
+			err = fmt.Errorf("%s: unexpected control byte %q", name, p.Control())
+			d.errors.BadPackets++
+		case p.Check() != nil:
+			err = p.Check()
+			d.errors.BadPackets++
+		case p.Command() != NORMAL_DATA && p.Command() != LAST_DATA:
+			err = fmt.Errorf("%s: unexpected command byte %q", name, p.Command())
+			d.errors.BadPackets++
 		}
-		cm := p.Command()
-		if cm != NORMAL_DATA && cm != LAST_DATA {
-			return fmt.Errorf("readROM: unexpected command byte %q: got %d bytes, want %d", cm, n, want)
+		if err != nil {
+			d.drain()
+			d.SendControl(NAK)
+			continue
 		}
 		pk := int(p.bytes[3])
 		pg := int(p.bytes[4])*256 + int(p.bytes[5])
-		if packet != pk || page != pg {
-			return fmt.Errorf("readROM: packet out of sequence: got %d,%d bytes, want %d,%d", pk, pg, packet, page)
-		}
-		if n+FRAMESIZE == want {
-			if cm == LAST_DATA {
-				fmt.Printf("DEBUG: got LAST_DATA at %d\n", n)
-			} else {
-				fmt.Printf("DEBUG: filled buffer with NORMAL_DATA command at %d\n", n)
-			}
-			fin = true
-		} else {
-			if packet == 255 {
-				//TODO: check if a different response is needed
-				d.SendControl(ACK)
-			} else {
+		if pk != packet || pg != page {
+			prev := n/FRAMESIZE - 1
+			if prev >= 0 && pk == prev%ppp && pg == prev/ppp {
+				// the device missed our ACK and sent the last packet again
+				err = fmt.Errorf("repeated packet %d,%d", pk, pg)
+				d.errors.Resyncs++
 				d.SendControl(ACK)
+				continue
 			}
+			return fmt.Errorf("%s: packet out of sequence: got %d,%d, want %d,%d", name, pk, pg, packet, page)
 		}
+		tries = 0
 		copy(b[n:n+FRAMESIZE], p.Frame())
 		n = n + FRAMESIZE
-		fmt.Printf("DEBUG: buffer: %d page: %d packet: %d pk: %d pg: %d\n", n, page, packet, pk, pg)
+		if n < want {
+			d.SendControl(ACK)
+			continue
+		}
+		switch {
+		case sub == RRAM && want == 2*1024:
+			// stop the device part way through its 8KiB page
+			d.SendControl(END)
+		case sub == RRAM && p.Command() != LAST_DATA:
+			d.SendControl(ACK)
+		}
 	}
 	return nil
 }
@@ -463,8 +491,8 @@ func (d *GBCF) ReadStatus() (*FirmwareVersion, *DeviceCartInfo, error) {
 		Control:    DATA,
 		Command:    STATUS,
 		Subcommand: READ_ID,
-		Algorithm:  ALG16,
-		MBC:        MBCAUTO,
+		Algorithm:  d.alg,
+		MBC:        d.mbc,
 	}
 	p, err := pc.Packet()
 	if err != nil {
@@ -553,46 +581,126 @@ func (d *GBCF) SetOptions(options serial.OpenOptions) {
 	d.opt = options
 }
 
-// WriteRAM writes b to cartridge RAM
+// SetOpener makes Connect use o to open the device instead of serial.Open.
+func (d *GBCF) SetOpener(o transport.Opener) {
+	d.open = o
+}
+
+func (d *GBCF) opener() transport.Opener {
+	if d.open == nil {
+		return transport.Serial
+	}
+	return d.open
+}
+
+// WriteRAM writes b to cartridge RAM. MBC2 RAM, gbcart.MBC2_RAM_SIZE bytes,
+// is written as 2KiB with b repeated in each mirror.
 func (d *GBCF) WriteRAM(b []byte) error {
 	have := len(b)
 	pgc := 1
 	switch {
+	case have == gbcart.MBC2_RAM_SIZE:
+		return d.WriteRAM(bytes.Repeat(b, 2*1024/gbcart.MBC2_RAM_SIZE))
 	case have == 2*1024:
 	case have > 0 && have%(8*1024) == 0:
 		pgc = have / (8 * 1024)
 	default:
-		return fmt.Errorf("WriteRAM: invalid buffer size %d bytes, should be 2KiB or N*8KiB", have)
+		return fmt.Errorf("WriteRAM: invalid buffer size %d bytes, should be 512 (MBC2), 2KiB or N*8KiB", have)
+	}
+	return d.withFallback(len(b), func() error {
+		return d.writePages("WriteRAM", WRAM, b, pgc, 128) // 8kiB RAM page / 64B packet payload
+	})
+}
+
+// WriteROM writes b to a flash cart's ROM, which should already be erased
+// with EraseFlash. If the write fails and is tried again at a lower speed,
+// the flash is erased again first, as the device can only write from page 0
+// and the pages already written can't be programmed twice.
+func (d *GBCF) WriteROM(b []byte) error {
+	have := len(b)
+	if have == 0 || have%(16*1024) != 0 {
+		return fmt.Errorf("WriteROM: invalid buffer size %d bytes, should be N*16KiB", have)
+	}
+	rerun := false
+	return d.withFallback(len(b), func() error {
+		if rerun {
+			if err := d.EraseFlash(); err != nil {
+				return fmt.Errorf("WriteROM: erasing to write again: %v", err)
+			}
+		}
+		rerun = true
+		return d.writePages("WriteROM", WROM, b, have/(16*1024), 256) // 16kiB ROM page / 64B packet payload
+	})
+}
+
+// BootBlockError is returned by CheckBootBlock when a ROM image would have
+// to change a locked boot block.
+type BootBlockError struct {
+	Chip   *flashchip.Chip
+	Sector flashchip.Sector // the locked region
+	Offset int              // first byte where the image and cart differ
+}
+
+func (e *BootBlockError) Error() string {
+	return fmt.Sprintf("boot block 0x%06X-0x%06X is locked (%v), and the image differs "+
+		"from the cart there at 0x%06X: it can't be erased or programmed, so the write "+
+		"would fail to verify. Unlock it with the cart's own tools, or write an image "+
+		"with the same boot block",
+		e.Sector.Addr, e.Sector.Addr+e.Sector.Size-1, e.Chip, e.Offset)
+}
+
+// CheckBootBlock checks rom can be written to the cart dci describes. A
+// locked boot block is left alone by EraseFlash and ignores WriteROM, so
+// the write only works if rom already matches the cart there. That part of
+// ROM is read back to compare, from page 0 as reads always start there.
+// Returns a *BootBlockError if they differ.
+func (d *GBCF) CheckBootBlock(dci *DeviceCartInfo, rom []byte) error {
+	if dci == nil {
+		return nil
+	}
+	sector, locked := dci.LockedRegion()
+	if !locked || sector.Addr >= len(rom) {
+		return nil
 	}
+	end := sector.Addr + sector.Size
+	if end > len(rom) {
+		end = len(rom)
+	}
+	b := make([]byte, (end+ROM_PAGE_SIZE-1)/ROM_PAGE_SIZE*ROM_PAGE_SIZE)
+	if err := d.ReadROM(b); err != nil {
+		return fmt.Errorf("reading locked boot block: %v", err)
+	}
+	for i := sector.Addr; i < end; i++ {
+		if b[i] != rom[i] {
+			return &BootBlockError{Chip: dci.FlashChip(), Sector: sector, Offset: i}
+		}
+	}
+	return nil
+}
+
+// writePages sends the CONFIG packet for sub, then streams b as pgc pages of
+// ppp packets, checking for an ACK after each.
+func (d *GBCF) writePages(name string, sub SubcommandByte, b []byte, pgc int, ppp int) error {
 	pc := &PacketConfig{
 		Control:    DATA,
 		Command:    CONFIG,
-		Subcommand: WRAM,
-		Algorithm:  ALG16,
-		MBC:        MBCAUTO,
+		Subcommand: sub,
+		Algorithm:  d.alg,
+		MBC:        d.mbc,
 		PageCount:  pgc,
 	}
 	p, err := pc.Packet()
 	if err != nil {
 		return err
 	}
-	if err := d.SendPacket(p); err != nil {
-		return err
-	}
-	// TODO: original code has 10 retries
-	p, err = d.ReceivePacket()
-	if err != nil {
-		return err
-	}
-	cb := p.Control()
-	if cb != ACK {
-		return fmt.Errorf("WriteRAM: Unexpected response ControlByte to WRAM: %s", p.Control().String())
+	if err := d.sendWithRetries(name, p); err != nil {
+		return fmt.Errorf("%s: %s: %v", name, sub.Name(CONFIG), err)
 	}
 	fin := false
 	n := 0
 	for fin == false {
-		page := uint16((n / FRAMESIZE) / 128) // 8kiB RAM page / 64B packet payload
-		packet := uint8((n / FRAMESIZE) % 128)
+		page := uint16((n / FRAMESIZE) / ppp)
+		packet := uint8((n / FRAMESIZE) % ppp)
 		c := NORMAL_DATA
 		if n+FRAMESIZE >= len(b) {
 			c = LAST_DATA
@@ -610,59 +718,229 @@ func (d *GBCF) WriteRAM(b []byte) error {
 			return err
 		}
 		n = n + p.Pack(b[n:n+FRAMESIZE])
-		fmt.Printf("DEBUG: buffer: %d page: %d packet: %d\n", n, page, packet)
-		if err := d.SendPacket(p); err != nil {
+		if err := d.sendWithRetries(name, p); err != nil {
+			return fmt.Errorf("%s: page %d packet %d: %v", name, page, packet, err)
+		}
+	}
+	return nil
+}
+
+// sendWithRetries sends p until the device ACKs it. A NAK or a missing ACK
+// sends it again, up to the retry limit. The device recognises a repeated
+// data packet by its index if only the ACK was lost.
+func (d *GBCF) sendWithRetries(name string, p *Packet) error {
+	var err error
+	for tries := 0; tries <= d.Retries(); tries++ {
+		if tries > 0 {
+			d.errors.Resent++
+			d.drain()
+		}
+		if err = d.SendPacket(p); err != nil {
 			return err
 		}
-		p, err = d.ReceivePacket()
+		var r *Packet
+		r, err = d.ReceivePacket()
+		switch {
+		case err != nil:
+			d.errors.Timeouts++
+		case r.Control() == ACK:
+			return nil
+		case r.Control() == NAK:
+			err = errors.New("device sent NAK")
+		default:
+			err = fmt.Errorf("unexpected response ControlByte: %s", r.Control().String())
+			d.errors.BadPackets++
+		}
+	}
+	return fmt.Errorf("giving up after %d retries: %v", d.Retries(), err)
+}
+
+// drain discards anything left of a bad packet.
+func (d *GBCF) drain() {
+	b := make([]byte, PACKETSIZE)
+	for {
+		n, err := d.fd.Read(b)
+		if n == 0 || err != nil {
+			return
+		}
+	}
+}
+
+// SetRetries sets how many times a packet is retried before a transfer fails,
+// RETRIES by default.
+func (d *GBCF) SetRetries(n int) {
+	d.retries = &n
+}
+
+func (d *GBCF) Retries() int {
+	if d.retries == nil {
+		return RETRIES
+	}
+	return *d.retries
+}
+
+// SetMBC overrides the MBC type the device detects from the cart header,
+// for carts that auto mode gets wrong. MBCAUTO restores detection.
+func (d *GBCF) SetMBC(mbc byte) error {
+	if mbc > RUMBLE {
+		return fmt.Errorf("SetMBC: invalid MBC %d", mbc)
+	}
+	d.mbc = mbc
+	return nil
+}
+
+func (d *GBCF) MBC() byte {
+	return d.mbc
+}
+
+// SetAlgorithm sets the flash command addressing, ALG12 for chips that
+// take 12-bit command addresses. ALG16 is the default.
+func (d *GBCF) SetAlgorithm(alg byte) error {
+	if alg > ALG12 {
+		return fmt.Errorf("SetAlgorithm: invalid algorithm %d", alg)
+	}
+	d.alg = alg
+	return nil
+}
+
+func (d *GBCF) Algorithm() byte {
+	return d.alg
+}
+
+// SetSpeed sets the link speed. The device is only told the speed by the
+// baud rate, so if it's connected the port is reopened at the new rate and
+// the device has to answer STATUS(NREAD_ID). If it doesn't, lower speeds are
+// tried and an error is returned with the link left at the one that worked.
+func (d *GBCF) SetSpeed(speed byte) error {
+	if _, ok := SpeedBauds[speed]; !ok {
+		return fmt.Errorf("SetSpeed: invalid speed %d", speed)
+	}
+	for s := speed; ; s-- {
+		d.opt.BaudRate = SpeedBauds[s]
+		if d.fd == nil {
+			return nil
+		}
+		if err := d.fd.Close(); err != nil {
+			return err
+		}
+		f, err := d.opener()(d.opt)
 		if err != nil {
+			d.fd = nil
 			return err
 		}
-		if cb := p.Control(); cb != ACK {
-			return fmt.Errorf("WriteRAM: Unexpected response ControlByte to sent data: %s", cb.String())
+		d.fd = f
+		if err = d.checkLink(); err == nil {
+			if s != speed {
+				return fmt.Errorf("SetSpeed: no answer at %d baud, using %d baud", SpeedBauds[speed], SpeedBauds[s])
+			}
+			return nil
+		}
+		if s == LOW {
+			return fmt.Errorf("SetSpeed: no answer at any speed: %v", err)
 		}
 	}
-	return nil
 }
 
-// GBCartInfo is human-readable version of DeviceCartInfo
-type GBCartInfo struct {
-	Manufacturer      string
-	ChipID            byte
-	BBL               bool
-	LogoCorrect       bool
-	CGB               bool
-	SGB               bool
-	ROMSize           string
-	RAMSize           string
-	CRC16             uint16
-	CartType          string
-	GameNamePrintable string
+// Speed returns the fastest speed_type the port's baud rate reaches, LOW if
+// it's slower than all of them.
+func (d *GBCF) Speed() byte {
+	speed := byte(LOW)
+	for s, baud := range SpeedBauds {
+		if d.opt.BaudRate >= baud && s > speed {
+			speed = s
+		}
+	}
+	return speed
 }
 
-type GBCartRAM struct {
-	d          *GBCF
-	addressCur int64
-	size       int64
+// checkLink asks for the device status until it gets a good answer, up to
+// the retry limit.
+func (d *GBCF) checkLink() error {
+	var err error
+	for tries := 0; tries <= d.Retries(); tries++ {
+		d.drain()
+		if _, err = d.ReadDeviceStatus(); err == nil {
+			return nil
+		}
+	}
+	return err
 }
 
-func (m *GBCartRAM) AlwaysWritable() bool {
-	return true
+// withFallback runs op, a transfer of n bytes. If it failed, or recovered
+// more than one packet in FALLBACK_RATE, the link drops to the next lower
+// speed, and a failed transfer is tried again at it. op is run again from the
+// start, so it must be safe to repeat: reads and RAM writes are, and WriteROM
+// erases the flash first.
+func (d *GBCF) withFallback(n int, op func() error) error {
+	for {
+		before := d.errors.Total()
+		err := op()
+		bad := d.errors.Total() - before
+		if d.Speed() == LOW || err == nil && bad*FALLBACK_RATE <= n/FRAMESIZE {
+			return err
+		}
+		if serr := d.SetSpeed(d.Speed() - 1); serr != nil && d.fd == nil {
+			return serr
+		}
+		if err == nil {
+			return nil
+		}
+	}
 }
 
-func (m *GBCartRAM) Name() string {
-	return "gbcartram"
+// Errors returns the errors recovered from since the device was connected.
+func (d *GBCF) Errors() ErrorCounts {
+	return d.errors
 }
 
-func (m *GBCartRAM) Read(p []byte) (n int, err error) {
-	// wrap readRAM bytes with a reader
-	return 0, nil
+// EraseFlash erases a flash cart's ROM. The device answers once the chip has
+// finished, which can take up to DELETE_TIMEOUT.
+func (d *GBCF) EraseFlash() error {
+	return d.erase(EFLA)
 }
 
-func (m *GBCartRAM) Size() int64 {
-	return m.size
+// EraseRAM erases cartridge RAM.
+func (d *GBCF) EraseRAM() error {
+	return d.erase(ERAM)
 }
 
+// erase sends ERASE(sub) and waits up to DELETE_TIMEOUT for the ACK.
+func (d *GBCF) erase(sub SubcommandByte) error {
+	pc := &PacketConfig{
+		Control:    DATA,
+		Command:    ERASE,
+		Subcommand: sub,
+		Algorithm:  d.alg,
+		MBC:        d.mbc,
+	}
+	p, err := pc.Packet()
+	if err != nil {
+		return err
+	}
+	if err := d.SendPacket(p); err != nil {
+		return err
+	}
+	deadline := time.Now().Add(DELETE_TIMEOUT)
+	for {
+		p, err = d.ReceivePacket()
+		if err == io.EOF && time.Now().Before(deadline) {
+			// serial read timed out, the chip is still busy
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("erase %s: %v", sub.Name(ERASE), err)
+		}
+		if cb := p.Control(); cb != ACK {
+			return fmt.Errorf("erase %s: Unexpected response ControlByte: %s", sub.Name(ERASE), cb.String())
+		}
+		return nil
+	}
+}
+
+// GBCartInfo is human-readable version of DeviceCartInfo, shared with
+// gbcart so device info can be compared with a ROM header.
+type GBCartInfo = gbcart.GBCartInfo
+
 type Packet struct {
 	bytes [PACKETSIZE]byte
 }
@@ -764,8 +1042,8 @@ type PacketConfig struct {
 	Control     ControlByte
 	Command     CommandByte
 	Subcommand  SubcommandByte
-	Algorithm   byte   // *READ_ID, RRAM?
-	MBC         byte   // *READ_ID, RRAM?
+	Algorithm   byte   // CONFIG, ERASE, STATUS
+	MBC         byte   // CONFIG, ERASE, STATUS
 	PageCount   int    // RRAM
 	PacketIndex uint8  // WRAM
 	PageIndex   uint16 // WRAM
@@ -789,7 +1067,7 @@ func (pc *PacketConfig) Packet() (*Packet, error) {
 	cb := CommandByte(p.bytes[1])
 	switch cb {
 	case CONFIG:
-		n = 4
+		n = 6
 	case NORMAL_DATA:
 		n = 1
 	case LAST_DATA:
@@ -805,7 +1083,17 @@ func (pc *PacketConfig) Packet() (*Packet, error) {
 		return nil, fmt.Errorf("Subcommand value %d is invalid for %s.", pc.Subcommand, cb.String())
 	}
 	p.bytes[2] = byte(pc.Subcommand)
-	// TODO: nonzero Algorithm, MBC for STATUS
+	if pc.Algorithm > ALG12 {
+		return nil, fmt.Errorf("Algorithm value %d is invalid.", pc.Algorithm)
+	}
+	if pc.MBC > RUMBLE {
+		return nil, fmt.Errorf("MBC value %d is invalid.", pc.MBC)
+	}
+	switch pc.Command {
+	case CONFIG, ERASE, STATUS:
+		p.bytes[3] = pc.Algorithm
+		p.bytes[4] = pc.MBC
+	}
 	switch pc.Command {
 	case CONFIG:
 		p.bytes[6] = byte((pc.PageCount - 1) / 256)
@@ -6,25 +6,67 @@ func TestCRC(t *testing.T) {
 	p := Packet{}
 	p.bytes[0] = 0x55
 	p.bytes[1] = 0x04
-	c := p.generate_crc16()
+	c := p.CRC16()
 	if c != 0xA3C1 {
 		t.Errorf("CRC(DATA, STATUS, NREAD_ID): got %x, want 0xA3C1", c)
 	}
 	p.bytes[2] = 0x01
-	c = p.generate_crc16()
+	c = p.CRC16()
 	if c != 0x9936 {
 		t.Errorf("CRC(DATA, STATUS, READ_ID): got %x, want 0x9936", c)
 	}
 	p.bytes[70] = 0xFF
 	p.bytes[71] = 0xFF
 	p.bytes[2] = 0x00
-	c = p.generate_crc16()
+	c = p.CRC16()
 	if c != 0xA3C1 {
 		t.Errorf("CRC(DATA, STATUS, NREAD_ID, ..., 0xFFFF): got %x, want 0xA3C1", c)
 	}
 	p.bytes[2] = 0x01
-	c = p.generate_crc16()
+	c = p.CRC16()
 	if c != 0x9936 {
 		t.Errorf("CRC(DATA, STATUS, READ_ID, ..., 0xFFFF): got %x, want 0x9936", c)
 	}
 }
+
+func TestParseMBC(t *testing.T) {
+	for s, want := range map[string]byte{"auto": MBCAUTO, "MBC3": MBC3, "romonly": ROMONLY, "Rumble": RUMBLE} {
+		if mbc, err := ParseMBC(s); mbc != want || err != nil {
+			t.Errorf("ParseMBC(%q): got %d, %v, want %d", s, mbc, err, want)
+		}
+	}
+	if _, err := ParseMBC("mbc7"); err == nil {
+		t.Error("ParseMBC(\"mbc7\") succeeded")
+	}
+	for s, want := range map[string]byte{"16": ALG16, "12": ALG12, "ALG12": ALG12} {
+		if alg, err := ParseAlgorithm(s); alg != want || err != nil {
+			t.Errorf("ParseAlgorithm(%q): got %d, %v, want %d", s, alg, err, want)
+		}
+	}
+	if _, err := ParseAlgorithm("8"); err == nil {
+		t.Error("ParseAlgorithm(\"8\") succeeded")
+	}
+}
+
+func TestPacketMBC(t *testing.T) {
+	pc := &PacketConfig{Control: DATA, Command: CONFIG, Subcommand: WROM, Algorithm: ALG12, MBC: MBC2, PageCount: 0x102}
+	p, err := pc.Packet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.bytes[3] != ALG12 || p.bytes[4] != MBC2 || p.bytes[6] != 0x01 || p.bytes[7] != 0x01 {
+		t.Errorf("CONFIG packet: got % x", p.bytes[:8])
+	}
+	pc = &PacketConfig{Control: DATA, Command: NORMAL_DATA, Algorithm: ALG12, MBC: MBC2, PacketIndex: 7}
+	if p, err = pc.Packet(); err != nil || p.bytes[3] != 7 || p.bytes[4] != 0 {
+		t.Errorf("data packet: algorithm or MBC overwrote its index: % x, %v", p.bytes[:6], err)
+	}
+	pc = &PacketConfig{Control: DATA, Command: STATUS, MBC: RUMBLE + 1}
+	if _, err = pc.Packet(); err == nil {
+		t.Error("Packet with invalid MBC succeeded")
+	}
+	var d GBCF
+	if err = d.SetAlgorithm(2); err == nil || d.Algorithm() != ALG16 {
+		t.Error("SetAlgorithm(2) succeeded")
+	}
+}
@@ -0,0 +1,229 @@
+package gbcf
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/grantek/fkmd/memcart"
+)
+
+const (
+	ROM_PAGE_SIZE = 16 * 1024
+	RAM_PAGE_SIZE = 8 * 1024
+	MAX_ROM_SIZE  = 8 * 1024 * 1024 // ROM size code 0x08
+)
+
+// GBCart returns a MemCart for the cart in the device, with romsize bytes of
+// ROM in bank 0 and ramsize bytes of RAM in bank 1 if ramsize isn't 0.
+// Requires Connect().
+func (d *GBCF) GBCart(romsize int64, ramsize int64) *GBCart {
+	gbc := &GBCart{d: d}
+	gbc.romBank = &GBCartROM{d: d, size: romsize}
+	if ramsize > 0 {
+		gbc.ramAvailable = true
+		gbc.ramBank = &GBCartRAM{d: d, size: ramsize}
+	}
+	gbc.SwitchBank(0)
+	return gbc
+}
+
+// seek implements io.Seeker for a bank of size bytes at cur.
+func seek(cur int64, size int64, offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += cur
+	case io.SeekEnd:
+		offset += size
+	}
+	if offset < 0 {
+		return cur, fmt.Errorf("Trying to seek to negative offset %d", offset)
+	}
+	return offset, nil
+}
+
+///////////////gbcartrom (MemBank)
+
+// GBCartROM reads the ROM through the device, which can only read whole
+// 16KiB pages from the start of the cart, so pages read are cached.
+type GBCartROM struct {
+	d          *GBCF
+	addressCur int64
+	size       int64
+	cache      []byte
+}
+
+func (m *GBCartROM) Read(p []byte) (n int, err error) {
+	if m.addressCur >= m.size {
+		return 0, io.EOF
+	}
+	end := m.addressCur + int64(len(p))
+	if end > m.size {
+		end = m.size
+	}
+	if end > int64(len(m.cache)) {
+		// read at least twice what's cached, so reading in small blocks
+		// doesn't read the start of the ROM over and over
+		want := end
+		if want < 2*int64(len(m.cache)) {
+			want = 2 * int64(len(m.cache))
+		}
+		pages := (want + ROM_PAGE_SIZE - 1) / ROM_PAGE_SIZE
+		if max := (m.size + ROM_PAGE_SIZE - 1) / ROM_PAGE_SIZE; pages > max {
+			pages = max
+		}
+		b := make([]byte, pages*ROM_PAGE_SIZE)
+		if err = m.d.ReadROM(b); err != nil {
+			return 0, err
+		}
+		m.cache = b
+	}
+	n = copy(p, m.cache[m.addressCur:end])
+	m.addressCur += int64(n)
+	return n, nil
+}
+
+func (m *GBCartROM) Seek(offset int64, whence int) (int64, error) {
+	var err error
+	m.addressCur, err = seek(m.addressCur, m.size, offset, whence)
+	return m.addressCur, err
+}
+
+// Write isn't supported, flash has to be erased as a whole first.
+func (m *GBCartROM) Write(p []byte) (n int, err error) {
+	return 0, errors.New("Writing gbcartrom: use EraseFlash and WriteROM to write a whole flash cart")
+}
+
+func (m *GBCartROM) Name() string {
+	return "gbcartrom"
+}
+
+func (m *GBCartROM) Size() int64 {
+	return m.size
+}
+
+func (m *GBCartROM) AlwaysWritable() bool {
+	return false
+}
+
+///////////////gbcartram (MemBank)
+
+// GBCartRAM reads and writes cart RAM through the device, which only
+// transfers all of it at once.
+type GBCartRAM struct {
+	d          *GBCF
+	addressCur int64
+	size       int64
+	cache      []byte
+}
+
+// load reads the whole RAM into the cache.
+func (m *GBCartRAM) load() error {
+	if m.cache != nil {
+		return nil
+	}
+	b := make([]byte, m.size)
+	if err := m.d.ReadRAM(b); err != nil {
+		return err
+	}
+	m.cache = b
+	return nil
+}
+
+func (m *GBCartRAM) Read(p []byte) (n int, err error) {
+	if m.addressCur >= m.size {
+		return 0, io.EOF
+	}
+	if err = m.load(); err != nil {
+		return 0, err
+	}
+	n = copy(p, m.cache[m.addressCur:])
+	m.addressCur += int64(n)
+	return n, nil
+}
+
+// Write writes back all of RAM with p in place. Writes are cut off at the end
+// of the bank. The cache is dropped afterwards so a verify reads from the
+// cart.
+func (m *GBCartRAM) Write(p []byte) (n int, err error) {
+	if m.addressCur >= m.size {
+		return 0, io.ErrShortWrite
+	}
+	b := make([]byte, m.size)
+	if m.addressCur > 0 || m.addressCur+int64(len(p)) < m.size {
+		if err = m.load(); err != nil {
+			return 0, err
+		}
+		copy(b, m.cache)
+	}
+	n = copy(b[m.addressCur:], p)
+	m.cache = nil
+	if err = m.d.WriteRAM(b); err != nil {
+		return 0, err
+	}
+	m.addressCur += int64(n)
+	if n < len(p) {
+		err = io.ErrShortWrite
+	}
+	return n, err
+}
+
+func (m *GBCartRAM) Seek(offset int64, whence int) (int64, error) {
+	var err error
+	m.addressCur, err = seek(m.addressCur, m.size, offset, whence)
+	return m.addressCur, err
+}
+
+func (m *GBCartRAM) Name() string {
+	return "gbcartram"
+}
+
+func (m *GBCartRAM) Size() int64 {
+	return m.size
+}
+
+func (m *GBCartRAM) AlwaysWritable() bool {
+	return true
+}
+
+///////////////gbcart (MemCart)
+
+// GBCart has the ROM in bank 0 and RAM, if any, in bank 1.
+type GBCart struct {
+	d            *GBCF
+	ramAvailable bool
+	currentBank  memcart.MemBank
+	romBank      *GBCartROM
+	ramBank      *GBCartRAM
+}
+
+func (gbc *GBCart) NumBanks() int {
+	if gbc.ramAvailable {
+		return 2
+	}
+	return 1
+}
+
+func (gbc *GBCart) CurrentBank() memcart.MemBank {
+	return gbc.currentBank
+}
+
+// SwitchBank always explicitly seeks to 0, and drops anything cached so
+// the new bank is read fresh from the cart.
+func (gbc *GBCart) SwitchBank(reqbank int) error {
+	switch reqbank {
+	case 0:
+		gbc.romBank.cache = nil
+		gbc.currentBank = gbc.romBank
+	case 1:
+		if !gbc.ramAvailable {
+			return errors.New("RAM bank requested but not detected on cartridge")
+		}
+		gbc.ramBank.cache = nil
+		gbc.currentBank = gbc.ramBank
+	default:
+		return fmt.Errorf("Bank %d out of range 0-1", reqbank)
+	}
+	gbc.currentBank.Seek(0, io.SeekStart)
+	return nil
+}
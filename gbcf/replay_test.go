@@ -0,0 +1,95 @@
+package gbcf_test
+
+import (
+	"flag"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/grantek/fkmd/gbcf"
+	"github.com/grantek/fkmd/gbcf_sim"
+	"github.com/grantek/fkmd/transport"
+)
+
+// Transcripts in testdata are replayed through the same calls as sfgb
+// -rominfo -readram, so a session recorded with sfgb -rominfo -readram -record
+// can be dropped in as a new test.
+var update = flag.Bool("update", false, "rewrite testdata/sim_readram.txt from the simulator")
+
+type replayResult struct {
+	name   string
+	ramcrc uint32
+}
+
+// replayResults are the results expected from transcripts in testdata.
+var replayResults = map[string]replayResult{
+	"sim_readram.txt": {"TESTCART", 0xbc592b59},
+}
+
+func readRAMSession(o transport.Opener) (*replayResult, error) {
+	d := &gbcf.GBCF{}
+	d.SetOpener(o)
+	if err := d.Connect(); err != nil {
+		return nil, err
+	}
+	defer d.Disconnect()
+	if _, err := d.ReadDeviceStatus(); err != nil {
+		return nil, err
+	}
+	_, dci, err := d.ReadStatus()
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, gbcf.RamSizeBytes[dci.RAMSize])
+	if err = d.ReadRAM(b); err != nil {
+		return nil, err
+	}
+	return &replayResult{string(dci.GameNameBytes), crc32.ChecksumIEEE(b)}, nil
+}
+
+func TestReplay(t *testing.T) {
+	if *update {
+		f, err := os.Create(filepath.Join("testdata", "sim_readram.txt"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rom := gbcf_sim.SampleROM(0x8000, "TESTCART", 0x03, 0x02)
+		ram := make([]byte, 8*1024)
+		copy(ram, rom[0x4000:])
+		s := gbcf_sim.New(rom, ram)
+		_, err = readRAMSession(transport.Record(s.Open, f))
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	files, err := filepath.Glob(filepath.Join("testdata", "*.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, fn := range files {
+		f, err := os.Open(fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p, err := transport.NewReplayer(f)
+		f.Close()
+		if err != nil {
+			t.Fatalf("%s: %v", fn, err)
+		}
+		got, err := readRAMSession(p.Open)
+		if err == nil {
+			err = p.Done()
+		}
+		if err != nil {
+			t.Errorf("%s: %v", fn, err)
+			continue
+		}
+		t.Logf("%s: %q RAM CRC32 %08x", fn, got.name, got.ramcrc)
+		if want, ok := replayResults[filepath.Base(fn)]; ok && *got != want {
+			t.Errorf("%s: got %+v, want %+v", fn, *got, want)
+		}
+	}
+}
@@ -0,0 +1,544 @@
+package gbcf_test
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"testing"
+
+	"github.com/grantek/fkmd/gbcart"
+	"github.com/grantek/fkmd/gbcf"
+	"github.com/grantek/fkmd/gbcf_sim"
+	"github.com/grantek/fkmd/memcart"
+)
+
+// newSim returns a GBCF driver attached to a simulated device.
+func newSim(romsize int, ramsize int) (*gbcf.GBCF, *gbcf_sim.GBCF) {
+	var ramcode byte
+	switch ramsize {
+	case 2 * 1024:
+		ramcode = 0x01
+	case 8 * 1024:
+		ramcode = 0x02
+	case 32 * 1024:
+		ramcode = 0x03
+	}
+	rom := gbcf_sim.SampleROM(romsize, "TESTCART", 0x1b, ramcode)
+	ram := make([]byte, ramsize)
+	copy(ram, rom[0x4000:])
+	s := gbcf_sim.New(rom, ram)
+	d := &gbcf.GBCF{}
+	d.SetOpener(s.Open)
+	if err := d.Connect(); err != nil {
+		panic(err)
+	}
+	return d, s
+}
+
+func TestReadDeviceStatus(t *testing.T) {
+	d, s := newSim(0x8000, 0)
+	s.Firmware = gbcf.FirmwareVersion{Ver11: 1, Ver12: 2, Ver21: 3, Ver22: 4}
+	fw, err := d.ReadDeviceStatus()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *fw != s.Firmware {
+		t.Errorf("ReadDeviceStatus: got %+v, want %+v", *fw, s.Firmware)
+	}
+}
+
+func TestReadStatus(t *testing.T) {
+	d, s := newSim(0x20000, 8*1024)
+	s.CartInfo.BBL = true
+	s.CartInfo.SGB = true
+	s.CartInfo.ManufacturerID = 0xbf
+	_, dci, err := d.ReadStatus()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := s.CartInfo
+	if string(dci.GameNameBytes) != "TESTCART" {
+		t.Errorf("GameNameBytes: got %q, want %q", dci.GameNameBytes, "TESTCART")
+	}
+	if !reflect.DeepEqual(*dci, want) {
+		t.Errorf("ReadStatus: got %+v, want %+v", *dci, want)
+	}
+	if !dci.LogoCorrect || dci.TypeID != 0x1b || dci.ROMSize != 0x02 || dci.RAMSize != 0x02 {
+		t.Errorf("ReadStatus: cart info doesn't match ROM header: %+v", *dci)
+	}
+}
+
+func TestReadROM(t *testing.T) {
+	for _, size := range []int{0x8000, 0x20000} {
+		d, s := newSim(size, 0)
+		b := make([]byte, size)
+		if err := d.ReadROM(b); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b, s.ROM) {
+			t.Errorf("ReadROM %#x bytes: data mismatch", size)
+		}
+	}
+}
+
+func TestReadRAM(t *testing.T) {
+	for _, size := range []int{2 * 1024, 8 * 1024, 32 * 1024} {
+		d, s := newSim(0x8000, size)
+		b := make([]byte, size)
+		if err := d.ReadRAM(b); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b, s.RAM) {
+			t.Errorf("ReadRAM %#x bytes: data mismatch", size)
+		}
+		// the device must be idle and answering again
+		if _, err := d.ReadDeviceStatus(); err != nil {
+			t.Errorf("ReadDeviceStatus after ReadRAM %#x bytes: %v", size, err)
+		}
+	}
+}
+
+func TestWriteRAM(t *testing.T) {
+	for _, size := range []int{2 * 1024, 32 * 1024} {
+		d, s := newSim(0x8000, size)
+		b := gbcf_sim.SampleROM(size, "", 0, 0)
+		if err := d.WriteRAM(b); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b, s.RAM) {
+			t.Errorf("WriteRAM %#x bytes: data mismatch", size)
+		}
+		if s.BadPackets != 0 {
+			t.Errorf("WriteRAM %#x bytes: device got %d bad packets", size, s.BadPackets)
+		}
+	}
+}
+
+func TestMBC2RAM(t *testing.T) {
+	rom := gbcf_sim.SampleROM(0x10000, "PINBALL", 0x06, 0x00)
+	ram := make([]byte, 512)
+	for i := range ram {
+		ram[i] = byte(i)
+	}
+	s := gbcf_sim.New(rom, ram)
+	s.NibbleRAM = true
+	d := &gbcf.GBCF{}
+	d.SetOpener(s.Open)
+	mc, err := d.MemCart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mc.NumBanks() != 2 {
+		t.Fatalf("MBC2 cart has %d banks, want 2", mc.NumBanks())
+	}
+	var buf bytes.Buffer
+	if _, err = memcart.ReadBank(mc, 1, &buf, 512); err != nil {
+		t.Fatal(err)
+	}
+	want := make([]byte, 512)
+	for i := range want {
+		want[i] = byte(i) | 0xf0
+	}
+	if !bytes.Equal(buf.Bytes(), want) {
+		t.Errorf("ReadBank: got % x...", buf.Bytes()[:32])
+	}
+
+	save := make([]byte, 512)
+	for i := range save {
+		save[i] = byte(i+1) & 0x0f
+	}
+	if _, err = memcart.WriteBank(mc, 1, save); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(s.RAM, save) {
+		t.Errorf("WriteBank: RAM is % x..., want % x...", s.RAM[:16], save[:16])
+	}
+	gbcart.NormalizeMBC2RAM(save)
+	if err = memcart.VerifyBank(mc, 1, save); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestGetRomSize(t *testing.T) {
+	for _, tt := range []struct {
+		size int
+		code byte // what the header says
+	}{
+		{0x10000, 0x01},
+		{0x40000, 0x00}, // header too small
+		{0x10000, 0x04}, // header too big
+		{0x8000, 0x00},
+	} {
+		d, s := newSim(tt.size, 0)
+		s.ROM[0x148] = tt.code
+		hint, _ := gbcart.RomSize(tt.code)
+		got, rom, err := d.GetRomSize(hint)
+		if err != nil || got != tt.size {
+			t.Errorf("GetRomSize(%#x) of %#x bytes: got %#x, %v", hint, tt.size, got, err)
+		}
+		if !bytes.Equal(rom, s.ROM[:tt.size]) {
+			t.Errorf("GetRomSize(%#x) of %#x bytes: returned %#x bytes that don't match the ROM", hint, tt.size, len(rom))
+		}
+	}
+}
+
+func TestEraseFlash(t *testing.T) {
+	d, s := newSim(0x20000, 0)
+	s.EraseReads = 5
+	if err := d.EraseFlash(); err != nil {
+		t.Fatal(err)
+	}
+	if s.FlashErases != 1 {
+		t.Errorf("EraseFlash: device erased %d times, want 1", s.FlashErases)
+	}
+	for i, v := range s.ROM {
+		if v != 0xff {
+			t.Fatalf("EraseFlash: ROM byte %#x is %#02x, want 0xff", i, v)
+		}
+	}
+}
+
+func TestWriteROM(t *testing.T) {
+	d, s := newSim(0x20000, 0)
+	b := gbcf_sim.SampleROM(0x20000, "NEWCART", 0x19, 0)
+	if err := d.EraseFlash(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.WriteROM(b); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, s.ROM) {
+		t.Error("WriteROM: data mismatch")
+	}
+	if s.BadPackets != 0 || s.FailedBits != 0 {
+		t.Errorf("WriteROM: device got %d bad packets, %d failed bits", s.BadPackets, s.FailedBits)
+	}
+
+	got := make([]byte, len(b))
+	if err := d.ReadROM(got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, got) {
+		t.Error("ReadROM after WriteROM: data mismatch")
+	}
+}
+
+func TestCheckBootBlock(t *testing.T) {
+	d, s := newSim(0x40000, 0)
+	s.CartInfo.BBL = true
+	_, dci, err := d.ReadStatus()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sector, locked := dci.LockedRegion(); !locked || sector.Addr != 0 || sector.Size != 0x10000 {
+		t.Fatalf("LockedRegion: got %v %v, want the first 64KiB locked", sector, locked)
+	}
+
+	b := gbcf_sim.SampleROM(0x40000, "NEWCART", 0x19, 0)
+	err = d.CheckBootBlock(dci, b)
+	if e, ok := err.(*gbcf.BootBlockError); !ok || e.Offset != 0x134 {
+		t.Errorf("CheckBootBlock with a new boot block: got %v, want a BootBlockError at 0x134", err)
+	}
+
+	// keep the old boot block, and the write goes around it
+	copy(b, s.ROM[:0x10000])
+	if err = d.CheckBootBlock(dci, b); err != nil {
+		t.Fatal(err)
+	}
+	if err = d.EraseFlash(); err != nil {
+		t.Fatal(err)
+	}
+	if err = d.WriteROM(b); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, s.ROM) || s.FailedBits != 0 {
+		t.Errorf("WriteROM around the boot block: data mismatch, %d failed bits", s.FailedBits)
+	}
+	if s.Protected != 0x10000 {
+		t.Errorf("WriteROM: %#x bytes refused by the boot block, want 0x10000", s.Protected)
+	}
+
+	// a chip with 4KiB sectors locks less of the image
+	dci.ManufacturerID, dci.ChipID = 0xbf, 0xb5 // SST39SF010A
+	if sector, _ := dci.LockedRegion(); sector.Size != 0x1000 {
+		t.Errorf("LockedRegion: got %v, want 4KiB", sector)
+	}
+	if err = d.CheckBootBlock(dci, make([]byte, 0x4000)); err == nil {
+		t.Error("CheckBootBlock with a zeroed boot block: no error")
+	}
+	dci.BBL = false
+	if err = d.CheckBootBlock(dci, make([]byte, 0x4000)); err != nil {
+		t.Errorf("CheckBootBlock unlocked: %v", err)
+	}
+}
+
+func TestWriteROMUnerased(t *testing.T) {
+	d, s := newSim(0x8000, 0)
+	b := make([]byte, len(s.ROM))
+	for i, v := range s.ROM {
+		b[i] = ^v
+	}
+	if err := d.WriteROM(b); err != nil {
+		t.Fatal(err)
+	}
+	if s.FailedBits == 0 {
+		t.Error("WriteROM over old data: flash took every bit")
+	}
+	for i, v := range s.ROM {
+		if v != 0 {
+			t.Fatalf("WriteROM over old data: byte %#x is %#02x, want 0", i, v)
+		}
+	}
+}
+
+func TestWriteROMSize(t *testing.T) {
+	d, _ := newSim(0x8000, 0)
+	for _, size := range []int{0, 0x2000, 0x5000} {
+		if err := d.WriteROM(make([]byte, size)); err == nil {
+			t.Errorf("WriteROM %#x bytes: no error", size)
+		}
+	}
+}
+
+func TestEraseRAM(t *testing.T) {
+	d, s := newSim(0x8000, 8*1024)
+	s.EraseReads = 2
+	if err := d.EraseRAM(); err != nil {
+		t.Fatal(err)
+	}
+	if s.RAMErases != 1 || s.FlashErases != 0 {
+		t.Errorf("EraseRAM: device erased RAM %d times and flash %d times, want 1 and 0", s.RAMErases, s.FlashErases)
+	}
+	if !bytes.Equal(s.RAM, make([]byte, 8*1024)) {
+		t.Error("EraseRAM: RAM not cleared")
+	}
+}
+
+func TestMemCart(t *testing.T) {
+	d, s := newSim(0x20000, 8*1024)
+	mc, err := d.MemCart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mc.NumBanks() != 2 {
+		t.Fatalf("NumBanks: got %d, want 2", mc.NumBanks())
+	}
+	for bank, want := range [][]byte{s.ROM, s.RAM} {
+		var buf bytes.Buffer
+		if _, err := memcart.ReadBank(mc, bank, &buf, 0x1000); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf.Bytes(), want) {
+			t.Errorf("bank %d (%s): data mismatch", bank, mc.CurrentBank().Name())
+		}
+	}
+	if err := mc.SwitchBank(2); err == nil {
+		t.Error("SwitchBank(2) succeeded")
+	}
+	if mc, _ = d.MemCart(); mc.NumBanks() != 2 {
+		t.Errorf("NumBanks after reconnect: got %d, want 2", mc.NumBanks())
+	}
+
+	// unknown ROM size code, unknown cart type
+	for _, tt := range []struct{ typ, rom byte }{{0x1b, 0x20}, {0xee, 0x02}} {
+		s.CartInfo.TypeID, s.CartInfo.ROMSize = tt.typ, tt.rom
+		if mc, err = d.MemCart(); mc != nil || err == nil {
+			t.Errorf("MemCart with type 0x%02X, ROM size code 0x%02X: got %v, %v, want an error", tt.typ, tt.rom, mc, err)
+		}
+	}
+}
+
+func TestGBCartROMSeek(t *testing.T) {
+	d, s := newSim(0x20000, 0)
+	mc := d.GBCart(0x20000, 0)
+	if mc.NumBanks() != 1 {
+		t.Errorf("NumBanks: got %d, want 1", mc.NumBanks())
+	}
+	if err := mc.SwitchBank(1); err == nil {
+		t.Error("SwitchBank(1) succeeded without RAM")
+	}
+	mb := mc.CurrentBank()
+	b := make([]byte, 0x10)
+	for _, off := range []int64{0x1fff0, 0x134, 0x4000} {
+		if _, err := mb.Seek(off, io.SeekStart); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.ReadFull(mb, b); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b, s.ROM[off:off+0x10]) {
+			t.Errorf("read at %#x: got % x, want % x", off, b, s.ROM[off:off+0x10])
+		}
+	}
+	if pos, _ := mb.Seek(-0x10, io.SeekEnd); pos != 0x1fff0 {
+		t.Errorf("Seek from end: got %#x, want 0x1fff0", pos)
+	}
+	if n, err := mb.Read(b); n != 0x10 || err != nil {
+		t.Errorf("read at end of bank: got %d, %v", n, err)
+	}
+	if _, err := mb.Read(b); err != io.EOF {
+		t.Errorf("read past end of bank: got %v, want io.EOF", err)
+	}
+	if _, err := mb.Write(b); err == nil {
+		t.Error("Write to ROM succeeded")
+	}
+}
+
+func TestGBCartRAMWrite(t *testing.T) {
+	for _, size := range []int{2 * 1024, 32 * 1024} {
+		d, s := newSim(0x8000, size)
+		mc := d.GBCart(0x8000, int64(size))
+		want := append([]byte{}, s.RAM...)
+		if err := mc.SwitchBank(1); err != nil {
+			t.Fatal(err)
+		}
+		mb := mc.CurrentBank()
+		mb.Seek(0x100, io.SeekStart)
+		if n, err := mb.Write([]byte("patch")); n != 5 || err != nil {
+			t.Fatalf("Write: got %d, %v", n, err)
+		}
+		copy(want[0x100:], "patch")
+		if !bytes.Equal(s.RAM, want) {
+			t.Errorf("%d byte RAM: partial write changed the rest of RAM", size)
+		}
+		if err := memcart.VerifyBank(mc, 1, want); err != nil {
+			t.Error(err)
+		}
+
+		full := bytes.Repeat([]byte{0x5a}, size+1)
+		if n, _ := memcart.WriteBank(mc, 1, full); n != size {
+			t.Errorf("WriteBank: wrote %d bytes, want %d", n, size)
+		}
+		if !bytes.Equal(s.RAM, full[:size]) {
+			t.Errorf("%d byte RAM: whole write mismatch", size)
+		}
+	}
+}
+
+func TestSelectMBC(t *testing.T) {
+	d, s := newSim(0x8000, 8*1024)
+	if _, _, err := d.ReadStatus(); err != nil {
+		t.Fatal(err)
+	}
+	if s.Algorithm != gbcf.ALG16 || s.MBC != gbcf.MBCAUTO {
+		t.Errorf("defaults: device got algorithm %d, MBC %d", s.Algorithm, s.MBC)
+	}
+	if err := d.SetMBC(gbcf.MBC1); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.SetAlgorithm(gbcf.ALG12); err != nil {
+		t.Fatal(err)
+	}
+	for name, op := range map[string]func() error{
+		"ReadRAM":    func() error { return d.ReadRAM(make([]byte, 8*1024)) },
+		"EraseFlash": d.EraseFlash,
+		"WriteROM":   func() error { return d.WriteROM(make([]byte, 0x4000)) },
+	} {
+		s.Algorithm, s.MBC = 0xff, 0xff
+		if err := op(); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if s.Algorithm != gbcf.ALG12 || s.MBC != gbcf.MBC1 {
+			t.Errorf("%s: device got algorithm %d, MBC %d", name, s.Algorithm, s.MBC)
+		}
+	}
+}
+
+func TestSetSpeed(t *testing.T) {
+	d, s := newSim(0x8000, 0)
+	if s.Options.BaudRate != 185000 || d.Speed() != gbcf.STANDARD {
+		t.Errorf("default: opened at %d baud, speed %d", s.Options.BaudRate, d.Speed())
+	}
+	opens := s.Opens
+	if err := d.SetSpeed(gbcf.HIGH); err != nil {
+		t.Fatal(err)
+	}
+	if s.Options.BaudRate != 375000 || s.Opens != opens+1 || d.Speed() != gbcf.HIGH {
+		t.Errorf("SetSpeed(HIGH): opened at %d baud, speed %d", s.Options.BaudRate, d.Speed())
+	}
+
+	// nothing gets through above 125000 baud
+	s.FlakyBaud, s.FlakyEvery = 125000, 1
+	err := d.SetSpeed(gbcf.HIGH)
+	if err == nil || d.Speed() != gbcf.LOW || s.Options.BaudRate != 125000 {
+		t.Errorf("SetSpeed(HIGH) on a bad link: got speed %d, %v", d.Speed(), err)
+	}
+	if _, err = d.ReadDeviceStatus(); err != nil {
+		t.Error(err)
+	}
+	if err = d.SetSpeed(3); err == nil {
+		t.Error("SetSpeed(3) succeeded")
+	}
+}
+
+func TestSpeedFallback(t *testing.T) {
+	d, s := newSim(0x20000, 0)
+	if err := d.SetSpeed(gbcf.HIGH); err != nil {
+		t.Fatal(err)
+	}
+	// 1 in 20 bad is too many at 375000 baud, 185000 is clean
+	s.FlakyBaud, s.FlakyEvery = 185000, 20
+	b := make([]byte, 0x20000)
+	if err := d.ReadROM(b); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, s.ROM) {
+		t.Error("ReadROM: data mismatch")
+	}
+	if d.Speed() != gbcf.STANDARD {
+		t.Errorf("speed after a flaky transfer: got %d, want STANDARD", d.Speed())
+	}
+	e := d.Errors()
+	if err := d.ReadROM(b); err != nil || d.Errors() != e {
+		t.Errorf("ReadROM at STANDARD: %v, errors went from %v to %v", err, e, d.Errors())
+	}
+
+	// a transfer that fails outright is tried again lower down
+	d.SetSpeed(gbcf.HIGH)
+	s.FlakyBaud, s.FlakyEvery = 125000, 1
+	d.SetRetries(0)
+	if err := d.ReadROM(b); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, s.ROM) || d.Speed() != gbcf.LOW {
+		t.Errorf("ReadROM after failing: speed %d", d.Speed())
+	}
+}
+
+func TestWriteROMFallback(t *testing.T) {
+	d, s := newSim(0x20000, 0)
+	if err := d.SetSpeed(gbcf.HIGH); err != nil {
+		t.Fatal(err)
+	}
+	b := gbcf_sim.SampleROM(0x20000, "NEWCART", 0x19, 0)
+	if err := d.EraseFlash(); err != nil {
+		t.Fatal(err)
+	}
+	// the write fails part way through at 375000 baud, 185000 is clean
+	s.FlakyBaud, s.FlakyEvery = 185000, 1000
+	d.SetRetries(0)
+	if err := d.WriteROM(b); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, s.ROM) {
+		t.Error("WriteROM: data mismatch")
+	}
+	if s.BadPackets != 1 || d.Speed() != gbcf.STANDARD {
+		t.Errorf("WriteROM: %d bad packets, speed %d, want 1 at STANDARD", s.BadPackets, d.Speed())
+	}
+	if s.FlashErases != 2 || s.Reprogrammed != 0 || s.FailedBits != 0 {
+		t.Errorf("WriteROM again after failing: %d erases, %d bytes programmed twice, %d failed bits, want 2 erases",
+			s.FlashErases, s.Reprogrammed, s.FailedBits)
+	}
+}
+
+func TestParseSpeed(t *testing.T) {
+	for str, want := range map[string]byte{"low": gbcf.LOW, "Standard": gbcf.STANDARD, "375000": gbcf.HIGH} {
+		if speed, err := gbcf.ParseSpeed(str); speed != want || err != nil {
+			t.Errorf("ParseSpeed(%q): got %d, %v, want %d", str, speed, err, want)
+		}
+	}
+	if _, err := gbcf.ParseSpeed("115200"); err == nil {
+		t.Error("ParseSpeed(\"115200\") succeeded")
+	}
+}
@@ -0,0 +1,112 @@
+package gbcf
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/grantek/fkmd/transport"
+)
+
+// tracer decodes each direction separately, both carry control bytes and
+// packets.
+type tracer struct {
+	sent     []byte
+	received []byte
+}
+
+// NewDecoder returns a transport.Decoder for the GBCF packet protocol, giving
+// a line for each control byte and each packet's command, subcommand,
+// page/packet index and CRC status.
+func NewDecoder() transport.Decoder {
+	return &tracer{}
+}
+
+func (t *tracer) Sent(b []byte) []string {
+	var lines []string
+	t.sent, lines = decodePackets(append(t.sent, b...))
+	return lines
+}
+
+func (t *tracer) Received(b []byte) []string {
+	var lines []string
+	t.received, lines = decodePackets(append(t.received, b...))
+	return lines
+}
+
+// decodePackets returns a line for each control byte and packet in b, and
+// the bytes of an incomplete packet left over.
+func decodePackets(b []byte) ([]byte, []string) {
+	var lines []string
+	for len(b) > 0 {
+		if ControlByte(b[0]) != DATA {
+			lines = append(lines, ControlByte(b[0]).String())
+			b = b[1:]
+			continue
+		}
+		if len(b) < PACKETSIZE {
+			break
+		}
+		p := &Packet{}
+		copy(p.bytes[:], b)
+		lines = append(lines, p.String())
+		b = b[PACKETSIZE:]
+	}
+	return b, lines
+}
+
+// String describes a DATA packet, eg. "DATA NORMAL_DATA page 3 packet 12 CRC
+// ok".
+func (p *Packet) String() string {
+	s := fmt.Sprintf("%s %s", p.Control(), p.Command())
+	sub := SubcommandByte(p.bytes[2])
+	switch p.Command() {
+	case CONFIG:
+		s += fmt.Sprintf(" %s pages %d", sub.Name(CONFIG), int(p.bytes[6])*256+int(p.bytes[7])+1)
+	case ERASE, STATUS:
+		s += " " + sub.Name(p.Command())
+	}
+	switch p.Command() {
+	case CONFIG, ERASE, STATUS:
+		// only shown when they're not the defaults
+		if p.bytes[3] == ALG12 {
+			s += " ALG12"
+		}
+		if p.bytes[4] != MBCAUTO {
+			s += " " + mbcName(p.bytes[4])
+		}
+	case NORMAL_DATA, LAST_DATA:
+		s += fmt.Sprintf(" page %d packet %d", int(p.bytes[4])*256+int(p.bytes[5]), p.bytes[3])
+	}
+	if err := p.Check(); err != nil {
+		c := p.CRC16()
+		return s + fmt.Sprintf(" CRC bad (got 0x%02X%02X, want 0x%04X)", p.bytes[PACKETSIZE-2], p.bytes[PACKETSIZE-1], c)
+	}
+	return s + " CRC ok"
+}
+
+// mbcName returns the name of an mbc_t, as accepted by ParseMBC.
+func mbcName(mbc byte) string {
+	for name, v := range MBCs {
+		if v == mbc {
+			return strings.ToUpper(name)
+		}
+	}
+	return fmt.Sprintf("MBC(%d)", mbc)
+}
+
+// Name returns the name of a subcommand of cb, since their values overlap.
+func (s SubcommandByte) Name(cb CommandByte) string {
+	var names []string
+	switch cb {
+	case CONFIG:
+		names = []string{"RROM", "RRAM", "WROM", "WRAM"}
+	case ERASE:
+		names = []string{"EFLA", "ERAM"}
+	case STATUS:
+		names = []string{"NREAD_ID", "READ_ID"}
+	}
+	if int(s) < len(names) {
+		return names[s]
+	}
+	return fmt.Sprintf("SubcommandByte(%d)", s)
+}
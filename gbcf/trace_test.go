@@ -0,0 +1,53 @@
+package gbcf
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestDecoder(t *testing.T) {
+	pc := PacketConfig{Control: DATA, Command: CONFIG, Subcommand: RROM, PageCount: 2}
+	p, err := pc.Packet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, _ := p.Bytes()
+	pc = PacketConfig{Control: DATA, Command: LAST_DATA, PageIndex: 3, PacketIndex: 12}
+	if p, err = pc.Packet(); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := p.Bytes()
+	data[PACKETSIZE-1] ^= 0xff
+	pc = PacketConfig{Control: DATA, Command: STATUS, Subcommand: READ_ID, Algorithm: ALG12, MBC: MBC5}
+	if p, err = pc.Packet(); err != nil {
+		t.Fatal(err)
+	}
+	status, _ := p.Bytes()
+
+	dec := NewDecoder()
+	for _, c := range []struct {
+		sent     []byte
+		received []byte
+		want     []string
+	}{
+		{sent: config[:10]},
+		{sent: config[10:], want: []string{"DATA CONFIG RROM pages 2 CRC ok"}},
+		{received: append([]byte{byte(ACK)}, data...), want: []string{
+			"ACK",
+			fmt.Sprintf("DATA LAST_DATA page 3 packet 12 CRC bad (got 0x%02X%02X, want 0x%02X%02X)",
+				data[PACKETSIZE-2], data[PACKETSIZE-1], data[PACKETSIZE-2], data[PACKETSIZE-1]^0xff),
+		}},
+		{sent: append([]byte{byte(NAK), byte(END)}, status...), want: []string{"NAK", "END", "DATA STATUS READ_ID ALG12 MBC5 CRC ok"}},
+	} {
+		var got []string
+		if c.sent != nil {
+			got = dec.Sent(c.sent)
+		} else {
+			got = dec.Received(c.received)
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("got %q, want %q", got, c.want)
+		}
+	}
+}
@@ -0,0 +1,456 @@
+// Package gbcf_sim simulates a Game Boy Cart Flasher on the far end of the
+// serial line. It decodes the 72-byte packets sent by the gbcf driver and
+// answers them from an in-memory cartridge, so the driver can be tested
+// without hardware.
+package gbcf_sim
+
+import (
+	"errors"
+	"io"
+
+	"github.com/grantek/fkmd/gbcf"
+	"github.com/jacobsa/go-serial/serial"
+)
+
+const (
+	ROM_PAGE_SIZE = 16 * 1024
+	RAM_PAGE_SIZE = 8 * 1024
+
+	HEADER_OFFSET = 0x134 // header bytes copied into STATUS(READ_ID) from here
+	HEADER_LEN    = 0x1c
+	STATUS_OFFSET = 9 // position of header bytes in STATUS(READ_ID)
+)
+
+type xferState int
+
+const (
+	IDLE      xferState = iota
+	SENDING             // streaming ROM or RAM to the host
+	RECEIVING           // taking WRAM data from the host
+)
+
+// GBCF is a simulated cart flasher with a cartridge inserted. It implements
+// io.ReadWriteCloser: bytes written are decoded as packets and control bytes,
+// and replies are queued to be read.
+type GBCF struct {
+	ROM []byte // Cartridge ROM, mirrored if a read runs past the end
+	RAM []byte // Cartridge RAM, nil if none
+
+	// MBC2 RAM only keeps the low 4 bits of each byte, the rest read as 1s.
+	NibbleRAM bool
+
+	Firmware gbcf.FirmwareVersion
+	CartInfo gbcf.DeviceCartInfo // Reported by STATUS(READ_ID)
+
+	Options serial.OpenOptions // Options from the last Open
+	Opens   int                // Number of times Open was called
+
+	// Reads that find nothing to read while the flash is erasing
+	EraseReads int
+
+	// One in FlakyEvery packets sent while the port is open faster than
+	// FlakyBaud is corrupted, for testing speed fallback, and so is one in
+	// FlakyEvery data packets written. A resend after a NAK gets through.
+	FlakyBaud  uint
+	FlakyEvery int
+
+	// Flash algorithm and MBC type from the last CONFIG, ERASE or STATUS
+	Algorithm byte
+	MBC       byte
+
+	// Counters for tests to check what the driver did.
+	BadPackets   int // Packets received with a bad CRC
+	Resent       int // Packets sent again after a NAK
+	FlashErases  int
+	RAMErases    int
+	FailedBits   int // Attempts to program a 0 bit of flash back to 1
+	Reprogrammed int // Flash bytes programmed again without an erase
+	Protected    int // Bytes not programmed because the boot block is locked
+
+	state   xferState
+	mem     []byte // memory being streamed or written
+	flash   bool   // mem is flash, writes can only clear bits
+	nibbles bool   // mem is 4-bit RAM
+	erasing int    // reads left before the erase ACK
+	pages   int
+	pktsize int // packets per page
+	seq     int // index of the current packet across all pages
+	sent    int // packets sent or received over a flaky link
+	last    [gbcf.PACKETSIZE]byte
+	in      []byte
+	out     []byte
+	closed  bool
+}
+
+// New returns a simulated cart flasher with rom and ram inserted. CartInfo
+// is filled in from the ROM header, with an AMD flash chip.
+func New(rom []byte, ram []byte) *GBCF {
+	s := &GBCF{
+		ROM:      rom,
+		RAM:      ram,
+		Firmware: gbcf.FirmwareVersion{Ver11: 0, Ver12: 1, Ver21: 0, Ver22: 5},
+	}
+	var hdr [HEADER_LEN]byte
+	if len(rom) >= HEADER_OFFSET+HEADER_LEN {
+		copy(hdr[:], rom[HEADER_OFFSET:])
+	}
+	name := hdr[:16]
+	for i, v := range name {
+		if v == 0 {
+			name = name[:i]
+			break
+		}
+	}
+	s.CartInfo = gbcf.DeviceCartInfo{
+		ManufacturerID: 0x01,
+		ChipID:         0xad,
+		LogoCorrect:    len(rom) >= 0x134 && string(rom[0x104:0x134]) == string(Logo[:]),
+		CGB:            hdr[0x0f] == 0x80,
+		SGB:            hdr[0x12] == 0x03,
+		TypeID:         hdr[0x13],
+		ROMSize:        hdr[0x14],
+		RAMSize:        hdr[0x15],
+		CRC16:          uint16(hdr[0x1a])<<8 | uint16(hdr[0x1b]),
+		GameNameBytes:  append([]byte{}, name...),
+	}
+	return s
+}
+
+// Read returns queued reply bytes. Like a serial port hitting its read
+// timeout, it returns io.EOF when the device has nothing to send.
+func (s *GBCF) Read(p []byte) (int, error) {
+	if s.closed {
+		return 0, errors.New("gbcf_sim: read from closed device")
+	}
+	if s.erasing > 0 {
+		s.erasing--
+		if s.erasing == 0 {
+			s.sendControl(gbcf.ACK)
+		}
+		return 0, io.EOF
+	}
+	if len(s.out) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, s.out)
+	s.out = s.out[n:]
+	return n, nil
+}
+
+// Write decodes packets and control bytes from p. A packet may be split
+// across calls.
+func (s *GBCF) Write(p []byte) (int, error) {
+	if s.closed {
+		return 0, errors.New("gbcf_sim: write to closed device")
+	}
+	s.in = append(s.in, p...)
+	for len(s.in) > 0 {
+		if gbcf.ControlByte(s.in[0]) != gbcf.DATA {
+			s.control(gbcf.ControlByte(s.in[0]))
+			s.in = s.in[1:]
+			continue
+		}
+		if len(s.in) < gbcf.PACKETSIZE {
+			break
+		}
+		s.packet(s.in[:gbcf.PACKETSIZE])
+		s.in = s.in[gbcf.PACKETSIZE:]
+	}
+	return len(p), nil
+}
+
+// Open reopens the device with the given options. It is a transport.Opener,
+// so drivers can use the simulator in place of a serial port.
+func (s *GBCF) Open(opt serial.OpenOptions) (io.ReadWriteCloser, error) {
+	s.Options = opt
+	s.Opens++
+	s.closed = false
+	s.in = nil
+	s.out = nil
+	s.state = IDLE
+	s.erasing = 0
+	return s, nil
+}
+
+// Close marks the device closed, cartridge memory is kept.
+func (s *GBCF) Close() error {
+	if s.closed {
+		return errors.New("gbcf_sim: device already closed")
+	}
+	s.closed = true
+	s.in = nil
+	s.out = nil
+	s.state = IDLE
+	return nil
+}
+
+func (s *GBCF) control(cb gbcf.ControlByte) {
+	switch cb {
+	case gbcf.ACK:
+		if s.state != SENDING {
+			return
+		}
+		s.seq++
+		if s.seq >= s.pages*s.pktsize {
+			s.state = IDLE
+			return
+		}
+		s.sendData()
+	case gbcf.NAK:
+		if s.state != SENDING {
+			return
+		}
+		s.Resent++
+		s.out = append(s.out, s.last[:]...)
+	case gbcf.END:
+		s.state = IDLE
+	}
+}
+
+func (s *GBCF) packet(b []byte) {
+	c := CRC16(b[:gbcf.PACKETSIZE-2])
+	if b[gbcf.PACKETSIZE-2] != byte(c>>8) || b[gbcf.PACKETSIZE-1] != byte(c) {
+		s.BadPackets++
+		s.sendControl(gbcf.NAK)
+		return
+	}
+
+	cmd := gbcf.CommandByte(b[1])
+	sub := gbcf.SubcommandByte(b[2])
+	if s.state == RECEIVING {
+		if cmd == gbcf.NORMAL_DATA || cmd == gbcf.LAST_DATA {
+			s.receiveData(b)
+			return
+		}
+		s.state = IDLE
+	}
+
+	switch cmd {
+	case gbcf.CONFIG, gbcf.ERASE, gbcf.STATUS:
+		s.Algorithm = b[3]
+		s.MBC = b[4]
+	}
+	switch cmd {
+	case gbcf.STATUS:
+		s.sendStatus(sub == gbcf.READ_ID)
+	case gbcf.CONFIG:
+		pages := int(b[6])*256 + int(b[7]) + 1
+		s.nibbles = s.NibbleRAM && (sub == gbcf.RRAM || sub == gbcf.WRAM)
+		switch sub {
+		case gbcf.RROM:
+			s.startSend(s.ROM, pages, ROM_PAGE_SIZE)
+		case gbcf.RRAM:
+			s.startSend(s.RAM, pages, RAM_PAGE_SIZE)
+		case gbcf.WROM:
+			s.startReceive(s.ROM, true, pages, ROM_PAGE_SIZE)
+		case gbcf.WRAM:
+			s.startReceive(s.RAM, false, pages, RAM_PAGE_SIZE)
+		default:
+			s.sendControl(gbcf.NAK)
+		}
+	case gbcf.ERASE:
+		switch sub {
+		case gbcf.EFLA:
+			for i := range s.ROM {
+				if !s.locked(i) {
+					s.ROM[i] = 0xff
+				}
+			}
+			s.FlashErases++
+			s.startErase()
+		case gbcf.ERAM:
+			for i := range s.RAM {
+				s.RAM[i] = 0x00
+			}
+			s.RAMErases++
+			s.startErase()
+		default:
+			s.sendControl(gbcf.NAK)
+		}
+	default:
+		s.sendControl(gbcf.NAK)
+	}
+}
+
+func (s *GBCF) sendControl(cb gbcf.ControlByte) {
+	s.out = append(s.out, byte(cb))
+}
+
+// sendPacket fills in the CRC and queues b, keeping a copy to resend on NAK.
+func (s *GBCF) sendPacket(b []byte) {
+	c := CRC16(b[:gbcf.PACKETSIZE-2])
+	b[gbcf.PACKETSIZE-2] = byte(c >> 8)
+	b[gbcf.PACKETSIZE-1] = byte(c)
+	copy(s.last[:], b)
+	if s.flaky() {
+		b[gbcf.PACKETSIZE/2] ^= 0xff
+	}
+	s.out = append(s.out, b...)
+}
+
+// flaky reports whether the flaky link corrupts the packet going over it.
+func (s *GBCF) flaky() bool {
+	if s.FlakyEvery == 0 || s.Options.BaudRate <= s.FlakyBaud {
+		return false
+	}
+	s.sent++
+	return s.sent%s.FlakyEvery == 0
+}
+
+func (s *GBCF) sendStatus(long bool) {
+	b := make([]byte, gbcf.PACKETSIZE)
+	b[0] = byte(gbcf.DATA)
+	b[1] = byte(gbcf.STATUS)
+	b[2] = s.Firmware.Ver11<<4 | s.Firmware.Ver12
+	b[3] = s.Firmware.Ver21<<4 | s.Firmware.Ver22
+	if long {
+		dci := &s.CartInfo
+		b[4] = dci.ManufacturerID
+		b[5] = dci.ChipID
+		if dci.BBL {
+			b[6] = 0x01
+		}
+		if dci.LogoCorrect {
+			b[8] = 1
+		}
+		copy(b[STATUS_OFFSET:STATUS_OFFSET+16], dci.GameNameBytes)
+		if dci.CGB {
+			b[24] = 0x80
+		}
+		if dci.SGB {
+			b[27] = 0x03
+		}
+		b[28] = dci.TypeID
+		b[29] = dci.ROMSize
+		b[30] = dci.RAMSize
+		b[35] = byte(dci.CRC16 >> 8)
+		b[36] = byte(dci.CRC16)
+	}
+	s.sendPacket(b)
+}
+
+func (s *GBCF) startSend(mem []byte, pages int, pagesize int) {
+	s.mem = mem
+	s.pages = pages
+	s.pktsize = pagesize / gbcf.FRAMESIZE
+	s.seq = 0
+	s.state = SENDING
+	s.sendData()
+}
+
+// sendData sends the packet at s.seq, the last one of the transfer marked
+// LAST_DATA.
+func (s *GBCF) sendData() {
+	b := make([]byte, gbcf.PACKETSIZE)
+	b[0] = byte(gbcf.DATA)
+	b[1] = byte(gbcf.NORMAL_DATA)
+	if s.seq == s.pages*s.pktsize-1 {
+		b[1] = byte(gbcf.LAST_DATA)
+	}
+	page := s.seq / s.pktsize
+	b[3] = byte(s.seq % s.pktsize)
+	b[4] = byte(page >> 8)
+	b[5] = byte(page)
+	frame := b[6 : 6+gbcf.FRAMESIZE]
+	off := s.seq * gbcf.FRAMESIZE
+	for i := range frame {
+		frame[i] = 0xff
+		if len(s.mem) > 0 {
+			frame[i] = s.mem[(off+i)%len(s.mem)]
+		}
+		if s.nibbles {
+			frame[i] |= 0xf0
+		}
+	}
+	s.sendPacket(b)
+}
+
+func (s *GBCF) startReceive(mem []byte, flash bool, pages int, pagesize int) {
+	s.mem = mem
+	s.flash = flash
+	s.pages = pages
+	s.pktsize = pagesize / gbcf.FRAMESIZE
+	s.seq = 0
+	s.state = RECEIVING
+	s.sendControl(gbcf.ACK)
+}
+
+// locked reports whether ROM offset i is in a locked boot block, which the
+// chip won't erase or program.
+func (s *GBCF) locked(i int) bool {
+	sector, locked := s.CartInfo.LockedRegion()
+	return locked && i >= sector.Addr && i < sector.Addr+sector.Size
+}
+
+// startErase answers after EraseReads empty reads, as the device does when
+// the chip finishes.
+func (s *GBCF) startErase() {
+	if s.EraseReads == 0 {
+		s.sendControl(gbcf.ACK)
+		return
+	}
+	s.erasing = s.EraseReads
+}
+
+func (s *GBCF) receiveData(b []byte) {
+	if s.flaky() {
+		s.BadPackets++
+		s.sendControl(gbcf.NAK)
+		return
+	}
+	seq := (int(b[4])*256+int(b[5]))*s.pktsize + int(b[3])
+	switch seq {
+	case s.seq:
+		off := seq * gbcf.FRAMESIZE
+		for i, v := range b[6 : 6+gbcf.FRAMESIZE] {
+			if len(s.mem) == 0 {
+				break
+			}
+			j := (off + i) % len(s.mem)
+			if s.flash && s.locked(j) {
+				s.Protected++
+				continue
+			}
+			if s.flash {
+				if s.mem[j] != 0xff {
+					s.Reprogrammed++
+				}
+				for x := v &^ s.mem[j]; x != 0; x &= x - 1 {
+					s.FailedBits++
+				}
+				v &= s.mem[j]
+			}
+			if s.nibbles {
+				v &= 0x0f
+			}
+			s.mem[j] = v
+		}
+		s.seq++
+	case s.seq - 1:
+		// resent after a lost ACK, already written
+	default:
+		s.sendControl(gbcf.NAK)
+		return
+	}
+	if gbcf.CommandByte(b[1]) == gbcf.LAST_DATA {
+		s.state = IDLE
+	}
+	s.sendControl(gbcf.ACK)
+}
+
+// CRC16 is the CRC16-CCITT (XModem) of b, calculated bitwise so that it's
+// independent of the driver's lookup table.
+func CRC16(b []byte) uint16 {
+	var c uint16
+	for _, v := range b {
+		c ^= uint16(v) << 8
+		for i := 0; i < 8; i++ {
+			if c&0x8000 != 0 {
+				c = c<<1 ^ 0x1021
+			} else {
+				c <<= 1
+			}
+		}
+	}
+	return c
+}
@@ -0,0 +1,46 @@
+package gbcf_sim
+
+import "github.com/grantek/fkmd/gbcart"
+
+// Logo is the bitmap at 0x104 the Game Boy boot ROM checks.
+var Logo = gbcart.Logo
+
+// SampleROM returns a size-byte ROM image filled with pseudo-random data, so
+// no two banks mirror each other, with a valid header naming the given cart
+// type and RAM size code and correct header and global checksums.
+func SampleROM(size int, title string, carttype byte, ramsize byte) []byte {
+	rom := make([]byte, size)
+	var x uint32 = 0x6d2b79f5
+	for i := range rom {
+		x = x*1664525 + 1013904223
+		rom[i] = byte(x >> 24)
+	}
+	if size < 0x150 {
+		return rom
+	}
+	hdr := rom[0x100:0x150]
+	for i := range hdr {
+		hdr[i] = 0
+	}
+	copy(rom[0x100:], []byte{0x00, 0xc3, 0x50, 0x01}) // nop; jp 0x150
+	copy(rom[0x104:], Logo[:])
+	copy(rom[0x134:0x144], title)
+	rom[0x147] = carttype
+	for code := byte(0); 0x8000<<code <= size; code++ {
+		rom[0x148] = code
+	}
+	rom[0x149] = ramsize
+	rom[0x14a] = 0x01 // non-Japanese
+	rom[0x14b] = 0x33 // use new licensee code
+	FixChecksums(rom)
+	return rom
+}
+
+// FixChecksums sets the header checksum at 0x14D and the global checksum at
+// 0x14E-0x14F of rom.
+func FixChecksums(rom []byte) {
+	rom[0x14d] = gbcart.HeaderChecksum(rom)
+	g := gbcart.GlobalChecksum(rom)
+	rom[0x14e] = byte(g >> 8)
+	rom[0x14f] = byte(g)
+}
@@ -0,0 +1,78 @@
+package krikzz_fkmd
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/grantek/fkmd/krikzz_fkmd_sim"
+	"github.com/grantek/fkmd/transport"
+)
+
+// newFaultySim returns a driver connected to a simulated Flashkit through f.
+func newFaultySim(t *testing.T, f *transport.Faults) (*Fkmd, *krikzz_fkmd_sim.Flashkit) {
+	s := krikzz_fkmd_sim.New(krikzz_fkmd_sim.SampleROM(0x20000, "TEST ROM"), 0)
+	fd := &Fkmd{}
+	fd.SetOpener(transport.Inject(s.Open, f))
+	if err := fd.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	return fd, s
+}
+
+func TestGetIDShortRead(t *testing.T) {
+	fd, _ := newFaultySim(t, &transport.Faults{Faults: []transport.Fault{
+		{Kind: transport.FAULT_TRUNCATE, Offset: 1},
+	}})
+	if _, err := fd.GetID(); err == nil || !strings.Contains(err.Error(), "short read") {
+		t.Errorf("GetID with 1 byte reply: got %v, want short read", err)
+	}
+}
+
+func TestGetIDTimeout(t *testing.T) {
+	fd, _ := newFaultySim(t, &transport.Faults{Faults: []transport.Fault{
+		{Kind: transport.FAULT_DROP, Offset: -1, Probability: 1},
+	}})
+	if _, err := fd.GetID(); err != io.EOF {
+		t.Errorf("GetID with no reply: got %v, want EOF", err)
+	}
+}
+
+func TestReadDelayed(t *testing.T) {
+	f := &transport.Faults{Faults: []transport.Fault{
+		{Kind: transport.FAULT_DELAY, Offset: 0x101},
+		{Kind: transport.FAULT_DELAY, Offset: 0x1000},
+	}}
+	fd, s := newFaultySim(t, f)
+	b := make([]byte, 0x2000)
+	if n, err := fd.Read(b); n != len(b) || err != nil {
+		t.Fatalf("Read with delays: got %#x bytes, %v", n, err)
+	}
+	if !bytes.Equal(b, s.ROM[:len(b)]) {
+		t.Error("Read with delays returned wrong data")
+	}
+	if f.Injected != 2 {
+		t.Errorf("Injected: got %d faults, want 2", f.Injected)
+	}
+}
+
+func TestReadTruncated(t *testing.T) {
+	fd, _ := newFaultySim(t, &transport.Faults{Faults: []transport.Fault{
+		{Kind: transport.FAULT_TRUNCATE, Offset: 0x10},
+	}})
+	b := make([]byte, 0x100)
+	if n, err := fd.Read(b); err == nil || n != 0x10 {
+		t.Errorf("Read truncated at 0x10: got %#x bytes, %v, want 0x10 bytes and an error", n, err)
+	}
+}
+
+func TestWriteTruncated(t *testing.T) {
+	// the 5 command bytes go first, then the data
+	fd, _ := newFaultySim(t, &transport.Faults{Faults: []transport.Fault{
+		{Kind: transport.FAULT_TRUNCATE, Write: true, Offset: 5 + 0x10},
+	}})
+	if n, err := fd.Write(make([]byte, 0x100)); err != io.ErrShortWrite || n != 0x10 {
+		t.Errorf("Write truncated at 0x10: got %#x bytes, %v, want 0x10 bytes and %v", n, err, io.ErrShortWrite)
+	}
+}
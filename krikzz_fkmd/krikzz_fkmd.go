@@ -3,7 +3,10 @@ package krikzz_fkmd
 import (
 	"errors"
 	"fmt"
+	"github.com/grantek/fkmd/flashchip"
+	"github.com/grantek/fkmd/mdcart"
 	"github.com/grantek/fkmd/memcart"
+	"github.com/grantek/fkmd/transport"
 	"github.com/jacobsa/go-serial/serial"
 	"io"
 )
@@ -23,12 +26,16 @@ const (
 	WRITE_BLOCK_SIZE int = 65536
 	READ_BLOCK_SIZE  int = 65536
 
-	RAM_ADDR int64 = 0x20000
+	RAM_ADDR int64 = 0x200000
 )
 
+// ErrNoFlash is returned by FlashID when the cart doesn't answer autoselect.
+var ErrNoFlash = mdcart.ErrNoFlash
+
 type Fkmd struct {
-	fd  io.ReadWriteCloser
-	opt serial.OpenOptions
+	fd   io.ReadWriteCloser
+	opt  serial.OpenOptions
+	open transport.Opener
 }
 
 //func New() *Fkmd {
@@ -40,6 +47,18 @@ func (d *Fkmd) SetOptions(options serial.OpenOptions) {
 	d.opt = options
 }
 
+//Use o to open the device instead of serial.Open
+func (d *Fkmd) SetOpener(o transport.Opener) {
+	d.open = o
+}
+
+func (d *Fkmd) opener() transport.Opener {
+	if d.open == nil {
+		return transport.Serial
+	}
+	return d.open
+}
+
 //Perform initialisation and return a MemCart
 func (d *Fkmd) MemCart() (memcart.MemCart, error) {
 	var mdc MDCart
@@ -59,7 +78,7 @@ func (d *Fkmd) MemCart() (memcart.MemCart, error) {
 
 //Just open the serial device for low-level debugging
 func (d *Fkmd) Connect() error {
-	f, err := serial.Open(d.opt)
+	f, err := d.opener()(d.opt)
 	d.fd = f
 	return err
 }
@@ -79,7 +98,7 @@ func (d *Fkmd) Handshake() error {
 		//port.WriteTimeout = 2000;
 		//port.ReadTimeout = 2000;
 		d.opt.InterCharacterTimeout = 2000
-		f, err := serial.Open(d.opt)
+		f, err := d.opener()(d.opt)
 		if err != nil {
 			return err
 		}
@@ -99,10 +118,12 @@ func (d *Fkmd) Handshake() error {
 func (d *Fkmd) MDCart() (MDCart, error) {
 	var mdc MDCart
 	mdc.d = d
-	if d.RamAvailable() {
+	mdc.ram, mdc.ramNote = d.RamLayout()
+	if mdc.ram.Size > 0 {
 		mdc.ramAvailable = true
 		var mdram MDRAM
-		mdram.size = d.GetRamSize()
+		mdram.layout = mdc.ram
+		mdram.size = mdc.ram.Span(mdc.ram.Size)
 		mdram.d = d
 		mdc.ramBank = &mdram
 	} else {
@@ -272,7 +293,7 @@ func (d *Fkmd) ReadWord(addr int64) (uint16, error) {
 
 // we can only write to the lower byte of a word-aligned address
 // since cartridge RAM is 8-bit
-func (d *Fkmd) WriteByte(addr int, data byte) (err error) {
+func (d *Fkmd) WriteByteAt(addr int, data byte) (err error) {
 	cmd := make([]byte, 8)
 	addr /= 2
 
@@ -346,7 +367,7 @@ func (d *Fkmd) Write(p []byte) (n int, err error) {
 // Erase 64KiB from addr (32K words)
 func (d *Fkmd) FlashErase(addr int64) error {
 	if addr%int64(WRITE_BLOCK_SIZE) > 0 {
-		return errors.New(fmt.Sprintf("Flash erase request is not aligned to a %iKiB block", WRITE_BLOCK_SIZE/1024))
+		return errors.New(fmt.Sprintf("Flash erase request is not aligned to a %dKiB block", WRITE_BLOCK_SIZE/1024))
 	}
 	cmd := make([]byte, 8*8)
 	addr /= 2
@@ -377,6 +398,21 @@ func (d *Fkmd) FlashErase(addr int64) error {
 	return err
 }
 
+// Erase the sector holding addr, see mdcart.FlashEraseSector
+func (d *Fkmd) FlashEraseSector(addr int64) error {
+	return mdcart.FlashEraseSector(d, addr)
+}
+
+// FlashID reads the flash chip's IDs, see mdcart.FlashID.
+func (d *Fkmd) FlashID() (manufacturer byte, device uint16, err error) {
+	return mdcart.FlashID(d)
+}
+
+// FlashChip identifies the flash chip, see mdcart.FlashChip.
+func (d *Fkmd) FlashChip() (*flashchip.Chip, error) {
+	return mdcart.FlashChip(d)
+}
+
 func (d *Fkmd) FlashRY() error {
 	cmd := make([]byte, 2)
 	buf := make([]byte, 2)
@@ -390,15 +426,15 @@ func (d *Fkmd) FlashRY() error {
 }
 
 func (d *Fkmd) FlashUnlockBypass() {
-	d.WriteByte(0x555*2, 0xaa)
-	d.WriteByte(0x2aa*2, 0x55)
-	d.WriteByte(0x555*2, 0x20)
+	d.WriteByteAt(0x555*2, 0xaa)
+	d.WriteByteAt(0x2aa*2, 0x55)
+	d.WriteByteAt(0x555*2, 0x20)
 }
 
 func (d *Fkmd) FlashResetBypass() {
 	d.WriteWord(0, 0xf0)
-	d.WriteByte(0, 0x90)
-	d.WriteByte(0, 0x00)
+	d.WriteByteAt(0, 0x90)
+	d.WriteByteAt(0, 0x00)
 }
 
 // expected use is to perform full erase, seek to 0, then run this with chunks of data until complete
@@ -450,6 +486,8 @@ type MDROM struct {
 	d          *Fkmd
 	addressCur int64
 	size       int64
+	chip       *flashchip.Chip //identified by FlashChip or the first Write
+	bypass     bool            //in unlock bypass for writing
 }
 
 func (m *MDROM) Read(p []byte) (n int, err error) {
@@ -471,7 +509,7 @@ func (m *MDROM) Seek(offset int64, whence int) (newoffset int64, err error) {
 		offset += m.addressCur
 	case io.SeekEnd:
 		if offset > m.size {
-			return m.size - m.addressCur - 1, errors.New(fmt.Sprintf("Trying to seek %i from io.SeekEnd of ROM with detected length %i", offset, m.size))
+			return m.size - m.addressCur - 1, errors.New(fmt.Sprintf("Trying to seek %d from io.SeekEnd of ROM with detected length %d", offset, m.size))
 		}
 		offset = m.size - offset
 	}
@@ -481,41 +519,81 @@ func (m *MDROM) Seek(offset int64, whence int) (newoffset int64, err error) {
 	return
 }
 
-//should allow incremental writing, erasing pages as they're reached?
-//if not on a page boundary, assume the rest of the page has been erased
+//erases sectors as they're reached, sized from the identified flash chip,
+//or 64KiB if no chip answers autoselect
+//if not on a sector boundary, assume the rest of the sector has been erased
 func (m *MDROM) Write(p []byte) (n int, err error) {
 	var (
 		writelen  int
 		chunksize int
 	)
+	if !m.bypass {
+		if _, err = m.FlashChip(); err != nil {
+			return 0, err
+		}
+		if m.chip.Known() && m.chip.Commands != flashchip.AMD {
+			return 0, errors.New(fmt.Sprintf("Flash chip %v uses the %v command set, only AMD is supported", m.chip, m.chip.Commands))
+		}
+		m.d.FlashUnlockBypass()
+		m.bypass = true
+		if _, err = m.d.Seek(m.addressCur, io.SeekStart); err != nil {
+			return 0, err
+		}
+	}
 	writelen = len(p)
+	if m.chip.Known() && m.addressCur+int64(writelen) > int64(m.chip.Size) {
+		return 0, errors.New(fmt.Sprintf("Writing %d bytes at 0x%X runs past the end of flash chip %v", writelen, m.addressCur, m.chip))
+	}
 	for n < writelen {
 		chunksize = writelen - n
-		if chunksize > int(WRITE_BLOCK_SIZE) {
-			chunksize = int(WRITE_BLOCK_SIZE)
+		sector := m.chip.SectorAt(int(m.addressCur))
+		//don't run past the next sector boundary, it needs erasing first
+		if sectorleft := sector.Addr + sector.Size - int(m.addressCur); chunksize > sectorleft {
+			chunksize = sectorleft
 		}
-		if m.addressCur%int64(WRITE_BLOCK_SIZE) == 0 {
+		if int64(sector.Addr) == m.addressCur {
 			//fmt.Printf("Debug: erasing at %d\n", m.addressCur)
 			m.d.FlashResetBypass()
-			m.d.FlashErase(m.addressCur)
+			if m.chip.Known() {
+				err = m.d.FlashEraseSector(m.addressCur)
+			} else {
+				err = m.d.FlashErase(m.addressCur)
+			}
+			if err != nil {
+				return n, fmt.Errorf("erasing flash at 0x%X: %v", m.addressCur, err)
+			}
 			m.d.FlashUnlockBypass()
-			m.d.Seek(m.addressCur, io.SeekStart)
+			if _, err = m.d.Seek(m.addressCur, io.SeekStart); err != nil {
+				return n, err
+			}
 		}
-		//chunksize = chunksize - int(m.addressCur%WRITE_BLOCK_SIZE)
 		//fmt.Printf("Debug:FlashWrite p[%d : %d]\n", n, n+chunksize)
-		err = m.d.FlashWrite(p[n : n+chunksize])
-
-		if err == nil {
-			n += chunksize
-			m.addressCur += int64(n)
-		} else {
-			panic(err)
+		if err = m.d.FlashWrite(p[n : n+chunksize]); err != nil {
+			return n, fmt.Errorf("writing flash at 0x%X: %v", m.addressCur, err)
 		}
+		n += chunksize
+		m.addressCur += int64(chunksize)
 	}
 
 	return
 }
 
+// FlashChip identifies the flash chip the ROM is on, once, for sizing
+// erases. A cart that doesn't answer autoselect gets a Chip with no IDs,
+// which Write erases in 64KiB blocks; other errors are returned.
+func (m *MDROM) FlashChip() (*flashchip.Chip, error) {
+	if m.chip == nil {
+		chip, err := m.d.FlashChip()
+		if err == ErrNoFlash {
+			chip = &flashchip.Chip{}
+		} else if err != nil {
+			return nil, fmt.Errorf("identifying flash chip: %v", err)
+		}
+		m.chip = chip
+	}
+	return m.chip, nil
+}
+
 func (m *MDROM) Name() string {
 	return "mdrom"
 }
@@ -529,10 +607,13 @@ func (m *MDROM) AlwaysWritable() bool {
 }
 
 ///////////////mdram (MemBank)
+// MDRAM reads and writes save RAM as it is on the bus, a word at a time: for
+// 8-bit RAM every other byte is RAM, so its Size is twice the RAM's.
 type MDRAM struct {
-	d          *Fkmd //attached device
-	addressCur int64 //current address pointer
-	size       int64 //size in bytes
+	d          *Fkmd            //attached device
+	layout     mdcart.RAMLayout //where the RAM is and which bytes it's on
+	addressCur int64            //current address pointer, from layout.Addr
+	size       int64            //size in bytes of bus, layout.Span(layout.Size)
 }
 
 func (m *MDRAM) Read(p []byte) (n int, err error) {
@@ -552,11 +633,11 @@ func (m *MDRAM) Read(p []byte) (n int, err error) {
 
 func (m *MDRAM) Write(p []byte) (n int, err error) {
 	writelen := len(p)
-	if m.addressCur+int64(n) > m.size {
+	if m.addressCur+int64(writelen) > m.size {
 		writelen = int(m.size - m.addressCur)
 	}
 	if writelen > 0 {
-		n, err = m.d.Write(p)
+		n, err = m.d.Write(p[:writelen])
 		m.addressCur += int64(n)
 	}
 	return
@@ -568,12 +649,13 @@ func (m *MDRAM) Seek(offset int64, whence int) (newoffset int64, err error) {
 		offset += m.addressCur
 	case io.SeekEnd:
 		if offset > m.size {
-			return m.size - m.addressCur - 1, errors.New(fmt.Sprintf("Trying to seek %i from io.SeekEnd of RAM with detected length %i", offset, m.size))
+			return m.size - m.addressCur - 1, errors.New(fmt.Sprintf("Trying to seek %d from io.SeekEnd of RAM with detected length %d", offset, m.size))
 		}
 		offset = m.size - offset
 	}
 
-	newoffset, err = m.d.Seek(offset+RAM_ADDR, io.SeekStart)
+	newoffset, err = m.d.Seek(offset+m.layout.Addr, io.SeekStart)
+	newoffset -= m.layout.Addr
 	m.addressCur = newoffset
 	return
 }
@@ -594,6 +676,8 @@ func (m *MDRAM) AlwaysWritable() bool {
 type MDCart struct {
 	d            *Fkmd
 	ramAvailable bool
+	ram          mdcart.RAMLayout
+	ramNote      string
 	currentBank  memcart.MemBank
 	romBank      memcart.MemBank
 	ramBank      memcart.MemBank
@@ -605,7 +689,13 @@ func (mdc *MDCart) NumBanks() int {
 	} else {
 		return 1
 	}
-	return 0
+}
+
+// RamLayout returns the layout of the cart's save RAM found when mdc was
+// built, and how the header and the probe disagreed about it, "" if they
+// didn't.
+func (mdc *MDCart) RamLayout() (mdcart.RAMLayout, string) {
+	return mdc.ram, mdc.ramNote
 }
 
 func (mdc *MDCart) CurrentBank() memcart.MemBank {
@@ -635,7 +725,7 @@ func (mdc *MDCart) SwitchBank(reqbank int) error {
 		mdc.currentBank.Seek(0, io.SeekStart)
 		return nil
 	}
-	return errors.New(fmt.Sprintf("Bank %i out of range 0-1", reqbank))
+	return errors.New(fmt.Sprintf("Bank %d out of range 0-1", reqbank))
 }
 
 ///////////////from cart.go
@@ -797,69 +887,21 @@ NameLoop:
 }
 
 func (d *Fkmd) RamAvailable() bool {
-	var (
-		first_word uint16
-		tmp        uint16
-		err        error
-	)
-
 	d.RamEnable()
-	first_word, err = d.ReadWord(RAM_ADDR)
-	d.WriteWord(RAM_ADDR, uint16(first_word^0xffff))
-	tmp, err = d.ReadWord(RAM_ADDR)
-	if err != nil {
-		panic(err)
-	}
-	d.WriteWord(RAM_ADDR, first_word)
-	tmp ^= 0xffff
-	if (first_word & 0x00ff) != (tmp & 0x00ff) { //Save RAM is 8-bit so we don't care what the second byte of the word is
-		return false
-	}
+	return mdcart.RamAvailableAt(d, RAM_ADDR, 0x00ff)
+}
 
-	return true
+// RamLayout returns where the cart's save RAM is and how it's wired, see
+// mdcart.RamLayout. It leaves RAM enabled.
+func (d *Fkmd) RamLayout() (mdcart.RAMLayout, string) {
+	return mdcart.RamLayout(d)
 }
 
+// GetRamSize returns the size of the cart's save RAM in bytes, 0 if it has
+// none. See RamLayout.
 func (d *Fkmd) GetRamSize() int64 {
-	var (
-		ram_size       int64
-		first_word     uint16
-		first_word_tmp uint16
-		tmp            uint16
-		tmp2           uint16
-		ram_type       uint16 = 0x00ff
-		err            error
-	)
-
-	//This commented-out write was in the original code
-	//Device.writeWord(0xA13000, 0x0001); //RamDisable()
-
-	if d.RamAvailable() == false { //RAM is banskswitched in here?
-		return 0
-	}
-
-	first_word, err = d.ReadWord(RAM_ADDR)
-
-	for ram_size = 256; ram_size < 0x100000; ram_size *= 2 {
-		tmp, err = d.ReadWord(RAM_ADDR + ram_size)
-		d.WriteWord(RAM_ADDR+ram_size, tmp^0xffff)
-		tmp2, err = d.ReadWord(RAM_ADDR + ram_size)
-		first_word_tmp, err = d.ReadWord(RAM_ADDR)
-		if err != nil {
-			panic(err)
-		}
-		d.WriteWord(RAM_ADDR+ram_size, tmp)
-		tmp2 ^= 0xffff
-		if (tmp & 0xff) != (tmp2 & 0xff) {
-			break
-		}
-		if (first_word & ram_type) != (first_word_tmp & ram_type) {
-			break
-		}
-	}
-
-	//Save RAM is 8-bit on a 16-bit system, this returns the real size in bytes
-	return ram_size / 2
-
+	l, _ := d.RamLayout()
+	return l.Size
 }
 
 func checkRomSize(d *Fkmd, base_addr int64, max_len int64) int64 {
@@ -1,12 +1,19 @@
 package krikzz_fkmd
 
 import (
+	"bytes"
+	"encoding/binary"
 	"encoding/hex"
 	//    "errors"
 	"flag"
 	"fmt"
+	"github.com/grantek/fkmd/flashchip"
+	"github.com/grantek/fkmd/krikzz_fkmd_sim"
+	"github.com/grantek/fkmd/mdcart"
+	"github.com/grantek/fkmd/memcart"
 	"github.com/jacobsa/go-serial/serial"
 	"io"
+	"io/ioutil"
 	"os"
 	"testing"
 )
@@ -14,6 +21,7 @@ import (
 var d *Fkmd
 var mf *os.File
 var d_len int64
+var sim *krikzz_fkmd_sim.Flashkit
 
 func CompReadWord(t *testing.T, addr int64) {
 	var (
@@ -40,7 +48,7 @@ func CompReadWord(t *testing.T, addr int64) {
 	file_word |= uint16(file_word_bytes[1])
 
 	if file_word != device_word {
-		t.Log("expected %x, device returned %x", file_word, device_word)
+		t.Logf("expected %x, device returned %x", file_word, device_word)
 		t.Fail()
 	}
 }
@@ -79,7 +87,7 @@ func usage() {
 
 func setup(m *testing.M) int {
 	port := flag.String("port", "/dev/ttyUSB0", "serial port to use (/dev/ttyUSB0, etc)")
-	testfile := flag.String("testfile", "", "expected ROM dump from device")
+	testfile := flag.String("testfile", "", "expected ROM dump from device (default: use simulated device)")
 	baud := new(uint)
 	*baud = 9600
 	//even := new(bool); *even = false
@@ -108,8 +116,7 @@ func setup(m *testing.M) int {
 	}
 
 	if *testfile == "" {
-		fmt.Println("Must specify port")
-		usage()
+		return setupSim(m)
 	}
 
 	options := serial.OpenOptions{
@@ -125,7 +132,7 @@ func setup(m *testing.M) int {
 		Rs485RtsHighAfterSend:  *rs485HighAfterSend,
 	}
 
-	d = New()
+	d = &Fkmd{}
 	d.SetOptions(options)
 	err := d.Connect()
 
@@ -148,6 +155,45 @@ func setup(m *testing.M) int {
 	return m.Run()
 }
 
+// setupSim runs the tests against a simulated Flashkit, with the ROM image
+// saved to a temporary file for comparison.
+func setupSim(m *testing.M) int {
+	var err error
+	sim = krikzz_fkmd_sim.New(krikzz_fkmd_sim.SampleROM(0x80000, "TEST ROM"), 0x2000)
+	d = &Fkmd{}
+	d.SetOpener(sim.Open)
+	if err = d.Connect(); err != nil {
+		fmt.Println("Error opening simulated device: ", err)
+		return -1
+	}
+	if err = d.Handshake(); err != nil {
+		fmt.Println("Error in handshake with simulated device: ", err)
+		return -1
+	}
+	defer d.Disconnect()
+
+	mf, err = ioutil.TempFile("", "krikzz_fkmd_test")
+	if err != nil {
+		fmt.Println("Error creating test file: ", err)
+		return -1
+	}
+	defer os.Remove(mf.Name())
+	defer mf.Close()
+	if _, err = mf.Write(sim.ROM); err != nil {
+		fmt.Println("Error writing test file: ", err)
+		return -1
+	}
+
+	return m.Run()
+}
+
+// newSim returns a Fkmd attached to its own simulated device, for tests that
+// need a particular cartridge.
+func newSim(romsize, ramsize int) (*Fkmd, *krikzz_fkmd_sim.Flashkit) {
+	s := krikzz_fkmd_sim.New(krikzz_fkmd_sim.SampleROM(romsize, "TEST ROM"), ramsize)
+	return &Fkmd{fd: s}, s
+}
+
 func TestMain(m *testing.M) {
 	os.Exit(setup(m))
 }
@@ -224,3 +270,434 @@ func TestFullRead(t *testing.T) {
 	t.Log("Read and matched", romlen, "bytes")
 
 }
+
+func TestGetRomSize(t *testing.T) {
+	sizes := []int{0x20000, 0x80000, 0x100000, 0x200000, 0x300000, 0x400000}
+	for _, ramsize := range []int{0, 0x2000} {
+		for _, romsize := range sizes {
+			sd, _ := newSim(romsize, ramsize)
+			if got := sd.GetRomSize(); got != int64(romsize) {
+				t.Errorf("GetRomSize with %d bytes RAM: got %#x, want %#x", ramsize, got, romsize)
+			}
+		}
+	}
+}
+
+func TestGetRamSize(t *testing.T) {
+	for _, ramsize := range []int{0, 0x800, 0x2000, 0x8000} {
+		sd, s := newSim(0x80000, ramsize)
+		copy(s.RAM, s.ROM)
+		want := append([]byte{}, s.RAM...)
+		if got := sd.GetRamSize(); got != int64(ramsize) {
+			t.Errorf("GetRamSize: got %#x, want %#x", got, ramsize)
+		}
+		for i, v := range want {
+			if s.RAM[i] != v {
+				t.Fatalf("GetRamSize changed RAM contents at %#x: got %#x, want %#x", i, s.RAM[i], v)
+			}
+		}
+	}
+}
+
+// setSRAM writes an "RA" block into the header of rom.
+func setSRAM(rom []byte, typ, kind byte, start, end uint32) {
+	copy(rom[0x1b0:], []byte{'R', 'A', typ, kind})
+	binary.BigEndian.PutUint32(rom[0x1b4:], start)
+	binary.BigEndian.PutUint32(rom[0x1b8:], end)
+}
+
+func TestRamLayout(t *testing.T) {
+	tests := []struct {
+		name       string
+		typ, kind  byte
+		start, end uint32
+		ramsize    int
+		addr       int64
+		lanes      uint16
+		width      byte
+		size       int64
+		note       bool
+	}{
+		{"no header", 0, 0, 0, 0, 0x2000, 0, 0, mdcart.SRAM_ODD, 0x2000, true},
+		{"none", 0, 0, 0, 0, 0, 0, 0, mdcart.SRAM_ODD, 0, false},
+		{"odd", 0xf8, 0x20, 0x200001, 0x203fff, 0x2000, 0, 0, mdcart.SRAM_ODD, 0x2000, false},
+		{"even", 0xf0, 0x20, 0x200000, 0x207ffe, 0x4000, 0, 0xff00, mdcart.SRAM_EVEN, 0x4000, false},
+		{"16-bit", 0xe0, 0x20, 0x200000, 0x207fff, 0x8000, 0, 0xffff, mdcart.SRAM_BOTH, 0x8000, false},
+		{"high", 0xf8, 0x20, 0x300001, 0x303fff, 0x2000, 0x300000, 0, mdcart.SRAM_ODD, 0x2000, false},
+		{"aliased", 0xf8, 0x20, 0x200001, 0x20ffff, 0x2000, 0, 0, mdcart.SRAM_ODD, 0x2000, true},
+		{"missing", 0xf8, 0x20, 0x200001, 0x203fff, 0, 0, 0, mdcart.SRAM_ODD, 0, true},
+		{"eeprom", 0xe8, 0x40, 0x200001, 0x200001, 0, 0, 0, mdcart.SRAM_ODD, 0, true},
+	}
+	for _, tt := range tests {
+		sd, s := newSim(0x80000, tt.ramsize)
+		if tt.typ != 0 {
+			setSRAM(s.ROM, tt.typ, tt.kind, tt.start, tt.end)
+		}
+		s.RAMAddr = tt.addr
+		s.RAMLanes = tt.lanes
+		copy(s.RAM, s.ROM[0x1000:])
+		ram := append([]byte{}, s.RAM...)
+
+		want := mdcart.RAMLayout{Addr: mdcart.RAM_ADDR, Width: tt.width, Size: tt.size}
+		if tt.addr != 0 {
+			want.Addr = tt.addr
+		}
+		l, note := sd.RamLayout()
+		if l != want || (note != "") != tt.note {
+			t.Errorf("%s: got %+v, %q, want %+v", tt.name, l, note, want)
+		}
+		for i, v := range ram {
+			if s.RAM[i] != v {
+				t.Fatalf("%s: RamLayout changed RAM contents at %#x: got %#x, want %#x", tt.name, i, s.RAM[i], v)
+			}
+		}
+		if tt.ramsize == 0 {
+			continue
+		}
+
+		mdc, err := sd.MDCart()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = mdc.SwitchBank(1); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		buf := make([]byte, 4)
+		if _, err = mdc.CurrentBank().Read(buf); err != nil {
+			t.Fatal(err)
+		}
+		if w := s.ReadWord(l.Addr); binary.BigEndian.Uint16(buf) != w {
+			t.Errorf("%s: RAM bank read %x, want %04x", tt.name, buf[:2], w)
+		}
+	}
+}
+
+func TestMDCart(t *testing.T) {
+	sd, s := newSim(0x40000, 0x2000)
+	copy(s.RAM, s.ROM[0x1000:])
+	mdc, err := sd.MDCart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mdc.NumBanks() != 2 {
+		t.Fatalf("NumBanks: got %d, want 2", mdc.NumBanks())
+	}
+
+	rom := mdc.CurrentBank()
+	if rom.Size() != int64(len(s.ROM)) {
+		t.Errorf("ROM Size: got %#x, want %#x", rom.Size(), len(s.ROM))
+	}
+	buf := make([]byte, rom.Size())
+	if _, err = rom.Read(buf); err != nil {
+		t.Fatal(err)
+	}
+	for i, v := range s.ROM {
+		if buf[i] != v {
+			t.Fatalf("ROM mismatch at %#x: read %#x, want %#x", i, buf[i], v)
+		}
+	}
+
+	if err = mdc.SwitchBank(1); err != nil {
+		t.Fatal(err)
+	}
+	ram := mdc.CurrentBank()
+	if ram.Size() != int64(2*len(s.RAM)) {
+		t.Errorf("RAM Size: got %#x, want %#x", ram.Size(), 2*len(s.RAM))
+	}
+	buf = make([]byte, 2*len(s.RAM))
+	if _, err = ram.Read(buf); err != nil {
+		t.Fatal(err)
+	}
+	for i, v := range s.RAM {
+		if buf[2*i+1] != v {
+			t.Fatalf("RAM mismatch at %#x: read %#x, want %#x", i, buf[2*i+1], v)
+		}
+	}
+}
+
+// TestMDRAMSave round-trips a whole 8KiB save on the odd bytes through the
+// RAM bank, as sfmd -readram and -writeram do.
+func TestMDRAMSave(t *testing.T) {
+	sd, s := newSim(0x40000, 0x2000)
+	setSRAM(s.ROM, 0xf8, 0x20, 0x200001, 0x203fff)
+	copy(s.RAM, s.ROM[0x1000:])
+	mdc, err := sd.MDCart()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	n, err := memcart.ReadBank(&mdc, 1, &buf, 0x2000)
+	if err != nil || n != 0x4000 {
+		t.Fatalf("ReadBank: read %#x bytes, %v, want 0x4000", n, err)
+	}
+	save := buf.Bytes()
+	for i, v := range s.RAM {
+		if save[2*i+1] != v {
+			t.Fatalf("save mismatch at RAM byte %#x: got %#x, want %#x", i, save[2*i+1], v)
+		}
+	}
+
+	for i := range save {
+		save[i] ^= 0xa5
+	}
+	if w, err := memcart.WriteBank(&mdc, 1, save); err != nil || w != len(save) {
+		t.Fatalf("WriteBank: wrote %#x bytes, %v, want %#x", w, err, len(save))
+	}
+	for i, v := range s.RAM {
+		if v != save[2*i+1] {
+			t.Fatalf("RAM mismatch at %#x: got %#x, want %#x", i, v, save[2*i+1])
+		}
+	}
+	buf.Reset()
+	if _, err = memcart.ReadBank(&mdc, 1, &buf, 0x2000); err != nil {
+		t.Fatal(err)
+	}
+	for i, v := range buf.Bytes() {
+		if i%2 == 1 && v != save[i] {
+			t.Fatalf("read back mismatch at %#x: got %#x, want %#x", i, v, save[i])
+		}
+	}
+}
+
+func TestMDROMWrite(t *testing.T) {
+	// write the same image in 4KiB blocks as sfmd does, and in one call
+	for _, blocklen := range []int{0x1000, 0x30000} {
+		s := krikzz_fkmd_sim.NewFlash(krikzz_fkmd_sim.SampleROM(0x40000, "OLD ROM"), 0)
+		sd := &Fkmd{fd: s}
+		image := krikzz_fkmd_sim.SampleROM(0x30000, "NEW ROM")
+		for i := range image[0x200:] {
+			image[0x200+i] ^= 0x5a
+		}
+
+		mdc, err := sd.MDCart()
+		if err != nil {
+			t.Fatal(err)
+		}
+		rom := mdc.CurrentBank()
+		for i := 0; i < len(image); i += blocklen {
+			n, err := rom.Write(image[i : i+blocklen])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != blocklen {
+				t.Fatalf("Write: wrote %d bytes, want %d", n, blocklen)
+			}
+		}
+
+		if s.Flash.SectorErases != 3 {
+			t.Errorf("blocklen %#x: erased %d sectors, want 3", blocklen, s.Flash.SectorErases)
+		}
+		if s.Flash.FailedBits != 0 {
+			t.Errorf("blocklen %#x: %d bits programmed without an erase", blocklen, s.Flash.FailedBits)
+		}
+		for i, v := range image {
+			if s.ROM[i] != v {
+				t.Fatalf("blocklen %#x: flash mismatch at %#x: got %#x, want %#x", blocklen, i, s.ROM[i], v)
+			}
+		}
+
+		buf := make([]byte, len(image))
+		rom.Seek(0, io.SeekStart)
+		if _, err = rom.Read(buf); err != nil {
+			t.Fatal(err)
+		}
+		for i, v := range image {
+			if buf[i] != v {
+				t.Fatalf("blocklen %#x: verify mismatch at %#x: read %#x, want %#x", blocklen, i, buf[i], v)
+			}
+		}
+	}
+}
+
+func TestFlashChip(t *testing.T) {
+	s := krikzz_fkmd_sim.New(krikzz_fkmd_sim.SampleROM(0x20000, "TEST ROM"), 0)
+	sd := &Fkmd{fd: s}
+	if _, err := sd.FlashChip(); err != ErrNoFlash {
+		t.Errorf("FlashChip on mask ROM: got error %v, want ErrNoFlash", err)
+	}
+
+	s = krikzz_fkmd_sim.NewFlash(krikzz_fkmd_sim.SampleROM(0x20000, "TEST ROM"), 0)
+	sd = &Fkmd{fd: s}
+	chip, err := sd.FlashChip()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chip.Known() || chip.Device != krikzz_fkmd_sim.DEFAULT_DEVICE_ID {
+		t.Errorf("FlashChip: got %v, want unknown device %#x", chip, krikzz_fkmd_sim.DEFAULT_DEVICE_ID)
+	}
+	if w, _ := sd.ReadWord(0); w != uint16(s.ROM[0])<<8|uint16(s.ROM[1]) {
+		t.Errorf("FlashChip left the chip in autoselect, word 0 reads %#x", w)
+	}
+}
+
+// TestFlashChipIntel identifies an Intel chip, which has to be put back in
+// read array mode with 0xFF rather than 0xF0.
+func TestFlashChipIntel(t *testing.T) {
+	want := flashchip.Lookup(0x89, 0x0016) // 28F320J3
+	s := krikzz_fkmd_sim.NewFlash(krikzz_fkmd_sim.SampleROM(0x20000, "TEST ROM"), 0)
+	s.Flash = krikzz_fkmd_sim.NewFlashChipFor(want)
+	sd := &Fkmd{fd: s}
+	chip, err := sd.FlashChip()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chip.Name != want.Name {
+		t.Errorf("FlashChip: got %v, want %v", chip, want)
+	}
+	if w, _ := sd.ReadWord(0); w != uint16(s.ROM[0])<<8|uint16(s.ROM[1]) {
+		t.Errorf("FlashChip left the chip reading IDs, word 0 reads %#x", w)
+	}
+}
+
+// TestMDROMWriteBootSectors writes over the small sectors of a bottom boot
+// chip, which have to be erased one by one.
+func TestMDROMWriteBootSectors(t *testing.T) {
+	want := flashchip.Lookup(0xc2, 0x22a8) // MX29LV320EB
+	s := krikzz_fkmd_sim.NewFlash(krikzz_fkmd_sim.SampleROM(0x40000, "OLD ROM"), 0)
+	s.Flash = krikzz_fkmd_sim.NewFlashChipFor(want)
+	sd := &Fkmd{fd: s}
+	image := krikzz_fkmd_sim.SampleROM(0x30000, "NEW ROM")
+	for i := range image[0x200:] {
+		image[0x200+i] ^= 0x5a
+	}
+
+	mdc, err := sd.MDCart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rom := mdc.CurrentBank()
+	for i := 0; i < len(image); i += 0x1000 {
+		if _, err := rom.Write(image[i : i+0x1000]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := rom.(*MDROM).chip; got.Name != want.Name {
+		t.Errorf("identified %v, want %v", got, want)
+	}
+	// 8 8KiB sectors, then 2 64KiB
+	if s.Flash.SectorErases != 10 {
+		t.Errorf("erased %d sectors, want 10", s.Flash.SectorErases)
+	}
+	if s.Flash.FailedBits != 0 {
+		t.Errorf("%d bits programmed without an erase", s.Flash.FailedBits)
+	}
+	for i, v := range image {
+		if s.ROM[i] != v {
+			t.Fatalf("flash mismatch at %#x: got %#x, want %#x", i, s.ROM[i], v)
+		}
+	}
+}
+
+func TestMDROMWriteErrors(t *testing.T) {
+	chip := flashchip.Lookup(0xc2, 0x22a8) // MX29LV320EB
+	s := krikzz_fkmd_sim.NewFlash(krikzz_fkmd_sim.SampleROM(0x40000, "OLD ROM"), 0)
+	s.Flash = krikzz_fkmd_sim.NewFlashChipFor(chip)
+	sd := &Fkmd{fd: s}
+	mdc, err := sd.MDCart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rom := mdc.CurrentBank()
+	rom.Seek(int64(chip.Size-0x1000), io.SeekStart)
+	if n, err := rom.Write(make([]byte, 0x2000)); err == nil || n != 0 {
+		t.Errorf("Write past the end of the chip: wrote %d bytes, error %v", n, err)
+	}
+	if s.Flash.SectorErases != 0 {
+		t.Errorf("Write past the end of the chip erased %d sectors", s.Flash.SectorErases)
+	}
+
+	// a serial error identifying the chip isn't taken as a chip that
+	// doesn't answer
+	s = krikzz_fkmd_sim.NewFlash(krikzz_fkmd_sim.SampleROM(0x40000, "OLD ROM"), 0)
+	sd = &Fkmd{fd: s}
+	if mdc, err = sd.MDCart(); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+	if _, err = mdc.CurrentBank().Write(make([]byte, 0x1000)); err == nil {
+		t.Error("Write on a closed device succeeded")
+	}
+}
+
+func TestFlashRY(t *testing.T) {
+	s := krikzz_fkmd_sim.NewFlash(krikzz_fkmd_sim.SampleROM(0x20000, "TEST ROM"), 0)
+	sd := &Fkmd{fd: s}
+
+	sd.FlashResetBypass()
+	sd.WriteWord(0x555*2, 0xaa)
+	sd.WriteWord(0x2aa*2, 0x55)
+	sd.WriteWord(0x555*2, 0x80)
+	sd.WriteWord(0x555*2, 0xaa)
+	sd.WriteWord(0x2aa*2, 0x55)
+	sd.WriteByteAt(0x10000, 0x30)
+	if !s.Flash.Busy() {
+		t.Fatal("flash not busy after sector erase")
+	}
+	first, _ := sd.ReadWord(0x10000)
+	second, _ := sd.ReadWord(0x10000)
+	if (first^second)&0x40 == 0 {
+		t.Errorf("DQ6 didn't toggle while busy: %#x, %#x", first, second)
+	}
+	if err := sd.FlashRY(); err != nil {
+		t.Fatal(err)
+	}
+	if s.Flash.Busy() {
+		t.Fatal("flash still busy after FlashRY")
+	}
+	if w, _ := sd.ReadWord(0x10000); w != 0xffff {
+		t.Errorf("erased sector reads %#x, want 0xffff", w)
+	}
+	if w, _ := sd.ReadWord(0); w == 0xffff {
+		t.Error("sector 0 was erased")
+	}
+}
+
+func TestHandshake(t *testing.T) {
+	s := krikzz_fkmd_sim.New(krikzz_fkmd_sim.SampleROM(0x20000, "TEST ROM"), 0)
+	s.Delay = 0xff
+	hd := &Fkmd{}
+	hd.SetOptions(serial.OpenOptions{PortName: "sim", InterCharacterTimeout: 200})
+	hd.SetOpener(s.Open)
+	if err := hd.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	if err := hd.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	if s.Opens != 2 {
+		t.Errorf("Handshake opened the device %d times, want 2", s.Opens)
+	}
+	if s.Options.InterCharacterTimeout != 2000 || s.Options.PortName != "sim" {
+		t.Errorf("Handshake reopened with %+v, want InterCharacterTimeout 2000", s.Options)
+	}
+	if s.Delay != 0 {
+		t.Errorf("Handshake left delay at %d, want 0", s.Delay)
+	}
+
+	s.ID = 0x0102
+	if err := hd.Handshake(); err == nil {
+		t.Error("Handshake accepted unknown device ID 0x0102")
+	}
+}
+
+func TestMemCart(t *testing.T) {
+	s := krikzz_fkmd_sim.New(krikzz_fkmd_sim.SampleROM(0x100000, "TEST ROM"), 0x8000)
+	md := &Fkmd{}
+	md.SetOpener(s.Open)
+	mdc, err := md.MemCart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer md.Disconnect()
+	if got := mdc.CurrentBank().Size(); got != 0x100000 {
+		t.Errorf("ROM Size: got %#x, want 0x100000", got)
+	}
+	if err = mdc.SwitchBank(1); err != nil {
+		t.Fatal(err)
+	}
+	// 32KiB of RAM on the odd bytes
+	if got := mdc.CurrentBank().Size(); got != 0x10000 {
+		t.Errorf("RAM Size: got %#x, want 0x10000", got)
+	}
+}
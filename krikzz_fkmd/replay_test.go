@@ -0,0 +1,76 @@
+package krikzz_fkmd
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/grantek/fkmd/krikzz_fkmd_sim"
+	"github.com/grantek/fkmd/mdcart"
+	"github.com/grantek/fkmd/transport"
+)
+
+// Transcripts in testdata are replayed through the same calls as sfmd
+// -rominfo, so a session recorded with sfmd -rominfo -record can be dropped in
+// as a new test.
+var update = flag.Bool("update", false, "rewrite testdata/sim_rominfo.txt from the simulator")
+
+// replayNames are the ROM names expected from transcripts in testdata.
+var replayNames = map[string]string{
+	"sim_rominfo.txt": "TEST ROM (W)",
+}
+
+func romInfoSession(o transport.Opener) (string, error) {
+	rd := &Fkmd{}
+	rd.SetOpener(o)
+	mdc, err := rd.MemCart()
+	if err != nil {
+		return "", err
+	}
+	defer rd.Disconnect()
+	return mdcart.GetRomName(mdc)
+}
+
+func TestReplay(t *testing.T) {
+	if *update {
+		f, err := os.Create(filepath.Join("testdata", "sim_rominfo.txt"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := krikzz_fkmd_sim.New(krikzz_fkmd_sim.SampleROM(0x20000, "TEST ROM"), 0x2000)
+		_, err = romInfoSession(transport.Record(s.Open, f))
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	files, err := filepath.Glob(filepath.Join("testdata", "*.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, fn := range files {
+		f, err := os.Open(fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p, err := transport.NewReplayer(f)
+		f.Close()
+		if err != nil {
+			t.Fatalf("%s: %v", fn, err)
+		}
+		name, err := romInfoSession(p.Open)
+		if err == nil {
+			err = p.Done()
+		}
+		if err != nil {
+			t.Errorf("%s: %v", fn, err)
+			continue
+		}
+		t.Logf("%s: %s", fn, name)
+		if want, ok := replayNames[filepath.Base(fn)]; ok && name != want {
+			t.Errorf("%s: got ROM name %q, want %q", fn, name, want)
+		}
+	}
+}
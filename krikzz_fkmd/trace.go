@@ -0,0 +1,200 @@
+package krikzz_fkmd
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/grantek/fkmd/transport"
+)
+
+const cmdMask byte = 0x0f
+
+// Addresses are shown as byte addresses, the device counts in words.
+type tracer struct {
+	in      []byte
+	addr    int64 // word address register
+	length  int   // word count register
+	pending []pendingRead
+}
+
+// pendingRead is a reply the device owes for a CMD_RD.
+type pendingRead struct {
+	desc string
+	size int
+	data []byte
+}
+
+// NewDecoder returns a transport.Decoder for the Flashkit command stream,
+// giving lines like "ADDR 0x100000, LEN 0x8000 words, RD INC".
+func NewDecoder() transport.Decoder {
+	return &tracer{}
+}
+
+func (t *tracer) Sent(b []byte) []string {
+	var lines, parts []string
+	for _, p := range t.pending {
+		lines = append(lines, fmt.Sprintf("%s: short, got %d of %d bytes", p.desc, len(p.data), p.size))
+	}
+	t.pending = nil
+
+	t.in = append(t.in, b...)
+	var reg string // ADDR or LEN being shifted in
+	for len(t.in) > 0 {
+		var this string
+		switch t.in[0] & cmdMask {
+		case CMD_ADDR:
+			this = "ADDR"
+		case CMD_LEN:
+			this = "LEN"
+		}
+		if reg != "" && reg != this {
+			parts = append(parts, t.register(reg))
+			reg = ""
+		}
+		n, s := t.command(t.in)
+		if n == 0 {
+			break
+		}
+		t.in = t.in[n:]
+		reg = this
+		if this == "" {
+			parts = append(parts, s)
+		}
+	}
+	if reg != "" {
+		parts = append(parts, t.register(reg))
+	}
+	if len(parts) > 0 {
+		lines = append(lines, strings.Join(parts, ", "))
+	}
+	return lines
+}
+
+func (t *tracer) register(reg string) string {
+	if reg == "ADDR" {
+		return fmt.Sprintf("ADDR 0x%X", t.addr*2)
+	}
+	return fmt.Sprintf("LEN 0x%X words", t.length)
+}
+
+// command decodes the first command in b and returns the number of bytes it
+// used, 0 if b doesn't hold all of it yet.
+func (t *tracer) command(b []byte) (int, string) {
+	c := b[0]
+	switch c & cmdMask {
+	case CMD_ADDR, CMD_LEN, CMD_DELAY:
+		if len(b) < 2 {
+			return 0, ""
+		}
+		switch c & cmdMask {
+		case CMD_ADDR:
+			t.addr = (t.addr<<8 | int64(b[1])) & 0xffffff
+		case CMD_LEN:
+			t.length = (t.length<<8 | int(b[1])) & 0xffff
+		}
+		return 2, fmt.Sprintf("DELAY %d", b[1])
+
+	case CMD_RY:
+		return 1, "RY"
+
+	case CMD_RD:
+		name := "RD" + modifiers(c)
+		count := t.length
+		switch {
+		case c&PAR_DEV_ID != 0:
+			t.pending = append(t.pending, pendingRead{desc: "DEV_ID", size: 2})
+			return 1, name
+		case c&PAR_SINGE != 0:
+			count = 1
+			t.pending = append(t.pending, pendingRead{desc: fmt.Sprintf("@0x%X", t.addr*2), size: 2})
+			name += fmt.Sprintf(" @0x%X", t.addr*2)
+		default:
+			t.pending = append(t.pending, pendingRead{desc: fmt.Sprintf("0x%X words @0x%X", count, t.addr*2), size: count * 2})
+		}
+		if c&PAR_INC != 0 {
+			t.addr += int64(count)
+		}
+		return 1, name
+
+	case CMD_WR:
+		name := "WR" + modifiers(c)
+		width := 2
+		unit := "words"
+		if c&PAR_MODE8 != 0 {
+			width = 1
+			unit = "bytes"
+		}
+		count := t.length
+		if c&PAR_SINGE != 0 {
+			count = 1
+		}
+		if len(b) < 1+count*width {
+			return 0, ""
+		}
+		addr := t.addr * 2
+		if c&PAR_INC != 0 {
+			t.addr += int64(count)
+		}
+		if c&PAR_SINGE == 0 {
+			return 1 + count*width, fmt.Sprintf("%s 0x%X %s @0x%X", name, count, unit, addr)
+		}
+		if width == 1 {
+			// MODE8 drives the low byte of the word
+			return 2, fmt.Sprintf("%s @0x%X = 0x%02X", name, addr+1, b[1])
+		}
+		return 3, fmt.Sprintf("%s @0x%X = 0x%04X", name, addr, uint16(b[1])<<8|uint16(b[2]))
+	}
+	return 1, fmt.Sprintf("unknown command 0x%02X", c)
+}
+
+func modifiers(c byte) string {
+	var s string
+	if c&PAR_DEV_ID != 0 {
+		s += " DEV_ID"
+	}
+	if c&PAR_SINGE != 0 {
+		s += " SINGLE"
+	}
+	if c&PAR_INC != 0 {
+		s += " INC"
+	}
+	if c&PAR_MODE8 != 0 {
+		s += " MODE8"
+	}
+	return s
+}
+
+func (t *tracer) Received(b []byte) []string {
+	var lines []string
+	for len(b) > 0 {
+		if len(t.pending) == 0 {
+			lines = append(lines, fmt.Sprintf("unexpected %d bytes: %s", len(b), preview(b)))
+			break
+		}
+		p := &t.pending[0]
+		n := p.size - len(p.data)
+		if n > len(b) {
+			n = len(b)
+		}
+		p.data = append(p.data, b[:n]...)
+		b = b[n:]
+		if len(p.data) < p.size {
+			break
+		}
+		if p.size == 2 {
+			lines = append(lines, fmt.Sprintf("%s = 0x%04X", p.desc, uint16(p.data[0])<<8|uint16(p.data[1])))
+		} else {
+			lines = append(lines, fmt.Sprintf("%s: %s", p.desc, preview(p.data)))
+		}
+		t.pending = t.pending[1:]
+	}
+	return lines
+}
+
+// preview shows the first few bytes of b in hex.
+func preview(b []byte) string {
+	if len(b) > 8 {
+		return fmt.Sprintf("% x ...", b[:8])
+	}
+	return fmt.Sprintf("% x", b)
+}
@@ -0,0 +1,44 @@
+package krikzz_fkmd
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDecoder(t *testing.T) {
+	dec := NewDecoder()
+	for _, c := range []struct {
+		sent     []byte
+		received []byte
+		want     []string
+	}{
+		{
+			sent: []byte{CMD_ADDR, 0x08, CMD_ADDR, 0x00, CMD_ADDR, 0x00, CMD_LEN, 0x80, CMD_LEN, 0x00, CMD_RD | PAR_INC},
+			want: []string{"ADDR 0x100000, LEN 0x8000 words, RD INC"},
+		},
+		{received: make([]byte, 0x8000)},
+		{received: make([]byte, 0x8000), want: []string{"0x8000 words @0x100000: 00 00 00 00 00 00 00 00 ..."}},
+		{
+			sent: []byte{CMD_ADDR, 0x10, CMD_ADDR, 0x00, CMD_ADDR, 0x00, CMD_WR | PAR_SINGE | PAR_MODE8, 0x5a},
+			want: []string{"ADDR 0x200000, WR SINGLE MODE8 @0x200001 = 0x5A"},
+		},
+		{sent: []byte{CMD_DELAY, 0}, want: []string{"DELAY 0"}},
+		{sent: []byte{CMD_RD | PAR_SINGE | PAR_DEV_ID}, want: []string{"RD DEV_ID SINGLE"}},
+		{received: []byte{0x01, 0x01}, want: []string{"DEV_ID = 0x0101"}},
+		{sent: []byte{CMD_WR | PAR_SINGE | PAR_INC, 0x12}},
+		{sent: []byte{0x34, CMD_RY}, want: []string{"WR SINGLE INC @0x200000 = 0x1234, RY"}},
+		{sent: []byte{CMD_RD | PAR_SINGE}, want: []string{"RD SINGLE @0x200002"}},
+		{sent: []byte{CMD_DELAY, 1}, want: []string{"@0x200002: short, got 0 of 2 bytes", "DELAY 1"}},
+		{received: []byte{0xff}, want: []string{"unexpected 1 bytes: ff"}},
+	} {
+		var got []string
+		if c.sent != nil {
+			got = dec.Sent(c.sent)
+		} else {
+			got = dec.Received(c.received)
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("sent % x received % x: got %q, want %q", c.sent, c.received, got, c.want)
+		}
+	}
+}
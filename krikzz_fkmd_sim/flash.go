@@ -0,0 +1,326 @@
+package krikzz_fkmd_sim
+
+// AMD-style flash command decoding, as used by the 16-bit flash on Flashkit MD
+// flash carts. Command addresses are word addresses and only the low byte of
+// the data bus is decoded for commands.
+
+import "github.com/grantek/fkmd/flashchip"
+
+const (
+	FLASH_UNLOCK_ADDR1 int64 = 0x555 // word address for first unlock cycle
+	FLASH_UNLOCK_ADDR2 int64 = 0x2aa // word address for second unlock cycle
+
+	FLASH_UNLOCK1      byte = 0xaa
+	FLASH_UNLOCK2      byte = 0x55
+	FLASH_RESET        byte = 0xf0
+	FLASH_ERASE_SETUP  byte = 0x80
+	FLASH_SECTOR_ERASE byte = 0x30
+	FLASH_CHIP_ERASE   byte = 0x10
+	FLASH_PROGRAM      byte = 0xa0
+	FLASH_BYPASS       byte = 0x20
+	FLASH_BYPASS_RESET byte = 0x90 // first cycle of unlock bypass reset, then 0x00
+	FLASH_AUTOSELECT   byte = 0x90 // after the unlock cycles: read IDs until reset
+
+	// Intel command set, for chips whose Geometry says so
+	INTEL_READ_ID    byte = 0x90 // read IDs until 0xFF, with no unlock cycles
+	INTEL_READ_ARRAY byte = 0xff
+
+	// Status bits returned while the chip is busy
+	FLASH_DQ7 byte = 0x80 // data polling, complement of programmed bit 7
+	FLASH_DQ6 byte = 0x40 // toggles on every read
+
+	DEFAULT_SECTOR_SIZE int = 0x10000 // bytes
+	DEFAULT_BUSY_READS  int = 2
+
+	// IDs of the chip NewFlashChip returns, not in the flashchip database so
+	// drivers fall back to 64KiB sectors
+	DEFAULT_MANUFACTURER_ID byte   = 0x01
+	DEFAULT_DEVICE_ID       uint16 = 0x22ff
+)
+
+type FlashState int
+
+const (
+	FLASH_READ              FlashState = iota // array read
+	FLASH_UNLOCKED1                           // got 0xAA at 0x555
+	FLASH_UNLOCKED2                           // got 0x55 at 0x2AA, next is the command
+	FLASH_ERASE1                              // got 0x80, next is 0xAA at 0x555
+	FLASH_ERASE2                              // next is 0x55 at 0x2AA
+	FLASH_ERASE3                              // next is 0x30 at a sector, or 0x10 at 0x555
+	FLASH_SECTOR_ERASE_WAIT                   // accepting more 0x30 sector writes
+	FLASH_PROGRAM_WAIT                        // next write is programmed
+	FLASH_BYPASS_ERASE                        // unlock bypass: next is 0x30 or 0x10
+	FLASH_BYPASS_RESET_WAIT                   // unlock bypass: next is 0x00 to leave
+	FLASH_ID                                  // autoselect: reads return IDs until 0xF0
+)
+
+// FlashChip models the command state machine of an AMD-compatible flash chip
+// standing in for the cartridge ROM. Erased bytes read 0xFF, and programming
+// can only clear bits.
+type FlashChip struct {
+	SectorSize int             // Uniform sector size in bytes, if Geometry is nil
+	Geometry   *flashchip.Chip // Sector layout, nil for uniform sectors
+	BusyReads  int             // Status reads returned before a busy operation finishes by itself
+
+	// IDs read in autoselect mode, from words 0 and 1
+	ManufacturerID byte
+	DeviceID       uint16
+
+	State  FlashState
+	Bypass bool // Unlock bypass mode, program with a single 0xA0 cycle
+
+	// Counters for tests to check what the driver asked for.
+	SectorErases int
+	ChipErases   int
+	Programs     int
+	FailedBits   int // Attempts to program a 0 bit back to 1
+	Ignored      int // Writes ignored because the chip was busy
+
+	busy    int                // status reads left before the current operation ends
+	pending []flashchip.Sector // sectors queued for erase
+	dq7     byte
+	toggle  byte
+}
+
+// NewFlashChip returns a flash chip with uniform sectors of sectorsize bytes.
+func NewFlashChip(sectorsize int) *FlashChip {
+	return &FlashChip{
+		SectorSize:     sectorsize,
+		BusyReads:      DEFAULT_BUSY_READS,
+		ManufacturerID: DEFAULT_MANUFACTURER_ID,
+		DeviceID:       DEFAULT_DEVICE_ID,
+	}
+}
+
+// NewFlashChipFor returns a flash chip with the IDs and sectors of chip.
+func NewFlashChipFor(chip *flashchip.Chip) *FlashChip {
+	return &FlashChip{
+		Geometry:       chip,
+		BusyReads:      DEFAULT_BUSY_READS,
+		ManufacturerID: chip.Manufacturer,
+		DeviceID:       chip.Device,
+	}
+}
+
+// NewFlash returns a simulated Flashkit with a flash cart containing rom.
+func NewFlash(rom []byte, ramsize int) *Flashkit {
+	f := New(rom, ramsize)
+	f.Flash = NewFlashChip(DEFAULT_SECTOR_SIZE)
+	return f
+}
+
+// Busy reports whether an erase or program is still in progress.
+func (c *FlashChip) Busy() bool {
+	return c.busy > 0 || c.State == FLASH_SECTOR_ERASE_WAIT
+}
+
+// Ready finishes any operation in progress, as the device does while it
+// waits on the RY/BY line for CMD_RY.
+func (c *FlashChip) Ready(rom []byte) {
+	if c.State == FLASH_SECTOR_ERASE_WAIT {
+		c.eraseSectors(rom)
+	}
+	c.busy = 0
+}
+
+// status returns the data polling word read from any address while busy.
+func (c *FlashChip) status(rom []byte) uint16 {
+	if c.State == FLASH_SECTOR_ERASE_WAIT {
+		// the sector erase timeout has passed, the erase starts
+		c.eraseSectors(rom)
+		c.busy = c.BusyReads
+		c.dq7 = 0
+	}
+	c.toggle ^= FLASH_DQ6
+	s := c.dq7 | c.toggle
+	if c.busy > 0 {
+		c.busy--
+	}
+	return uint16(s)<<8 | uint16(s)
+}
+
+// autoselect returns the word read from word address waddr in autoselect
+// mode: the IDs, or 0 for the sector protection and other codes.
+func (c *FlashChip) autoselect(waddr int64) uint16 {
+	switch waddr & 0xff {
+	case 0:
+		return uint16(c.ManufacturerID)
+	case 1:
+		return c.DeviceID
+	}
+	return 0
+}
+
+// write decodes a bus write of val to word address waddr.
+func (c *FlashChip) write(rom []byte, waddr int64, val uint16) {
+	cmd := byte(val)
+	if c.busy > 0 {
+		// A real chip ignores everything but suspend while busy.
+		c.Ignored++
+		return
+	}
+	if c.Geometry != nil && c.Geometry.Commands == flashchip.INTEL {
+		c.writeIntel(cmd)
+		return
+	}
+	if c.State == FLASH_SECTOR_ERASE_WAIT {
+		if cmd == FLASH_SECTOR_ERASE {
+			c.queueSector(rom, waddr)
+			return
+		}
+		c.eraseSectors(rom)
+		c.busy = 0
+	}
+
+	switch c.State {
+	case FLASH_PROGRAM_WAIT:
+		c.programWord(rom, waddr, val)
+		return
+	case FLASH_ERASE3, FLASH_BYPASS_ERASE:
+		c.erase(rom, waddr, cmd)
+		return
+	case FLASH_BYPASS_RESET_WAIT:
+		if cmd == 0x00 {
+			c.Bypass = false
+		}
+		c.State = FLASH_READ
+		return
+	}
+
+	if c.Bypass {
+		switch cmd {
+		case FLASH_PROGRAM:
+			c.State = FLASH_PROGRAM_WAIT
+		case FLASH_ERASE_SETUP:
+			c.State = FLASH_BYPASS_ERASE
+		case FLASH_BYPASS_RESET:
+			c.State = FLASH_BYPASS_RESET_WAIT
+		}
+		return
+	}
+
+	if cmd == FLASH_RESET {
+		c.State = FLASH_READ
+		return
+	}
+	if c.State == FLASH_ID {
+		return
+	}
+
+	next := FLASH_READ
+	switch c.State {
+	case FLASH_READ:
+		if waddr == FLASH_UNLOCK_ADDR1 && cmd == FLASH_UNLOCK1 {
+			next = FLASH_UNLOCKED1
+		}
+	case FLASH_UNLOCKED1:
+		if waddr == FLASH_UNLOCK_ADDR2 && cmd == FLASH_UNLOCK2 {
+			next = FLASH_UNLOCKED2
+		}
+	case FLASH_UNLOCKED2:
+		if waddr != FLASH_UNLOCK_ADDR1 {
+			break
+		}
+		switch cmd {
+		case FLASH_PROGRAM:
+			next = FLASH_PROGRAM_WAIT
+		case FLASH_ERASE_SETUP:
+			next = FLASH_ERASE1
+		case FLASH_AUTOSELECT:
+			next = FLASH_ID
+		case FLASH_BYPASS:
+			c.Bypass = true
+		}
+	case FLASH_ERASE1:
+		if waddr == FLASH_UNLOCK_ADDR1 && cmd == FLASH_UNLOCK1 {
+			next = FLASH_ERASE2
+		}
+	case FLASH_ERASE2:
+		if waddr == FLASH_UNLOCK_ADDR2 && cmd == FLASH_UNLOCK2 {
+			next = FLASH_ERASE3
+		}
+	}
+	c.State = next
+}
+
+// writeIntel decodes the commands of an Intel chip that identifying it
+// needs: 0x90 reads the IDs and 0xFF goes back to array data, anything else
+// leaves the mode unchanged.
+func (c *FlashChip) writeIntel(cmd byte) {
+	switch cmd {
+	case INTEL_READ_ID:
+		c.State = FLASH_ID
+	case INTEL_READ_ARRAY:
+		c.State = FLASH_READ
+	}
+}
+
+func (c *FlashChip) erase(rom []byte, waddr int64, cmd byte) {
+	c.State = FLASH_READ
+	switch {
+	case cmd == FLASH_SECTOR_ERASE:
+		c.queueSector(rom, waddr)
+		c.State = FLASH_SECTOR_ERASE_WAIT
+	case cmd == FLASH_CHIP_ERASE && (c.Bypass || waddr == FLASH_UNLOCK_ADDR1):
+		for i := range rom {
+			rom[i] = 0xff
+		}
+		c.ChipErases++
+		c.dq7 = 0
+		c.busy = c.BusyReads
+	}
+}
+
+// sectorAt returns the sector holding ROM offset i.
+func (c *FlashChip) sectorAt(i int) flashchip.Sector {
+	if c.Geometry != nil && c.Geometry.Known() {
+		return c.Geometry.SectorAt(i)
+	}
+	return flashchip.Sector{Addr: i - i%c.SectorSize, Size: c.SectorSize}
+}
+
+func (c *FlashChip) queueSector(rom []byte, waddr int64) {
+	if len(rom) < 2 {
+		return
+	}
+	s := c.sectorAt(int(romIndex(waddr*2, int64(len(rom)&^1))))
+	for _, v := range c.pending {
+		if v == s {
+			return
+		}
+	}
+	c.pending = append(c.pending, s)
+}
+
+func (c *FlashChip) eraseSectors(rom []byte) {
+	for _, s := range c.pending {
+		end := s.Addr + s.Size
+		if end > len(rom) {
+			end = len(rom)
+		}
+		for i := s.Addr; i < end; i++ {
+			rom[i] = 0xff
+		}
+		c.SectorErases++
+	}
+	c.pending = nil
+	c.State = FLASH_READ
+}
+
+func (c *FlashChip) programWord(rom []byte, waddr int64, val uint16) {
+	c.State = FLASH_READ
+	if len(rom) < 2 {
+		return
+	}
+	i := romIndex(waddr*2, int64(len(rom)&^1))
+	old := uint16(rom[i])<<8 | uint16(rom[i+1])
+	for b := val &^ old; b != 0; b &= b - 1 {
+		c.FailedBits++
+	}
+	val &= old
+	rom[i] = byte(val >> 8)
+	rom[i+1] = byte(val)
+	c.Programs++
+	c.dq7 = ^byte(val) & FLASH_DQ7
+	c.busy = c.BusyReads
+}
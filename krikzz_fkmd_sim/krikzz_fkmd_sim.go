@@ -0,0 +1,356 @@
+// Package krikzz_fkmd_sim simulates a krikzz.com Flashkit MD on the far end of
+// the serial line. It decodes the same command stream that krikzz_fkmd and
+// device send, over an in-memory ROM image and cartridge SRAM, so the drivers
+// can be tested without hardware.
+package krikzz_fkmd_sim
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/jacobsa/go-serial/serial"
+)
+
+const (
+	CMD_ADDR   byte = 0
+	CMD_LEN    byte = 1
+	CMD_RD     byte = 2
+	CMD_WR     byte = 3
+	CMD_RY     byte = 4
+	CMD_DELAY  byte = 5
+	PAR_MODE8  byte = 16
+	PAR_DEV_ID byte = 32
+	PAR_SINGE  byte = 64
+	PAR_INC    byte = 128
+
+	CMD_MASK byte = 0x0f
+
+	// Device ID returned by PAR_DEV_ID, matches a real Flashkit MD (257)
+	DEFAULT_ID uint16 = 0x0101
+
+	RAM_ADDR   int64 = 0x200000 // SRAM appears here when enabled
+	RAM_END    int64 = 0x400000 // SRAM is mirrored up to the end of cart space
+	RAM_LATCH  int64 = 0xA13000 // write bit 0 to enable/disable SRAM
+	ADDR_MASK  int64 = 0xffffff // 24-bit word address register
+	OPEN_BUS   byte  = 0xff     // value read from undriven data lines
+	MAX_LENGTH int   = 0x10000  // CMD_LEN is a 16-bit word count
+)
+
+// Flashkit is a simulated Flashkit MD with a cartridge inserted. It implements
+// io.ReadWriteCloser: bytes written are executed as device commands, and any
+// data the device sends back is queued to be read.
+type Flashkit struct {
+	ROM []byte // Cartridge ROM, mirrored across the 4MiB ROM space
+	RAM []byte // Cartridge SRAM, nil if none
+
+	RAMAddr  int64  // Where SRAM appears when enabled, RAM_ADDR if 0
+	RAMLanes uint16 // Bits of each word SRAM is on: 0x00ff (odd bytes, if 0), 0xff00 (even bytes) or 0xffff
+
+	Flash *FlashChip // Flash chip decoding writes to ROM, nil for mask ROM
+
+	ID         uint16 // Device ID
+	RamEnabled bool   // State of the 0xA13000 SRAM latch
+	Delay      byte   // Last value sent with CMD_DELAY
+
+	Options serial.OpenOptions // Options from the last Open
+	Opens   int                // Number of times Open was called
+
+	addr   int64  // current word address
+	length int    // word count for block reads and writes
+	in     []byte // incomplete command waiting for more bytes
+	out    []byte // response bytes waiting to be read
+	closed bool
+}
+
+// New returns a simulated Flashkit with rom inserted, and ramsize bytes of
+// SRAM (0 for none).
+func New(rom []byte, ramsize int) *Flashkit {
+	f := &Flashkit{
+		ROM: rom,
+		ID:  DEFAULT_ID,
+	}
+	if ramsize > 0 {
+		f.RAM = make([]byte, ramsize)
+	}
+	return f
+}
+
+// Read returns queued response bytes. Like a serial port hitting its read
+// timeout, it returns io.EOF when the device has nothing to send.
+func (f *Flashkit) Read(p []byte) (int, error) {
+	if f.closed {
+		return 0, errors.New("krikzz_fkmd_sim: read from closed device")
+	}
+	if len(f.out) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, f.out)
+	f.out = f.out[n:]
+	return n, nil
+}
+
+// Write executes commands from p. Commands may be split across calls, a
+// partial command is kept until the rest of its bytes arrive.
+func (f *Flashkit) Write(p []byte) (int, error) {
+	if f.closed {
+		return 0, errors.New("krikzz_fkmd_sim: write to closed device")
+	}
+	f.in = append(f.in, p...)
+	for len(f.in) > 0 {
+		n, err := f.exec(f.in)
+		if err != nil {
+			f.in = nil
+			return len(p), err
+		}
+		if n == 0 {
+			break
+		}
+		f.in = f.in[n:]
+	}
+	return len(p), nil
+}
+
+// Open reopens the device with the given options. It is a transport.Opener,
+// so drivers can use the simulator in place of a serial port.
+func (f *Flashkit) Open(opt serial.OpenOptions) (io.ReadWriteCloser, error) {
+	f.Options = opt
+	f.Opens++
+	f.closed = false
+	f.in = nil
+	f.out = nil
+	return f, nil
+}
+
+// Close marks the device closed, cartridge memory is kept.
+func (f *Flashkit) Close() error {
+	if f.closed {
+		return errors.New("krikzz_fkmd_sim: device already closed")
+	}
+	f.closed = true
+	f.in = nil
+	f.out = nil
+	return nil
+}
+
+// Address returns the device's current word address register.
+func (f *Flashkit) Address() int64 {
+	return f.addr
+}
+
+// exec runs the first command in b and returns the number of bytes it used,
+// or 0 if b doesn't hold the whole command yet.
+func (f *Flashkit) exec(b []byte) (int, error) {
+	cmd := b[0]
+	switch cmd & CMD_MASK {
+	case CMD_ADDR:
+		if len(b) < 2 {
+			return 0, nil
+		}
+		f.addr = (f.addr<<8 | int64(b[1])) & ADDR_MASK
+		return 2, nil
+
+	case CMD_LEN:
+		if len(b) < 2 {
+			return 0, nil
+		}
+		f.length = (f.length<<8 | int(b[1])) & (MAX_LENGTH - 1)
+		return 2, nil
+
+	case CMD_DELAY:
+		if len(b) < 2 {
+			return 0, nil
+		}
+		f.Delay = b[1]
+		return 2, nil
+
+	case CMD_RY:
+		if f.Flash != nil {
+			f.Flash.Ready(f.ROM)
+		}
+		return 1, nil
+
+	case CMD_RD:
+		switch {
+		case cmd&PAR_DEV_ID != 0:
+			f.out = append(f.out, byte(f.ID>>8), byte(f.ID))
+		case cmd&PAR_SINGE != 0:
+			f.readWords(1, cmd&PAR_INC != 0)
+		default:
+			f.readWords(f.length, cmd&PAR_INC != 0)
+		}
+		return 1, nil
+
+	case CMD_WR:
+		width := 2
+		if cmd&PAR_MODE8 != 0 {
+			width = 1
+		}
+		count := f.length
+		if cmd&PAR_SINGE != 0 {
+			count = 1
+		}
+		need := 1 + count*width
+		if len(b) < need {
+			return 0, nil
+		}
+		for i := 1; i < need; i += width {
+			if width == 1 {
+				f.writeByte(f.addr, b[i])
+			} else {
+				f.writeWord(f.addr, uint16(b[i])<<8|uint16(b[i+1]))
+			}
+			if cmd&PAR_INC != 0 {
+				f.addr = (f.addr + 1) & ADDR_MASK
+			}
+		}
+		return need, nil
+	}
+	return 0, fmt.Errorf("krikzz_fkmd_sim: unknown command byte 0x%02x", cmd)
+}
+
+func (f *Flashkit) readWords(count int, inc bool) {
+	for i := 0; i < count; i++ {
+		w := f.ReadWord(f.addr * 2)
+		f.out = append(f.out, byte(w>>8), byte(w))
+		if inc {
+			f.addr = (f.addr + 1) & ADDR_MASK
+		}
+	}
+}
+
+func (f *Flashkit) ramLanes() uint16 {
+	if f.RAMLanes == 0 {
+		return 0x00ff
+	}
+	return f.RAMLanes
+}
+
+// ramIndex returns the SRAM cell mapped at a byte address, the one on the
+// high byte for 16-bit SRAM, or -1 if SRAM isn't visible there.
+func (f *Flashkit) ramIndex(addr int64) int {
+	base := f.RAMAddr
+	if base == 0 {
+		base = RAM_ADDR
+	}
+	if !f.RamEnabled || len(f.RAM) == 0 || addr < base || addr >= RAM_END {
+		return -1
+	}
+	if f.ramLanes() == 0xffff {
+		return int(addr-base) % len(f.RAM) &^ 1
+	}
+	return int((addr-base)/2) % len(f.RAM)
+}
+
+// ReadWord returns the word the cartridge drives at byte address addr.
+func (f *Flashkit) ReadWord(addr int64) uint16 {
+	addr &^= 1
+	if i := f.ramIndex(addr); i >= 0 {
+		switch f.ramLanes() {
+		case 0xff00:
+			return uint16(f.RAM[i])<<8 | uint16(OPEN_BUS)
+		case 0xffff:
+			return uint16(f.RAM[i])<<8 | uint16(f.RAM[i+1])
+		}
+		return uint16(OPEN_BUS)<<8 | uint16(f.RAM[i])
+	}
+	if addr >= RAM_END || len(f.ROM) < 2 {
+		return uint16(OPEN_BUS)<<8 | uint16(OPEN_BUS)
+	}
+	if f.Flash != nil && f.Flash.Busy() {
+		return f.Flash.status(f.ROM)
+	}
+	if f.Flash != nil && f.Flash.State == FLASH_ID {
+		return f.Flash.autoselect(addr / 2)
+	}
+	i := romIndex(addr, int64(len(f.ROM)&^1))
+	return uint16(f.ROM[i])<<8 | uint16(f.ROM[i+1])
+}
+
+// romIndex mirrors addr into a ROM of size bytes the way cartridges decode
+// it: a ROM that isn't a power of two is built from power-of-two chips, each
+// of which repeats across the address space left for it, eg. a 3MiB ROM shows
+// its last 1MiB chip again at 0x300000.
+func romIndex(addr int64, size int64) int64 {
+	chip := int64(1)
+	for chip*2 <= size {
+		chip *= 2
+	}
+	if chip == size {
+		return addr % size
+	}
+	addr %= 2 * chip
+	if addr < chip {
+		return addr
+	}
+	return chip + romIndex(addr-chip, size-chip)
+}
+
+func (f *Flashkit) writeWord(waddr int64, val uint16) {
+	addr := waddr * 2
+	if addr == RAM_LATCH {
+		f.RamEnabled = val&1 == 1
+		return
+	}
+	if i := f.ramIndex(addr); i >= 0 {
+		switch f.ramLanes() {
+		case 0xff00:
+			f.RAM[i] = byte(val >> 8)
+		case 0xffff:
+			f.RAM[i] = byte(val >> 8)
+			f.RAM[i+1] = byte(val)
+		default:
+			f.RAM[i] = byte(val)
+		}
+		return
+	}
+	if f.Flash != nil && addr < RAM_END {
+		f.Flash.write(f.ROM, waddr, val)
+	}
+}
+
+// MODE8 writes drive the low byte of the data bus only.
+func (f *Flashkit) writeByte(waddr int64, val byte) {
+	f.writeWord(waddr, uint16(OPEN_BUS)<<8|uint16(val))
+}
+
+// SampleROM returns a size-byte ROM image filled with pseudo-random data, so
+// no two banks mirror each other, with a minimal Mega Drive header and a
+// correct checksum.
+func SampleROM(size int, name string) []byte {
+	rom := make([]byte, size)
+	var x uint32 = 0x2545f491
+	for i := range rom {
+		x = x*1664525 + 1013904223
+		rom[i] = byte(x >> 24)
+	}
+	if size < 0x200 {
+		return rom
+	}
+	hdr := rom[0x100:0x200]
+	for i := range hdr {
+		hdr[i] = ' '
+	}
+	copy(rom[0x100:], "SEGA MEGA DRIVE ")
+	copy(rom[0x120:], name)
+	copy(rom[0x150:], name)
+	putLong(rom[0x1a0:], 0)
+	putLong(rom[0x1a4:], uint32(size-1))
+	putLong(rom[0x1a8:], 0xff0000)
+	putLong(rom[0x1ac:], 0xffffff)
+	copy(rom[0x1f0:], "JUE")
+	var sum uint16
+	for i := 0x200; i+1 < size; i += 2 {
+		sum += uint16(rom[i])<<8 | uint16(rom[i+1])
+	}
+	rom[0x18e] = byte(sum >> 8)
+	rom[0x18f] = byte(sum)
+	return rom
+}
+
+func putLong(b []byte, v uint32) {
+	b[0] = byte(v >> 24)
+	b[1] = byte(v >> 16)
+	b[2] = byte(v >> 8)
+	b[3] = byte(v)
+}
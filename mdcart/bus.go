@@ -0,0 +1,91 @@
+package mdcart
+
+import (
+	"errors"
+	"io"
+
+	"github.com/grantek/fkmd/flashchip"
+)
+
+// Bus is the access to a cart that both Flashkit MD drivers, device.Device
+// and krikzz_fkmd.Fkmd, give. Addresses are in bytes, words are big-endian
+// at even addresses.
+type Bus interface {
+	io.ReadSeeker
+	ReadWord(addr int64) (uint16, error)
+	WriteWord(addr int64, data uint16) error
+	WriteByteAt(addr int, data byte) error
+	RamEnable() error
+	RamDisable() error
+	FlashRY() error
+	FlashResetBypass()
+}
+
+// ErrNoFlash is returned by FlashID when the cart doesn't answer autoselect,
+// eg. because it's mask ROM.
+var ErrNoFlash = errors.New("no flash chip answered autoselect")
+
+// FlashID reads the flash chip's manufacturer and device IDs in autoselect
+// mode, from words 0 and 1. If the words read the same as the array data
+// before, nothing switched to autoselect and ErrNoFlash is returned.
+// Leaves the chip in read mode, out of unlock bypass, with RAM disabled.
+func FlashID(b Bus) (manufacturer byte, device uint16, err error) {
+	b.RamDisable()
+	b.FlashResetBypass()
+	// Intel chips take the 0x90 of the bypass reset as Read Identifier
+	flashReadArray(b)
+	w0, err := b.ReadWord(0)
+	if err != nil {
+		return 0, 0, err
+	}
+	w1, err := b.ReadWord(2)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	b.WriteWord(0x555*2, 0xaa)
+	b.WriteWord(0x2aa*2, 0x55)
+	b.WriteWord(0x555*2, 0x90)
+	mfr, err := b.ReadWord(0)
+	if err == nil {
+		device, err = b.ReadWord(2)
+	}
+	flashReadArray(b)
+	if err != nil {
+		return 0, 0, err
+	}
+	if mfr == w0 && device == w1 {
+		return 0, 0, ErrNoFlash
+	}
+	return byte(mfr), device, nil
+}
+
+// flashReadArray returns the chip to reading array data: 0xF0 resets AMD
+// chips and 0xFF Intel ones, and each ignores the other's.
+func flashReadArray(b Bus) {
+	b.WriteWord(0, 0xf0)
+	b.WriteWord(0, 0xff)
+}
+
+// FlashChip identifies the flash chip from the flashchip database. Chips
+// that answer but aren't in it are returned with only their IDs set.
+func FlashChip(b Bus) (*flashchip.Chip, error) {
+	mfr, dev, err := FlashID(b)
+	if err != nil {
+		return nil, err
+	}
+	return flashchip.Lookup(mfr, dev), nil
+}
+
+// FlashEraseSector erases the sector holding addr, of whatever size it is on
+// the chip, and waits for it to finish.
+func FlashEraseSector(b Bus, addr int64) error {
+	b.WriteWord(0x555*2, 0xaa)
+	b.WriteWord(0x2aa*2, 0x55)
+	b.WriteWord(0x555*2, 0x80)
+	b.WriteWord(0x555*2, 0xaa)
+	b.WriteWord(0x2aa*2, 0x55)
+	err := b.WriteByteAt(int(addr), 0x30)
+	b.FlashRY()
+	return err
+}
@@ -0,0 +1,146 @@
+package mdcart
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+const (
+	// CHECKSUM_START is where the checksummed part of ROM begins, after the
+	// vectors and header.
+	CHECKSUM_START = 0x200
+
+	// BLOCK_SIZE is the unit reads of a dump are compared and re-read in.
+	BLOCK_SIZE = 0x8000
+)
+
+// Checksum returns the sum of the big-endian words of rom from
+// CHECKSUM_START to the end, the value the header has at 0x18E. An odd last
+// byte counts as the high byte of a word.
+func Checksum(rom []byte) uint16 {
+	var sum uint16
+	for i := CHECKSUM_START; i < len(rom); i += 2 {
+		w := uint16(rom[i]) << 8
+		if i+1 < len(rom) {
+			w |= uint16(rom[i+1])
+		}
+		sum += w
+	}
+	return sum
+}
+
+// ChecksumError describes a ROM image whose checksum doesn't match its
+// header.
+type ChecksumError struct {
+	Got, Want uint16
+}
+
+func (e *ChecksumError) Error() string {
+	return fmt.Sprintf("bad checksum 0x%04X, header says 0x%04X", e.Got, e.Want)
+}
+
+// Verify computes the checksum of rom, and returns a *ChecksumError if it
+// doesn't match h.
+func (h *Header) Verify(rom []byte) error {
+	if sum := Checksum(rom); sum != h.Checksum {
+		return &ChecksumError{Got: sum, Want: h.Checksum}
+	}
+	return nil
+}
+
+// FixChecksum writes the checksum of rom into its header, returning the
+// value it replaced and the new one.
+func FixChecksum(rom []byte) (old uint16, sum uint16, err error) {
+	if len(rom) < ROM_HDR_LEN {
+		return 0, 0, fmt.Errorf("Short ROM header, expected %d, got %d", ROM_HDR_LEN, len(rom))
+	}
+	old = binary.BigEndian.Uint16(rom[HDR_CHECKSUM:])
+	sum = Checksum(rom)
+	binary.BigEndian.PutUint16(rom[HDR_CHECKSUM:], sum)
+	return old, sum, nil
+}
+
+// DiffBlocks returns the index of each BLOCK_SIZE block that differs
+// between a and b.
+func DiffBlocks(a []byte, b []byte) []int {
+	var blocks []int
+	for off := 0; off < len(a) || off < len(b); off += BLOCK_SIZE {
+		if !bytes.Equal(block(a, off), block(b, off)) {
+			blocks = append(blocks, off/BLOCK_SIZE)
+		}
+	}
+	return blocks
+}
+
+func block(b []byte, off int) []byte {
+	if off >= len(b) {
+		return nil
+	}
+	if off+BLOCK_SIZE > len(b) {
+		return b[off:]
+	}
+	return b[off : off+BLOCK_SIZE]
+}
+
+// readAt reads len(p) bytes of r from off.
+func readAt(r io.ReadSeeker, p []byte, off int) error {
+	if _, err := r.Seek(int64(off), io.SeekStart); err != nil {
+		return err
+	}
+	if n, err := io.ReadFull(r, p); err != nil {
+		return fmt.Errorf("short read at %d, expected %d bytes: %v", off+n, len(p), err)
+	}
+	return nil
+}
+
+// VerifyDump checks the checksum of rom, a dump of the ROM r reads. If it
+// fails, the ROM is read again to find the blocks that differ between
+// reads, and each of those is read again up to rereads times until two
+// reads of it agree. It returns the best image it has, the blocks that
+// differed and an error if the checksum still fails. If both whole reads
+// agree the dump is likely good and the header's checksum stale, which the
+// error says.
+func VerifyDump(r io.ReadSeeker, rom []byte, rereads int) ([]byte, []int, error) {
+	h, err := ParseHeader(rom)
+	if err != nil {
+		return rom, nil, err
+	}
+	if err = h.Verify(rom); err == nil {
+		return rom, nil, nil
+	}
+	again := make([]byte, len(rom))
+	if rerr := readAt(r, again, 0); rerr != nil {
+		return rom, nil, fmt.Errorf("%v, re-reading: %v", err, rerr)
+	}
+	blocks := DiffBlocks(rom, again)
+	if len(blocks) == 0 {
+		return rom, nil, fmt.Errorf("%v, but 2 reads agree: the header may be stale", err)
+	}
+
+	voted := append([]byte{}, rom...)
+	for _, b := range blocks {
+		off := b * BLOCK_SIZE
+		reads := [][]byte{block(rom, off), block(again, off)}
+		agreed := []byte(nil)
+		for i := 0; i < rereads && agreed == nil; i++ {
+			p := make([]byte, len(reads[0]))
+			if rerr := readAt(r, p, off); rerr != nil {
+				return voted, blocks, fmt.Errorf("%v, re-reading block %d: %v", err, b, rerr)
+			}
+			for _, prev := range reads {
+				if bytes.Equal(prev, p) {
+					agreed = p
+					break
+				}
+			}
+			reads = append(reads, p)
+		}
+		if agreed == nil {
+			agreed = reads[len(reads)-1]
+		}
+		copy(voted[off:], agreed)
+	}
+	return voted, blocks, h.Verify(voted)
+}
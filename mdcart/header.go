@@ -0,0 +1,355 @@
+package mdcart
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/grantek/fkmd/memcart"
+)
+
+// Header layout, from plutiedev.com/rom-header and the Sega Genesis
+// Software Manual.
+const (
+	HDR_SYSTEM    = 0x100
+	HDR_COPYRIGHT = 0x110
+	HDR_DOMESTIC  = 0x120
+	HDR_OVERSEAS  = 0x150
+	HDR_SERIAL    = 0x180
+	HDR_CHECKSUM  = 0x18e
+	HDR_DEVICES   = 0x190
+	HDR_ROM_RANGE = 0x1a0
+	HDR_RAM_RANGE = 0x1a8
+	HDR_SRAM      = 0x1b0
+	HDR_MODEM     = 0x1bc
+	HDR_MEMO      = 0x1c8
+	HDR_REGION    = 0x1f0
+)
+
+// SRAM type byte at 0x1B2: bit 6 set for battery backup, bits 4-3 the bus
+// lanes the RAM is on.
+const (
+	SRAM_BACKUP     byte = 0x40
+	SRAM_WIDTH_MASK byte = 0x18
+	SRAM_BOTH       byte = 0x00 // 16-bit RAM
+	SRAM_EVEN       byte = 0x10 // 8-bit RAM on even addresses, the high byte
+	SRAM_ODD        byte = 0x18 // 8-bit RAM on odd addresses, the low byte
+
+	// Byte at 0x1B3
+	SRAM_KIND_RAM    byte = 0x20
+	SRAM_KIND_EEPROM byte = 0x40 // serial EEPROM, mapped at the given range
+)
+
+// SRAM is the "RA" block at 0x1B0 declaring extra memory, usually battery
+// backed save RAM.
+type SRAM struct {
+	Present bool   // "RA" is there, the rest is only meaningful if it is
+	Type    byte   // 0x1B2, see SRAM_BACKUP and SRAM_WIDTH_MASK
+	Kind    byte   // 0x1B3, SRAM_KIND_RAM or SRAM_KIND_EEPROM
+	Start   uint32 // 0x1B4, byte address of the first byte
+	End     uint32 // 0x1B8, byte address of the last byte
+}
+
+// Backup reports whether the memory keeps its contents, eg. battery backed.
+func (s SRAM) Backup() bool {
+	return s.Type&SRAM_BACKUP != 0
+}
+
+// Width returns which bytes of each word the memory is on: SRAM_ODD,
+// SRAM_EVEN or SRAM_BOTH.
+func (s SRAM) Width() byte {
+	return s.Type & SRAM_WIDTH_MASK
+}
+
+// Size returns how many bytes the memory holds. 8-bit RAM only takes every
+// other byte of its address range.
+func (s SRAM) Size() int {
+	if !s.Present || s.End < s.Start {
+		return 0
+	}
+	switch s.Width() {
+	case SRAM_ODD, SRAM_EVEN:
+		return int(s.End-s.Start)/2 + 1
+	}
+	return int(s.End-s.Start) + 1
+}
+
+func (s SRAM) String() string {
+	if !s.Present {
+		return "none"
+	}
+	width := "16-bit"
+	switch s.Width() {
+	case SRAM_ODD:
+		width = "odd bytes"
+	case SRAM_EVEN:
+		width = "even bytes"
+	}
+	kind := "RAM"
+	if s.Kind == SRAM_KIND_EEPROM {
+		kind = "EEPROM"
+	}
+	str := fmt.Sprintf("0x%06X-0x%06X, %s %s on %s", s.Start, s.End, sizeString(s.Size()), kind, width)
+	if s.Backup() {
+		str += ", battery backed"
+	}
+	return str
+}
+
+// Region is a set of regions a game runs in, as in the new style region
+// code: a hex digit with a bit for each.
+type Region byte
+
+const (
+	REGION_JAPAN    Region = 0x1 // domestic NTSC
+	REGION_ASIA_PAL Region = 0x2 // domestic PAL, hardly used
+	REGION_AMERICAS Region = 0x4 // overseas NTSC
+	REGION_EUROPE   Region = 0x8 // overseas PAL
+)
+
+func (r Region) String() string {
+	var names []string
+	for _, v := range []struct {
+		bit  Region
+		name string
+	}{
+		{REGION_JAPAN, "Japan"},
+		{REGION_ASIA_PAL, "Asia PAL"},
+		{REGION_AMERICAS, "Americas"},
+		{REGION_EUROPE, "Europe"},
+	} {
+		if r&v.bit != 0 {
+			names = append(names, v.name)
+		}
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, ", ")
+}
+
+// ParseRegion reads the region field at 0x1F0. The old style lists letters,
+// J for Japan, U for the Americas and E for Europe. The new style is a
+// single hex digit bitmask, which is ambiguous with "E" alone, taken as
+// Europe like GetRomRegion does. Some carts have the digit as a raw byte.
+func ParseRegion(b []byte) Region {
+	code := strings.Trim(string(b), " \x00")
+	if len(code) == 1 && code != "J" && code != "U" && code != "E" {
+		c := code[0]
+		switch {
+		case c < 0x10:
+			return Region(c)
+		case c >= '0' && c <= '9':
+			return Region(c - '0')
+		case c >= 'A' && c <= 'F':
+			return Region(c - 'A' + 10)
+		}
+	}
+	var r Region
+	for _, c := range code {
+		switch c {
+		case 'J':
+			r |= REGION_JAPAN
+		case 'U':
+			r |= REGION_AMERICAS
+		case 'E':
+			r |= REGION_EUROPE
+		}
+	}
+	return r
+}
+
+// Devices maps the I/O support letters at 0x190 to what they stand for.
+var Devices = map[byte]string{
+	'J': "3-button controller",
+	'6': "6-button controller",
+	'0': "Master System controller",
+	'A': "analog joystick",
+	'4': "multitap",
+	'G': "light gun",
+	'L': "Activator",
+	'M': "mouse",
+	'B': "trackball",
+	'T': "tablet",
+	'V': "paddle",
+	'K': "keyboard",
+	'R': "RS-232",
+	'P': "printer",
+	'C': "CD-ROM",
+	'F': "floppy drive",
+	'D': "download",
+}
+
+// Header holds the fields of the Mega Drive header at 0x100-0x1FF, text
+// trimmed of padding.
+type Header struct {
+	System       string // 0x100, eg. "SEGA MEGA DRIVE" or "SEGA GENESIS"
+	Copyright    string // 0x110, eg. "(C)SEGA 1991.APR"
+	DomesticName string // 0x120, often Shift-JIS, unprintable bytes shown as '?'
+	OverseasName string // 0x150
+	ProductType  string // 0x180, "GM" for games, "AI" for educational
+	ProductCode  string // 0x183
+	Revision     string // 0x18C, after the '-'
+	Checksum     uint16 // 0x18E, big-endian
+	Devices      string // 0x190, see Devices
+	ROMStart     uint32 // 0x1A0
+	ROMEnd       uint32 // 0x1A4
+	RAMStart     uint32 // 0x1A8, work RAM, normally 0xFF0000
+	RAMEnd       uint32 // 0x1AC, normally 0xFFFFFF
+	SRAM         SRAM   // 0x1B0
+	Modem        string // 0x1BC
+	Memo         string // 0x1C8
+	RegionCode   string // 0x1F0, as found
+	Regions      Region // RegionCode parsed
+}
+
+// ParseHeader reads the header of a ROM image. rom needs to hold at least
+// the first ROM_HDR_LEN bytes.
+func ParseHeader(rom []byte) (*Header, error) {
+	if len(rom) < ROM_HDR_LEN {
+		return nil, fmt.Errorf("Short ROM header, expected %d, got %d", ROM_HDR_LEN, len(rom))
+	}
+	be := binary.BigEndian
+	h := &Header{
+		System:       text(rom[HDR_SYSTEM:HDR_COPYRIGHT]),
+		Copyright:    text(rom[HDR_COPYRIGHT:HDR_DOMESTIC]),
+		DomesticName: text(rom[HDR_DOMESTIC:HDR_OVERSEAS]),
+		OverseasName: text(rom[HDR_OVERSEAS:HDR_SERIAL]),
+		ProductType:  text(rom[HDR_SERIAL : HDR_SERIAL+2]),
+		Checksum:     be.Uint16(rom[HDR_CHECKSUM:]),
+		Devices:      text(rom[HDR_DEVICES:HDR_ROM_RANGE]),
+		ROMStart:     be.Uint32(rom[HDR_ROM_RANGE:]),
+		ROMEnd:       be.Uint32(rom[HDR_ROM_RANGE+4:]),
+		RAMStart:     be.Uint32(rom[HDR_RAM_RANGE:]),
+		RAMEnd:       be.Uint32(rom[HDR_RAM_RANGE+4:]),
+		Modem:        text(rom[HDR_MODEM:HDR_MEMO]),
+		Memo:         text(rom[HDR_MEMO:HDR_REGION]),
+		RegionCode:   text(rom[HDR_REGION : HDR_REGION+3]),
+		Regions:      ParseRegion(rom[HDR_REGION : HDR_REGION+3]),
+	}
+	code := text(rom[HDR_SERIAL+2 : HDR_CHECKSUM])
+	if i := strings.LastIndexByte(code, '-'); i >= 0 {
+		h.Revision = strings.TrimSpace(code[i+1:])
+		code = strings.TrimSpace(code[:i])
+	}
+	h.ProductCode = code
+	if string(rom[HDR_SRAM:HDR_SRAM+2]) == "RA" {
+		h.SRAM = SRAM{
+			Present: true,
+			Type:    rom[HDR_SRAM+2],
+			Kind:    rom[HDR_SRAM+3],
+			Start:   be.Uint32(rom[HDR_SRAM+4:]),
+			End:     be.Uint32(rom[HDR_SRAM+8:]),
+		}
+	}
+	return h, nil
+}
+
+// ReadHeader reads and parses the header from the ROM bank of mdc.
+func ReadHeader(mdc memcart.MemCart) (*Header, error) {
+	buf, err := readHeaderBytes(mdc)
+	if err != nil {
+		return nil, err
+	}
+	return ParseHeader(buf)
+}
+
+// ReadHeaderFile reads and parses the header of the ROM image in name.
+func ReadHeaderFile(name string) (*Header, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	buf := make([]byte, ROM_HDR_LEN)
+	if _, err = io.ReadFull(f, buf); err != nil {
+		return nil, fmt.Errorf("%s: reading header: %v", name, err)
+	}
+	return ParseHeader(buf)
+}
+
+// text returns b as a string without its padding, unprintable bytes as '?'.
+func text(b []byte) string {
+	s := make([]byte, len(b))
+	for i, v := range b {
+		if v < 0x20 && v != 0 || v >= 0x7f {
+			v = '?'
+		}
+		s[i] = v
+	}
+	return strings.Trim(string(s), " \x00")
+}
+
+func sizeString(n int) string {
+	if n >= 1024 && n%1024 == 0 {
+		return fmt.Sprintf("%dKiB", n/1024)
+	}
+	return fmt.Sprintf("%dB", n)
+}
+
+// TMSSValid reports whether the system field starts with "SEGA" or " SEGA",
+// which the TMSS boot ROM of later consoles checks for.
+func (h *Header) TMSSValid() bool {
+	// text has already trimmed a leading space
+	return strings.HasPrefix(h.System, "SEGA")
+}
+
+// Name returns the overseas name, or the domestic one if it's blank, with
+// runs of spaces collapsed.
+func (h *Header) Name() string {
+	name := h.OverseasName
+	if name == "" {
+		name = h.DomesticName
+	}
+	return strings.Join(strings.Fields(name), " ")
+}
+
+// DeviceNames returns what each letter of Devices stands for, or the letter
+// quoted if it isn't known.
+func (h *Header) DeviceNames() []string {
+	var names []string
+	for i := 0; i < len(h.Devices); i++ {
+		c := h.Devices[i]
+		if c == ' ' {
+			continue
+		}
+		if name, ok := Devices[c]; ok {
+			names = append(names, name)
+		} else {
+			names = append(names, fmt.Sprintf("%q", c))
+		}
+	}
+	return names
+}
+
+// ROMSize returns the size of ROM the header declares.
+func (h *Header) ROMSize() int {
+	if h.ROMEnd < h.ROMStart {
+		return 0
+	}
+	return int(h.ROMEnd-h.ROMStart) + 1
+}
+
+// String formats every field, a line each, for printing.
+func (h *Header) String() string {
+	var b strings.Builder
+	line := func(name string, format string, args ...interface{}) {
+		fmt.Fprintf(&b, "%-14s "+format+"\n", append([]interface{}{name + ":"}, args...)...)
+	}
+	line("System", "%s", h.System)
+	line("Copyright", "%s", h.Copyright)
+	line("Domestic name", "%s", h.DomesticName)
+	line("Overseas name", "%s", h.OverseasName)
+	line("Serial", "%s %s, revision %s", h.ProductType, h.ProductCode, h.Revision)
+	line("Checksum", "0x%04X", h.Checksum)
+	line("Devices", "%s (%s)", h.Devices, strings.Join(h.DeviceNames(), ", "))
+	line("ROM", "0x%06X-0x%06X, %s", h.ROMStart, h.ROMEnd, sizeString(h.ROMSize()))
+	line("RAM", "0x%06X-0x%06X", h.RAMStart, h.RAMEnd)
+	line("SRAM", "%v", h.SRAM)
+	line("Modem", "%s", h.Modem)
+	line("Memo", "%s", h.Memo)
+	line("Region", "%s (%v)", h.RegionCode, h.Regions)
+	return b.String()
+}
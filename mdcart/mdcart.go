@@ -68,6 +68,15 @@ func GetRomRegion(rom_hdr []byte) string {
 }
 
 func GetRomName(mdc memcart.MemCart) (string, error) {
+	buf, err := readHeaderBytes(mdc)
+	if err != nil {
+		return "", err
+	}
+	return GetRomNameFromHeader(buf)
+}
+
+// readHeaderBytes reads the first ROM_HDR_LEN bytes of the ROM bank
+func readHeaderBytes(mdc memcart.MemCart) ([]byte, error) {
 	var (
 		n   int
 		err error
@@ -75,21 +84,20 @@ func GetRomName(mdc memcart.MemCart) (string, error) {
 	)
 	err = mdc.SwitchBank(0)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	mdr = mdc.CurrentBank()
 	mdr.Seek(0, io.SeekStart)
-	buf := make([]byte, 512)
+	buf := make([]byte, ROM_HDR_LEN)
 	n, err = mdr.Read(buf)
-	if n < 512 {
-		return "", errors.New("short read")
+	if n < ROM_HDR_LEN {
+		return nil, errors.New("short read")
 	}
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-
-	return GetRomNameFromHeader(buf)
+	return buf, nil
 }
 
 func GetRomNameFromHeader(buf []byte) (string, error) {
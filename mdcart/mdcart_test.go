@@ -1,18 +1,24 @@
 package mdcart
 
 import (
+	"bytes"
 	//"encoding/hex"
 	//"errors"
 	"flag"
 	"fmt"
+	"github.com/grantek/fkmd/krikzz_fkmd_sim"
 	"github.com/grantek/fkmd/memcart_mock"
-	//"io"
+	"io"
+	"io/ioutil"
 	"os"
+	"reflect"
+	"strings"
 	"testing"
 )
 
 var mf *os.File
 var mmc *memcart_mock.MockMemCart
+var simulated bool
 
 func usage() {
 	flag.PrintDefaults()
@@ -26,10 +32,21 @@ func setup(m *testing.M) int {
 		f    *os.File
 		mrom *memcart_mock.MockMemBank
 	)
-	testfile := flag.String("testfile", "", "expected ROM dump from device")
+	testfile := flag.String("testfile", "", "expected ROM dump from device (default: generate a sample ROM)")
 	flag.Parse()
 	if *testfile == "" {
-		usage()
+		f, err = ioutil.TempFile("", "mdcart_test")
+		if err != nil {
+			panic(err)
+		}
+		defer os.Remove(f.Name())
+		_, err = f.Write(krikzz_fkmd_sim.SampleROM(0x20000, "TEST ROM"))
+		f.Close()
+		if err != nil {
+			panic(err)
+		}
+		*testfile = f.Name()
+		simulated = true
 	}
 	fi, err = os.Stat(*testfile)
 	if err != nil {
@@ -69,4 +86,248 @@ func TestGetRomName(t *testing.T) {
 	}
 
 	fmt.Println(fmt.Sprintf("romname: %s", romname))
+	if simulated && romname != "TEST ROM (W)" {
+		t.Errorf("GetRomName: got %q, want %q", romname, "TEST ROM (W)")
+	}
+}
+
+// sonicHeader returns a ROM header laid out like Sonic the Hedgehog's.
+func sonicHeader() []byte {
+	rom := make([]byte, ROM_HDR_LEN)
+	for i := 0x100; i < ROM_HDR_LEN; i++ {
+		rom[i] = ' '
+	}
+	copy(rom[0x100:], "SEGA MEGA DRIVE ")
+	copy(rom[0x110:], "(C)SEGA 1991.APR")
+	copy(rom[0x120:], "SONIC THE               HEDGEHOG")
+	copy(rom[0x150:], "SONIC THE               HEDGEHOG")
+	copy(rom[0x180:], "GM 00001009-00")
+	rom[0x18e], rom[0x18f] = 0x26, 0x4a
+	copy(rom[0x190:], "J")
+	copy(rom[0x1a0:], []byte{0, 0, 0, 0, 0, 0x07, 0xff, 0xff, 0, 0xff, 0, 0, 0, 0xff, 0xff, 0xff})
+	copy(rom[0x1b0:], []byte{'R', 'A', 0xf8, 0x20, 0, 0x20, 0, 0x01, 0, 0x20, 0x3f, 0xff})
+	copy(rom[0x1f0:], "JUE")
+	return rom
+}
+
+func TestParseHeader(t *testing.T) {
+	h, err := ParseHeader(sonicHeader())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &Header{
+		System:       "SEGA MEGA DRIVE",
+		Copyright:    "(C)SEGA 1991.APR",
+		DomesticName: "SONIC THE               HEDGEHOG",
+		OverseasName: "SONIC THE               HEDGEHOG",
+		ProductType:  "GM",
+		ProductCode:  "00001009",
+		Revision:     "00",
+		Checksum:     0x264a,
+		Devices:      "J",
+		ROMStart:     0,
+		ROMEnd:       0x7ffff,
+		RAMStart:     0xff0000,
+		RAMEnd:       0xffffff,
+		SRAM:         SRAM{Present: true, Type: 0xf8, Kind: SRAM_KIND_RAM, Start: 0x200001, End: 0x203fff},
+		RegionCode:   "JUE",
+		Regions:      REGION_JAPAN | REGION_AMERICAS | REGION_EUROPE,
+	}
+	if !reflect.DeepEqual(h, want) {
+		t.Errorf("ParseHeader:\ngot  %+v\nwant %+v", h, want)
+	}
+	if !h.TMSSValid() || h.Name() != "SONIC THE HEDGEHOG" || h.ROMSize() != 0x80000 {
+		t.Errorf("got TMSSValid %v, Name %q, ROMSize %#x", h.TMSSValid(), h.Name(), h.ROMSize())
+	}
+	if h.SRAM.Size() != 0x2000 || h.SRAM.Width() != SRAM_ODD || !h.SRAM.Backup() {
+		t.Errorf("SRAM: got size %#x, width %#x, backup %v", h.SRAM.Size(), h.SRAM.Width(), h.SRAM.Backup())
+	}
+	if got, want := h.SRAM.String(), "0x200001-0x203FFF, 8KiB RAM on odd bytes, battery backed"; got != want {
+		t.Errorf("SRAM.String: got %q, want %q", got, want)
+	}
+
+	if _, err = ParseHeader(make([]byte, 0x1ff)); err == nil {
+		t.Error("ParseHeader of 0x1ff bytes: no error")
+	}
+}
+
+func TestParseRegion(t *testing.T) {
+	tests := []struct {
+		code string
+		want Region
+	}{
+		{"JUE", REGION_JAPAN | REGION_AMERICAS | REGION_EUROPE},
+		{"U  ", REGION_AMERICAS},
+		{"E", REGION_EUROPE},
+		{"J\x00\x00", REGION_JAPAN},
+		{"4  ", REGION_AMERICAS},
+		{"A  ", REGION_ASIA_PAL | REGION_EUROPE},
+		{"F", REGION_JAPAN | REGION_ASIA_PAL | REGION_AMERICAS | REGION_EUROPE},
+		{"\x05", REGION_JAPAN | REGION_AMERICAS},
+		{"   ", 0},
+	}
+	for _, tt := range tests {
+		if got := ParseRegion([]byte(tt.code)); got != tt.want {
+			t.Errorf("ParseRegion(%q): got %v, want %v", tt.code, got, tt.want)
+		}
+	}
+}
+
+func TestReadHeader(t *testing.T) {
+	h, err := ReadHeader(mmc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Logf("\n%s", h)
+	if simulated && (h.Name() != "TEST ROM" || h.Regions != REGION_JAPAN|REGION_AMERICAS|REGION_EUROPE) {
+		t.Errorf("ReadHeader: got name %q, regions %v", h.Name(), h.Regions)
+	}
+
+	f, err := ioutil.TempFile("", "mdcart_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(sonicHeader())
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h, err = ReadHeaderFile(f.Name()); err != nil {
+		t.Fatal(err)
+	}
+	if h.Name() != "SONIC THE HEDGEHOG" {
+		t.Errorf("ReadHeaderFile: got name %q", h.Name())
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	rom := make([]byte, 0x205)
+	copy(rom[0x200:], []byte{0x12, 0x34, 0xff, 0xff, 0x01})
+	if got, want := Checksum(rom), uint16(0x1333); got != want {
+		t.Errorf("Checksum: got 0x%04X, want 0x%04X", got, want)
+	}
+
+	rom = krikzz_fkmd_sim.SampleROM(0x20000, "TEST ROM")
+	h, err := ParseHeader(rom)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = h.Verify(rom); err != nil {
+		t.Errorf("Verify of SampleROM: %v", err)
+	}
+	rom[0x1000]++
+	if _, ok := h.Verify(rom).(*ChecksumError); !ok {
+		t.Errorf("Verify of changed ROM: got %v, want a *ChecksumError", h.Verify(rom))
+	}
+	old, sum, err := FixChecksum(rom)
+	if err != nil || old != h.Checksum || sum != Checksum(rom) {
+		t.Errorf("FixChecksum: got 0x%04X, 0x%04X, %v", old, sum, err)
+	}
+	if h, _ = ParseHeader(rom); h.Verify(rom) != nil {
+		t.Errorf("Verify after FixChecksum: %v", h.Verify(rom))
+	}
+}
+
+// flakyReader reads like a bytes.Reader, but flips a different bit in each
+// of the first bad reads that cover off.
+type flakyReader struct {
+	*bytes.Reader
+	off int64
+	bad int
+}
+
+func (r *flakyReader) Read(p []byte) (int, error) {
+	pos, _ := r.Seek(0, io.SeekCurrent)
+	n, err := r.Reader.Read(p)
+	if r.bad > 0 && pos <= r.off && r.off < pos+int64(n) {
+		p[r.off-pos] ^= 1 << uint(r.bad%8)
+		r.bad--
+	}
+	return n, err
+}
+
+func TestVerifyDump(t *testing.T) {
+	rom := krikzz_fkmd_sim.SampleROM(0x20000, "TEST ROM")
+	tests := []struct {
+		name    string
+		bad     int
+		blocks  []int
+		wantErr bool
+	}{
+		{"good", 0, nil, false},
+		{"one bad read", 1, []int{2}, false},
+		{"two bad reads", 2, []int{2}, false},
+		{"always bad", 100, []int{2}, true},
+	}
+	for _, tt := range tests {
+		r := &flakyReader{bytes.NewReader(rom), 0x10123, tt.bad}
+		dump := make([]byte, len(rom))
+		if _, err := io.ReadFull(r, dump); err != nil {
+			t.Fatal(err)
+		}
+		got, blocks, err := VerifyDump(r, dump, 3)
+		if (err != nil) != tt.wantErr || !reflect.DeepEqual(blocks, tt.blocks) {
+			t.Errorf("%s: got blocks %v, error %v", tt.name, blocks, err)
+		}
+		if !tt.wantErr && !bytes.Equal(got, rom) {
+			t.Errorf("%s: dump differs from ROM", tt.name)
+		}
+	}
+
+	// A stale header checksum: every read agrees.
+	stale := append([]byte{}, rom...)
+	stale[0x18f]++
+	_, blocks, err := VerifyDump(bytes.NewReader(stale), stale, 3)
+	if err == nil || blocks != nil || !strings.Contains(err.Error(), "stale") {
+		t.Errorf("stale checksum: got blocks %v, error %v", blocks, err)
+	}
+}
+
+func TestRAMLayout(t *testing.T) {
+	h, err := ParseHeader(sonicHeader())
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, ok := h.SRAM.Layout()
+	want := RAMLayout{Addr: 0x200000, Width: SRAM_ODD, Size: 0x2000}
+	if !ok || l != want {
+		t.Errorf("Layout: got %+v, %v, want %+v", l, ok, want)
+	}
+	if l.Mask() != 0x00ff || l.Span(0x2000) != 0x4000 {
+		t.Errorf("got Mask %#x, Span %#x", l.Mask(), l.Span(0x2000))
+	}
+	if l.Wired(0) || !l.Wired(1) {
+		t.Errorf("odd bytes: got Wired(0) %v, Wired(1) %v", l.Wired(0), l.Wired(1))
+	}
+	if got, want := l.String(), "8KiB at 0x200000 on odd bytes"; got != want {
+		t.Errorf("String: got %q, want %q", got, want)
+	}
+
+	word := SRAM{Present: true, Type: 0xe0, Kind: SRAM_KIND_RAM, Start: 0x200000, End: 0x20ffff}
+	if l, _ = word.Layout(); l.Width != SRAM_BOTH || l.Size != 0x10000 || l.Mask() != 0xffff {
+		t.Errorf("16-bit Layout: got %+v", l)
+	}
+	eeprom := SRAM{Present: true, Type: 0xe8, Kind: SRAM_KIND_EEPROM, Start: 0x200001, End: 0x200001}
+	if _, ok = eeprom.Layout(); ok {
+		t.Error("EEPROM Layout: got ok")
+	}
+
+	tests := []struct {
+		sram   SRAM
+		probed int64
+		note   bool
+	}{
+		{h.SRAM, 0x2000, false},
+		{h.SRAM, 0x800, true},
+		{h.SRAM, 0, true},
+		{SRAM{}, 0, false},
+		{SRAM{}, 0x2000, true},
+		{eeprom, 0, true},
+	}
+	for _, tt := range tests {
+		if note := CompareRAM(tt.sram, tt.probed); (note != "") != tt.note {
+			t.Errorf("CompareRAM(%v, %#x): got %q", tt.sram, tt.probed, note)
+		}
+	}
 }
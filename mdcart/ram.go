@@ -0,0 +1,204 @@
+package mdcart
+
+import (
+	"fmt"
+	"io"
+)
+
+const (
+	// RAM_ADDR is where most carts map save RAM, and where it's probed for
+	// when the header doesn't say.
+	RAM_ADDR int64 = 0x200000
+
+	// RAM_END is the end of cart address space, where a probe for RAM
+	// stops.
+	RAM_END int64 = 0x400000
+)
+
+// RAMLayout is where a cart's save RAM is mapped and which bytes of each
+// word it's wired to.
+type RAMLayout struct {
+	Addr  int64 // bus address of the first word
+	Width byte  // SRAM_ODD, SRAM_EVEN or SRAM_BOTH
+	Size  int64 // bytes of RAM, 0 if there's none
+}
+
+// DefaultRAM is the layout of most carts' save RAM, 8-bit on the odd bytes
+// from RAM_ADDR, for probing when the header doesn't say. Its size is left
+// to the probe.
+var DefaultRAM = RAMLayout{Addr: RAM_ADDR, Width: SRAM_ODD}
+
+// Layout returns the layout of the RAM the header declares, and false if it
+// declares none the bus can read, eg. serial EEPROM.
+func (s SRAM) Layout() (RAMLayout, bool) {
+	if !s.Present || s.Kind == SRAM_KIND_EEPROM || s.Size() == 0 {
+		return RAMLayout{}, false
+	}
+	l := RAMLayout{Addr: int64(s.Start &^ 1), Width: s.Width(), Size: int64(s.Size())}
+	if l.Width != SRAM_ODD && l.Width != SRAM_EVEN {
+		l.Width = SRAM_BOTH
+	}
+	return l, true
+}
+
+// Mask returns the bits of each word read from the bus that hold RAM.
+func (l RAMLayout) Mask() uint16 {
+	switch l.Width {
+	case SRAM_ODD:
+		return 0x00ff
+	case SRAM_EVEN:
+		return 0xff00
+	}
+	return 0xffff
+}
+
+// Span returns how many bytes of address space n bytes of RAM take up.
+func (l RAMLayout) Span(n int64) int64 {
+	if l.Width == SRAM_BOTH {
+		return n
+	}
+	return n * 2
+}
+
+// Wired reports whether byte i of the Span of the RAM holds RAM, rather than
+// the half of a word 8-bit RAM isn't wired to.
+func (l RAMLayout) Wired(i int) bool {
+	switch l.Width {
+	case SRAM_ODD:
+		return i%2 == 1
+	case SRAM_EVEN:
+		return i%2 == 0
+	}
+	return true
+}
+
+func (l RAMLayout) String() string {
+	if l.Size == 0 {
+		return "none"
+	}
+	width := ", 16-bit"
+	switch l.Width {
+	case SRAM_ODD:
+		width = " on odd bytes"
+	case SRAM_EVEN:
+		width = " on even bytes"
+	}
+	return fmt.Sprintf("%s at 0x%06X%s", sizeString(int(l.Size)), l.Addr, width)
+}
+
+// RamAvailableAt reports whether the bits of mask in the word at addr hold
+// what's written to them, restoring the word after. RAM must be enabled.
+func RamAvailableAt(b Bus, addr int64, mask uint16) bool {
+	var (
+		first_word uint16
+		tmp        uint16
+		err        error
+	)
+
+	first_word, err = b.ReadWord(addr)
+	b.WriteWord(addr, uint16(first_word^0xffff))
+	tmp, err = b.ReadWord(addr)
+	if err != nil {
+		panic(err)
+	}
+	b.WriteWord(addr, first_word)
+	tmp ^= 0xffff
+	if (first_word & mask) != (tmp & mask) { //8-bit save RAM only holds one byte of the word
+		return false
+	}
+
+	return true
+}
+
+// RamLayout returns where the cart's save RAM is and how it's wired, from the
+// "RA" block of the header if it has one, otherwise found by probing at
+// DefaultRAM. The size is always probed, and if the header gives one too the
+// smaller wins: RAM smaller than declared repeats through the rest of the
+// range, and what's found past the declared range isn't the game's save. If
+// the probe finds no RAM the size is 0. The second value describes how the
+// header and the probe disagree, "" if they don't. It leaves RAM enabled.
+func RamLayout(b Bus) (RAMLayout, string) {
+	var sram SRAM
+	hdr := make([]byte, ROM_HDR_LEN)
+	b.RamDisable()
+	b.Seek(0, io.SeekStart)
+	if _, err := b.Read(hdr); err == nil {
+		if h, err := ParseHeader(hdr); err == nil {
+			sram = h.SRAM
+		}
+	}
+
+	l, ok := sram.Layout()
+	if !ok {
+		l = DefaultRAM
+	}
+	b.RamEnable()
+	probed := probeRamSize(b, l)
+	if !ok || probed < l.Size {
+		l.Size = probed
+	}
+	return l, CompareRAM(sram, probed)
+}
+
+// probeRamSize returns the size of the RAM wired as in l, by toggling words
+// at doubling offsets from l.Addr until one doesn't hold or aliases the
+// first. RAM must be enabled.
+func probeRamSize(b Bus, l RAMLayout) int64 {
+	var (
+		ram_size       int64
+		first_word     uint16
+		first_word_tmp uint16
+		tmp            uint16
+		tmp2           uint16
+		ram_type       uint16 = l.Mask()
+		err            error
+	)
+
+	if !RamAvailableAt(b, l.Addr, ram_type) {
+		return 0
+	}
+
+	first_word, err = b.ReadWord(l.Addr)
+
+	for ram_size = 256; ram_size < 0x100000 && l.Addr+ram_size < RAM_END; ram_size *= 2 {
+		tmp, err = b.ReadWord(l.Addr + ram_size)
+		b.WriteWord(l.Addr+ram_size, tmp^0xffff)
+		tmp2, err = b.ReadWord(l.Addr + ram_size)
+		first_word_tmp, err = b.ReadWord(l.Addr)
+		if err != nil {
+			panic(err)
+		}
+		b.WriteWord(l.Addr+ram_size, tmp)
+		tmp2 ^= 0xffff
+		if (tmp & ram_type) != (tmp2 & ram_type) {
+			break
+		}
+		if (first_word & ram_type) != (first_word_tmp & ram_type) {
+			break
+		}
+	}
+
+	//8-bit save RAM only takes every other byte of its address range
+	if l.Width != SRAM_BOTH {
+		return ram_size / 2
+	}
+	return ram_size
+}
+
+// CompareRAM describes how the RAM the header declares and the size a probe
+// found disagree, or returns "" if they don't. probed is the size found at
+// the header's layout if it has one, otherwise at DefaultRAM.
+func CompareRAM(s SRAM, probed int64) string {
+	l, ok := s.Layout()
+	switch {
+	case ok && probed == 0:
+		return fmt.Sprintf("header declares %v, but none was found there", l)
+	case ok && probed != l.Size:
+		return fmt.Sprintf("header declares %v, but probing found %s", l, sizeString(int(probed)))
+	case !ok && s.Present && s.Kind == SRAM_KIND_EEPROM:
+		return fmt.Sprintf("header declares serial EEPROM (%v), which can't be read as RAM", s)
+	case !ok && probed > 0:
+		return fmt.Sprintf("header declares no save RAM, but probing found %s at 0x%06X", sizeString(int(probed)), DefaultRAM.Addr)
+	}
+	return ""
+}
@@ -0,0 +1,76 @@
+package memcart
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+)
+
+// ReadBank switches mc to bank and copies all of it to w, reading blocksize
+// bytes at a time. It returns the number of bytes copied.
+func ReadBank(mc MemCart, bank int, w io.Writer, blocksize int) (int64, error) {
+	if err := mc.SwitchBank(bank); err != nil {
+		return 0, err
+	}
+	mb := mc.CurrentBank()
+	if _, err := mb.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	size := mb.Size()
+	buf := make([]byte, blocksize)
+	var n int64
+	for n < size {
+		want := int64(blocksize)
+		if size-n < want {
+			want = size - n
+		}
+		m, err := io.ReadFull(mb, buf[:want])
+		if err != nil {
+			return n, fmt.Errorf("short read at %d of %s, expected %d bytes: %v", n+int64(m), mb.Name(), size, err)
+		}
+		if _, err = w.Write(buf[:m]); err != nil {
+			return n, err
+		}
+		n += int64(m)
+	}
+	return n, nil
+}
+
+// WriteBank switches mc to bank and writes b from the start of it. Writes are
+// cut off at the end of the bank.
+func WriteBank(mc MemCart, bank int, b []byte) (int, error) {
+	if err := mc.SwitchBank(bank); err != nil {
+		return 0, err
+	}
+	mb := mc.CurrentBank()
+	if _, err := mb.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	if int64(len(b)) > mb.Size() {
+		b = b[:mb.Size()]
+	}
+	return mb.Write(b)
+}
+
+// VerifyBank switches mc to bank and checks that it starts with b.
+func VerifyBank(mc MemCart, bank int, b []byte) error {
+	if err := mc.SwitchBank(bank); err != nil {
+		return err
+	}
+	mb := mc.CurrentBank()
+	if _, err := mb.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	got := make([]byte, len(b))
+	if n, err := io.ReadFull(mb, got); err != nil {
+		return fmt.Errorf("verify: short read at %d of %s: %v", n, mb.Name(), err)
+	}
+	if !bytes.Equal(got, b) {
+		for i := range b {
+			if got[i] != b[i] {
+				return fmt.Errorf("verify failed at byte %#x of %s: read %#02x, want %#02x", i, mb.Name(), got[i], b[i])
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package memcart_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/grantek/fkmd/memcart"
+	"github.com/grantek/fkmd/memcart_mock"
+)
+
+func newCart(t *testing.T, banks ...[]byte) *memcart_mock.MockMemCart {
+	mc := &memcart_mock.MockMemCart{}
+	for i, b := range banks {
+		f, err := ioutil.TempFile("", "bank")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { f.Close(); os.Remove(f.Name()) })
+		f.Write(b)
+		mb, _ := memcart_mock.NewMemBank(string(rune('a'+i)), f, int64(len(b)))
+		mc.AddBank(mb)
+	}
+	return mc
+}
+
+func TestReadBank(t *testing.T) {
+	rom := bytes.Repeat([]byte("0123456789abcdef"), 0x100)
+	ram := []byte("save")
+	mc := newCart(t, rom, ram)
+	for _, c := range []struct {
+		bank      int
+		blocksize int
+		want      []byte
+	}{
+		{0, 0x100, rom},
+		{0, 0x300, rom},
+		{1, 0x1000, ram},
+	} {
+		var buf bytes.Buffer
+		n, err := memcart.ReadBank(mc, c.bank, &buf, c.blocksize)
+		if err != nil || n != int64(len(c.want)) || !bytes.Equal(buf.Bytes(), c.want) {
+			t.Errorf("ReadBank(%d, %#x): got %d bytes, %v", c.bank, c.blocksize, n, err)
+		}
+	}
+	if _, err := memcart.ReadBank(mc, 2, ioutil.Discard, 0x100); err == nil {
+		t.Error("ReadBank of a missing bank succeeded")
+	}
+}
+
+func TestWriteVerifyBank(t *testing.T) {
+	mc := newCart(t, make([]byte, 8))
+	n, err := memcart.WriteBank(mc, 0, []byte("0123456789"))
+	if n != 8 || err != nil {
+		t.Errorf("WriteBank past end of bank: wrote %d, %v, want 8", n, err)
+	}
+	if err = memcart.VerifyBank(mc, 0, []byte("01234567")); err != nil {
+		t.Error(err)
+	}
+	err = memcart.VerifyBank(mc, 0, []byte("0123x567"))
+	if err == nil || !strings.Contains(err.Error(), "byte 0x4") {
+		t.Errorf("VerifyBank with a difference at 4: got %v", err)
+	}
+	if err = memcart.VerifyBank(mc, 0, make([]byte, 9)); err == nil {
+		t.Error("VerifyBank past end of bank succeeded")
+	}
+}
@@ -22,13 +22,13 @@ func (mc *MockMemCart) AddBank(mb *MockMemBank) {
 	mc.banks = append(mc.banks, mb)
 }
 
-func (mc *MockMemCart) GetCurrentBank() memcart.MemBank {
+func (mc *MockMemCart) CurrentBank() memcart.MemBank {
 	return mc.banks[mc.currentbank]
 }
 
 func (mc *MockMemCart) SwitchBank(n int) error {
 	if n < 0 || n >= len(mc.banks) {
-		return errors.New(fmt.Sprintf("Requested bank %d does not exist"))
+		return errors.New(fmt.Sprintf("Requested bank %d does not exist", n))
 	}
 	mc.currentbank = n
 	return nil
@@ -52,14 +52,18 @@ func (d *MockMemBank) Seek(offset int64, whence int) (int64, error) {
 	return d.f.Seek(offset, whence)
 }
 
-func (d *MockMemBank) GetName() string {
+func (d *MockMemBank) Name() string {
 	return d.name
 }
 
-func (d *MockMemBank) GetSize() int64 {
+func (d *MockMemBank) Size() int64 {
 	return d.size
 }
 
+func (d *MockMemBank) AlwaysWritable() bool {
+	return true
+}
+
 func NewMemBank(name string, f io.ReadWriteSeeker, size int64) (*MockMemBank, error) {
 	var mb MockMemBank
 	mb.f = f
@@ -1,19 +1,25 @@
 package main
 
 import (
+	"bytes"
 	//"encoding/hex"
-	//"errors"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
-	//"io"
-	"encoding/json"
+	"image/png"
 	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
 	//"regexp"
 	"strings"
+	"time"
 
+	"github.com/grantek/fkmd/gbcart"
 	"github.com/grantek/fkmd/gbcf"
+	"github.com/grantek/fkmd/memcart"
+	"github.com/grantek/fkmd/transport"
 	"github.com/jacobsa/go-serial/serial"
 )
 
@@ -29,15 +35,345 @@ func usage() {
 	os.Exit(-1)
 }
 
-func main() {
+// CartName returns a file name for the cart from its header.
+func CartName(gbci *gbcf.GBCartInfo) string {
+	r := strings.NewReplacer("/", "_", " ", "_")
+	cartname := r.Replace(strings.TrimSpace(string(gbci.GameNamePrintable)))
+	if cartname == "" {
+		cartname = "game"
+	}
+	return cartname
+}
+
+// BackupName returns a timestamped file name to back up RAM to, based on
+// ramfile if one was given or the cart name if not.
+func BackupName(ramfile string, cartname string, t time.Time) string {
+	base := cartname
+	if ramfile != "" && ramfile != "-" {
+		base = strings.TrimSuffix(ramfile, filepath.Ext(ramfile))
+	}
+	return fmt.Sprintf("%s-%s.sav", base, t.Format("20060102-150405"))
+}
+
+// EraseRam saves the RAM bank of mc to backup, then erases it.
+func EraseRam(d *gbcf.GBCF, mc memcart.MemCart, backup string) error {
+	var buf bytes.Buffer
+	ilog.Println("RAM backup...")
+	n, err := memcart.ReadBank(mc, 1, &buf, gbcf.RAM_PAGE_SIZE)
+	if err != nil {
+		return fmt.Errorf("backing up RAM before erase: %v", err)
+	}
+	// O_EXCL: never overwrite an earlier backup
+	f, err := os.OpenFile(backup, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = buf.WriteTo(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	ilog.Printf("Saved %d bytes of RAM to %s", n, backup)
+
+	ilog.Println("RAM erase...")
+	if err = d.EraseRAM(); err != nil {
+		return err
+	}
+	ilog.Println("OK")
+	return nil
+}
+
+// WriteRom erases a flash cart, writes romfile to it and reads it back to
+// verify. If dci reports the boot block locked, the image has to match what
+// the cart already has there, see gbcf.CheckBootBlock.
+func WriteRom(d *gbcf.GBCF, dci *gbcf.DeviceCartInfo, romfile string) error {
+	var (
+		f   *os.File
+		err error
+	)
+
+	if romfile == "-" {
+		f = os.Stdin
+		romfile = "stdin"
+	} else {
+		f, err = os.Open(romfile)
+		if err != nil {
+			return err
+		}
+		ilog.Println("Opened", romfile, "for reading")
+		defer f.Close()
+	}
+
+	filebuf, err := ioutil.ReadAll(f)
+	if err != nil {
+		return err
+	}
+	fblen := len(filebuf)
+	ilog.Printf("Read %d bytes from file", fblen)
+	if fblen < 0x8000 {
+		return errors.New("File size < 32KiB, pad with 0xFF if required")
+	}
+	// Whole 16KiB pages are written, pad with erased flash.
+	for len(filebuf)%0x4000 != 0 {
+		filebuf = append(filebuf, 0xff)
+	}
+
+	if dci != nil && dci.BBL {
+		sector, _ := dci.LockedRegion()
+		ilog.Printf("Boot block 0x%06X-0x%06X is locked, checking the image leaves it unchanged", sector.Addr, sector.Addr+sector.Size-1)
+		if err = d.CheckBootBlock(dci, filebuf); err != nil {
+			return err
+		}
+	}
+
+	ilog.Println("Flash erase...")
+	if err = d.EraseFlash(); err != nil {
+		return err
+	}
+
+	ilog.Println("Flash write...")
+	if err = d.WriteROM(filebuf); err != nil {
+		return err
+	}
+
+	ilog.Println("Flash verify...")
+	mc := d.GBCart(int64(len(filebuf)), 0)
+	if err = memcart.VerifyBank(mc, 0, filebuf[:fblen]); err != nil {
+		return err
+	}
+
+	ilog.Println("OK")
+	return nil
+}
+
+// FileInfo prints the header of the ROM image in romfile.
+func FileInfo(romfile string) error {
+	f, err := os.Open(romfile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	b, err := ioutil.ReadAll(f)
+	if err != nil {
+		return err
+	}
+	h, err := gbcart.ParseHeader(b)
+	if err != nil {
+		return fmt.Errorf("%s: %v", romfile, err)
+	}
+	if !h.LogoCorrect() {
+		elog.Printf("%s: %v", romfile, gbcart.ErrNoHeader)
+	}
+	j, err := json.MarshalIndent(h.GBCartInfo(), "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s header:\n%s\n", romfile, string(j))
+	if err = h.Verify(b); err != nil {
+		fmt.Printf("Checksums: %v\n", err)
+	} else {
+		fmt.Println("Checksums: OK")
+	}
+	return nil
+}
+
+// CheckHeader warns about differences between the cart info the device
+// reported and the header of the ROM it dumped.
+func CheckHeader(gbci *gbcf.GBCartInfo, rom []byte) {
+	hdr, err := gbcart.Parse(rom)
+	if err != nil {
+		elog.Printf("Dumped ROM: %v", err)
+		return
+	}
+	for _, d := range gbci.Diff(hdr) {
+		elog.Printf("WARNING: device and dumped header disagree on %s", d)
+	}
+}
+
+// ReadRom dumps the ROM of mc to romfile, - for stdout, after checking its
+// checksums. Banks of a dump that fails them are read again up to rereads
+// times. gbci is the cart info from the device to compare the header with,
+// if it was read. probed is the ROM read by -probesize, used instead of
+// dumping it again if it's the whole ROM.
+func ReadRom(mc memcart.MemCart, romfile string, gbci *gbcf.GBCartInfo, rereads int, probed []byte) error {
+	if err := mc.SwitchBank(0); err != nil {
+		return err
+	}
+	var (
+		rom []byte
+		err error
+	)
+	if size := int(mc.CurrentBank().Size()); len(probed) == size {
+		ilog.Printf("Using the %d bytes read probing the ROM size", size)
+		rom = probed
+	} else {
+		var buf bytes.Buffer
+		var n int64
+		n, err = memcart.ReadBank(mc, 0, &buf, size)
+		ilog.Printf("Read %d bytes", n)
+		rom = buf.Bytes()
+	}
+	if err != nil {
+		elog.Println(err)
+	} else {
+		if gbci != nil {
+			CheckHeader(gbci, rom)
+		}
+		ilog.Println("Checksum verify...")
+		var banks []int
+		rom, banks, err = gbcart.VerifyDump(mc, rom, rereads)
+		if len(banks) > 0 {
+			elog.Printf("Banks that changed between reads (check the cart contacts): %v", banks)
+		}
+		if err != nil {
+			elog.Printf("WARNING: %v", err)
+		} else {
+			ilog.Println("OK")
+		}
+		if gbci != nil && err == nil && gbcart.GlobalChecksum(rom) != gbci.CRC16 {
+			elog.Printf("WARNING: global checksum 0x%04X doesn't match 0x%04X reported by the device", gbcart.GlobalChecksum(rom), gbci.CRC16)
+		}
+	}
+
+	f := os.Stdout
+	if romfile != "-" {
+		f, err = os.Create(romfile)
+		if err != nil {
+			return err
+		}
+		ilog.Println("Opened", romfile, "for writing")
+		defer f.Close()
+	}
+	_, err = f.Write(rom)
+	return err
+}
+
+// HasRTC reports whether the cart keeps an MBC3 clock. The GBCF can't read
+// or set it, so it isn't saved with the RAM.
+func HasRTC(gbci *gbcf.GBCartInfo) bool {
+	return gbci != nil && gbci.Type.MBC == gbcart.MBC3 && gbci.Type.Timer
+}
+
+// ReadRam saves the RAM bank of mc to ramfile, - for stdout, and returns the
+// RAM it read.
+func ReadRam(mc memcart.MemCart, ramfile string, ramsize int) ([]byte, error) {
+	var buf bytes.Buffer
+	n, err := memcart.ReadBank(mc, 1, &buf, ramsize)
+	ilog.Printf("Read %d bytes", n)
+	if err != nil {
+		return nil, err
+	}
+	if ramfile == "-" {
+		_, err = os.Stdout.Write(buf.Bytes())
+		return buf.Bytes(), err
+	}
+	ilog.Println("Writing", ramfile)
+	return buf.Bytes(), ioutil.WriteFile(ramfile, buf.Bytes(), 0644)
+}
+
+// SavePhotos writes the photos in Game Boy Camera save RAM to dir as PNG
+// files, photo_NN.png in album order and deleted_NN.png by slot for what's
+// left in free slots.
+func SavePhotos(ram []byte, dir string) error {
+	photos, err := gbcart.CameraPhotos(ram)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	saved := 0
+	used := map[string]bool{}
+	for _, p := range photos {
+		name := fmt.Sprintf("photo_%02d.png", p.Album+1)
+		if used[name] {
+			// two slots in the same place in a corrupt album
+			name = fmt.Sprintf("photo_%02d_slot_%02d.png", p.Album+1, p.Slot+1)
+		}
+		if p.Deleted() {
+			name = fmt.Sprintf("deleted_%02d.png", p.Slot+1)
+		} else {
+			saved++
+		}
+		used[name] = true
+		f, err := os.Create(filepath.Join(dir, name))
+		if err != nil {
+			return err
+		}
+		if err = png.Encode(f, p.Image); err != nil {
+			f.Close()
+			return err
+		}
+		if err = f.Close(); err != nil {
+			return err
+		}
+	}
+	ilog.Printf("Saved %d photos and %d deleted slots to %s", saved, len(photos)-saved, dir)
+	return nil
+}
+
+// WriteRam writes ramfile to the RAM bank of mc, - for stdin, and reads it
+// back to verify. An emulator's clock footer on the file is left off, the
+// GBCF can't set the clock.
+func WriteRam(mc memcart.MemCart, ramfile string, ramsize int) error {
 	var (
+		b   []byte
 		err error
 	)
+	if ramfile == "-" {
+		b, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		b, err = ioutil.ReadFile(ramfile)
+	}
+	if err != nil {
+		return err
+	}
+	b, footer, err := gbcart.SplitSave(b, ramsize)
+	if err != nil {
+		return err
+	}
+	if footer != nil {
+		elog.Println("ramfile has a clock footer, which the GBCF can't set, ignoring it.")
+	}
+	if ramsize == gbcart.MBC2_RAM_SIZE {
+		// only MBC2 has 512 bytes, whatever saved the file may have left
+		// the upper 4 bits of each 0
+		b = append([]byte{}, b...)
+		gbcart.NormalizeMBC2RAM(b)
+	}
+	n, err := memcart.WriteBank(mc, 1, b)
+	if err != nil {
+		return err
+	}
+	if len(b) > n {
+		elog.Printf("ramfile (%d bytes) > ramsize (%d bytes), write was limited to ramsize.", len(b), ramsize)
+	}
+	if len(b) < ramsize {
+		elog.Printf("ramfile (%d bytes) < ramsize (%d bytes).", len(b), ramsize)
+	}
+	ilog.Println("Verify...")
+	if err = memcart.VerifyBank(mc, 1, b[:n]); err != nil {
+		return err
+	}
+	ilog.Printf("Verified %d bytes", n)
+	return nil
+}
+
+func main() {
+	var (
+		err       error
+		probedROM []byte
+	)
 
 	//options
-	port := flag.String("port", "/dev/ttyUSB0", "serial port to use (/dev/ttyUSB0, etc)")
+	port := flag.String("port", "/dev/ttyUSB0", "serial port to use (/dev/ttyUSB0, etc), or tcp://host:port for a network bridge")
+	record := flag.String("record", "", "Write a transcript of all serial traffic to this file")
 
-	baud := flag.Uint("baud", 185000, "Baud rate")
+	speedname := flag.String("speed", "standard", "Link speed: low (125000 baud), standard (185000) or high (375000), lowered automatically on errors")
+	retries := flag.Int("retries", gbcf.RETRIES, "Times to retry a bad or missing packet before giving up")
+	rereads := flag.Int("rereads", 3, "Times to read the ROM again if a dump fails its checksums")
 	/*
 		//serial options, shouldn't be needed
 		even := flag.Bool("even", false, "enable even parity")
@@ -51,8 +387,6 @@ func main() {
 		minread := flag.Uint("minread", 0, "Minimum read count")
 	*/
 
-	//baud := new(uint)
-	//*baud = 115200
 	//even := new(bool); *even = false
 	//odd := new(bool); *odd = false
 	parity := serial.PARITY_NONE
@@ -73,18 +407,23 @@ func main() {
 
 	//sfgb options
 	rominfo := flag.Bool("rominfo", false, "Print ROM info")
+	fileinfo := flag.Bool("fileinfo", false, "Print the header of the ROM image in -romfile, without using the device")
+	photos := flag.String("photos", "", "Save Game Boy Camera photos as PNG files in this directory, from the RAM read with -readram or else from -ramfile without using the device")
 	readrom := flag.Bool("readrom", false, "Read and save ROM")
 	writerom := flag.Bool("writerom", false, "(Flash cart only) Write ROM data to flash")
 	readram := flag.Bool("readram", false, "Read and save RAM")
 	writeram := flag.Bool("writeram", false, "Write supplied RAM data to cartridge")
+	eraseram := flag.Bool("eraseram", false, "Erase cartridge RAM, after saving a timestamped backup")
 	autoname := flag.Bool("autoname", false, "Read ROM name and generate filenames to save ROM/RAM data")
-	//mbc := flag.String("mbc", "auto", "")
+	mbc := flag.String("mbc", "auto", "Override the MBC type: auto, mbc1, mbc2, mbc3, romonly, mbc5 or rumble")
+	alg := flag.String("alg", "16", "Flash algorithm: 16, or 12 for chips using 12-bit command addresses")
 	romfile := flag.String("romfile", "", "File to save or read ROM data (- for STDOUT/STDIN)")
 	ramfile := flag.String("ramfile", "", "File to save or read RAM data (- for STDOUT/STDIN)")
 	ramsize := flag.Int("ramsize", 0, "Size of RAM (0 to autodetect)")
 	romsize := flag.Int("romsize", 0, "Size of ROM (0 to autodetect)")
+	probesize := flag.Bool("probesize", false, "Detect the ROM size by reading until it mirrors, for carts with a wrong header, and print it with the header's")
 	verbose := flag.Bool("verbose", false, "Output info logs to stderr")
-	debug := flag.Bool("debug", false, "Output debug logs to stderr (implies verbose)")
+	debug := flag.Bool("debug", false, "Output debug logs and a protocol trace to stderr (implies verbose)")
 
 	flag.Parse()
 
@@ -110,6 +449,11 @@ func main() {
 		usage()
 	}
 
+	if *eraseram && *writeram {
+		elog.Println("Can't erase and write cartridge RAM in one invocation")
+		usage()
+	}
+
 	if *readrom && *writerom {
 		elog.Println("Can't read and write cartridge ROM in one invocation")
 		usage()
@@ -130,14 +474,57 @@ func main() {
 		usage()
 	}
 
-	if !*readrom && !*writerom && !*readram && !*writeram && !*rominfo {
+	if !*readrom && !*writerom && !*readram && !*writeram && !*eraseram && !*rominfo && !*fileinfo && *photos == "" && !*probesize {
 		elog.Println("No action specified")
 		usage()
 	}
 
+	if *fileinfo {
+		if *romfile == "" {
+			elog.Println("No ROM file name supplied")
+			usage()
+		}
+		if err = FileInfo(*romfile); err != nil {
+			elog.Println(err)
+			os.Exit(1)
+		}
+		if !*readrom && !*writerom && !*readram && !*writeram && !*eraseram && !*rominfo && *photos == "" && !*probesize {
+			return
+		}
+	}
+
+	if *photos != "" && !*readram {
+		if *ramfile == "" || *ramfile == "-" {
+			elog.Println("No RAM file name supplied to read photos from")
+			usage()
+		}
+		b, err := ioutil.ReadFile(*ramfile)
+		if err != nil {
+			elog.Println(err)
+			os.Exit(1)
+		}
+		// ignore anything an emulator appended past the RAM
+		if len(b) > gbcart.CAMERA_RAM_SIZE {
+			b = b[:gbcart.CAMERA_RAM_SIZE]
+		}
+		if err = SavePhotos(b, *photos); err != nil {
+			elog.Println(err)
+			os.Exit(1)
+		}
+		if !*readrom && !*writerom && !*writeram && !*eraseram && !*rominfo && !*probesize {
+			return
+		}
+	}
+
+	speed, err := gbcf.ParseSpeed(*speedname)
+	if err != nil {
+		elog.Println(err)
+		usage()
+	}
+
 	options := serial.OpenOptions{
 		PortName:               *port,
-		BaudRate:               *baud,
+		BaudRate:               gbcf.SpeedBauds[speed],
 		DataBits:               *databits,
 		StopBits:               *stopbits,
 		MinimumReadSize:        *minread,
@@ -150,9 +537,33 @@ func main() {
 
 	var d = &gbcf.GBCF{}
 	d.SetOptions(options)
-	//var mdc memcart.MemCart
-	//mdc, err = d.MemCart()
-
+	d.SetRetries(*retries)
+	if m, err := gbcf.ParseMBC(*mbc); err != nil {
+		elog.Println(err)
+		usage()
+	} else {
+		d.SetMBC(m)
+	}
+	if a, err := gbcf.ParseAlgorithm(*alg); err != nil {
+		elog.Println(err)
+		usage()
+	} else {
+		d.SetAlgorithm(a)
+	}
+	opener := transport.ForPort(*port)
+	if *record != "" {
+		tf, err := os.Create(*record)
+		if err != nil {
+			elog.Println("Error creating transcript file: ", err)
+			os.Exit(-1)
+		}
+		defer tf.Close()
+		opener = transport.Record(opener, tf)
+	}
+	if *debug {
+		opener = transport.Trace(opener, gbcf.NewDecoder(), dlog.Printf)
+	}
+	d.SetOpener(opener)
 	err = d.Connect()
 	if err != nil {
 		elog.Print("Error opening serial port: ", err)
@@ -160,10 +571,16 @@ func main() {
 	} else {
 		defer d.Disconnect()
 	}
+	if speed != gbcf.STANDARD {
+		// check the device answers at it, or find one it does
+		if err = d.SetSpeed(speed); err != nil {
+			elog.Println(err)
+		}
+	}
 
 	var dci *gbcf.DeviceCartInfo
 	var gbci *gbcf.GBCartInfo
-	if *rominfo || *autoname || (*ramsize == 0) || (*romsize == 0) {
+	if *rominfo || *autoname || *eraseram || *readram || *writeram || *writerom || *probesize || (*ramsize == 0) || (*romsize == 0) {
 		fv, err := d.ReadDeviceStatus()
 		if err != nil {
 			elog.Printf("ReadDeviceStatus: %v", err)
@@ -183,6 +600,7 @@ func main() {
 			elog.Println(err)
 			os.Exit(-1)
 		}
+		gbci = dci.GBCartInfo()
 		if *rominfo {
 			b, err := json.MarshalIndent(dci, "", "  ")
 			if err != nil {
@@ -190,26 +608,38 @@ func main() {
 			}
 			dlog.Printf("Raw cart status:\n%s\n", string(b))
 
-			gbci = dci.GBCartInfo()
 			b, err = json.MarshalIndent(gbci, "", "  ")
 			if err != nil {
 				fmt.Println("MarshallIndent: ", err)
 			}
 			fmt.Printf("Cart status:\n%s\n", string(b))
 		}
+		rom, ram, err := dci.Sizes()
+		if err != nil && (*romsize == 0 || *ramsize == 0) {
+			elog.Printf("Cart header: %v, set -romsize and -ramsize if autodetection is wrong.", err)
+		}
+		if *probesize {
+			var probed int
+			probed, probedROM, err = d.GetRomSize(rom)
+			if err != nil {
+				elog.Printf("Probing ROM size: %v", err)
+				os.Exit(1)
+			}
+			fmt.Printf("ROM size: header %s, detected %s\n", gbcart.SizeString(rom), gbcart.SizeString(probed))
+			if probed != rom {
+				elog.Printf("ROM mirrors at %s, header says %s: using %s", gbcart.SizeString(probed), gbcart.SizeString(rom), gbcart.SizeString(probed))
+			}
+			rom = probed
+		}
 		if *romsize == 0 {
-			*romsize = gbcf.RomSizeBytes[dci.ROMSize]
+			*romsize = rom
 		}
 		if *ramsize == 0 {
-			*ramsize = gbcf.RamSizeBytes[dci.RAMSize]
+			*ramsize = ram
 		}
 	}
 	if *autoname {
-		r := strings.NewReplacer("/", "_", " ", "_")
-		cartname := r.Replace(strings.TrimSpace(string(gbci.GameNamePrintable)))
-		if cartname == "" {
-			cartname = "game"
-		}
+		cartname := CartName(gbci)
 		suffix := "gb"
 		if dci.CGB {
 			suffix = "gbc"
@@ -218,40 +648,50 @@ func main() {
 		*ramfile = cartname + ".sav"
 	}
 
+	mc := d.GBCart(int64(*romsize), int64(*ramsize))
+
+	if HasRTC(gbci) && (*readram || *writeram) {
+		elog.Println("The cart has an MBC3 clock, which the GBCF can't read or set: only its RAM is saved or restored.")
+	}
+
 	if *readram {
 		if *ramsize == 0 {
 			elog.Println("Cartridge RAM not detected (force attempt to read by setting explicit -ramsize).")
 			os.Exit(1)
 		}
 		dlog.Printf("Using ramfile: %s\n", *ramfile)
-		b := make([]byte, *ramsize)
-		err = d.ReadRAM(b)
+		ram, err := ReadRam(mc, *ramfile, *ramsize)
 		if err != nil {
 			elog.Println(err)
+		} else if *photos != "" {
+			if gbci != nil && gbci.Type.MBC != gbcart.POCKET_CAMERA {
+				elog.Printf("Not a Game Boy Camera (%s), trying to save photos anyway.", gbci.CartType)
+			}
+			if err = SavePhotos(ram, *photos); err != nil {
+				elog.Println(err)
+			}
 		}
-		ioutil.WriteFile(*ramfile, b, 0644)
 	}
 
-	if *writeram {
+	if *eraseram {
 		if *ramsize == 0 {
-			elog.Println("Cartridge RAM not detected (force attempt to write by setting explicit -ramsize).")
+			elog.Println("Cartridge RAM not detected (force attempt to erase by setting explicit -ramsize).")
 			os.Exit(1)
 		}
-		dlog.Printf("Using ramfile: %s\n", *ramfile)
-		b, err := ioutil.ReadFile(*ramfile)
+		err = EraseRam(d, mc, BackupName(*ramfile, CartName(gbci), time.Now()))
 		if err != nil {
-			elog.Print(err)
+			elog.Println(err)
 			os.Exit(1)
 		}
-		have := len(b)
-		if have > *ramsize {
-			elog.Printf("ramfile (%d bytes) > ramsize (%d bytes), write will be limited to ramsize.", have, *ramsize)
-			b = b[:*ramsize]
-		}
-		if have < *ramsize {
-			elog.Printf("ramfile (%d bytes) < ramsize (%d bytes).", have, *ramsize)
+	}
+
+	if *writeram {
+		if *ramsize == 0 {
+			elog.Println("Cartridge RAM not detected (force attempt to write by setting explicit -ramsize).")
+			os.Exit(1)
 		}
-		err = d.WriteRAM(b)
+		dlog.Printf("Using ramfile: %s\n", *ramfile)
+		err = WriteRam(mc, *ramfile, *ramsize)
 		if err != nil {
 			elog.Print(err)
 			os.Exit(1)
@@ -263,17 +703,26 @@ func main() {
 			elog.Println("Cartridge ROM not detected (force attempt to read by setting explicit -romsize).")
 			os.Exit(1)
 		}
-		dlog.Printf("Using romfile: %s\n", *ramfile)
-		b := make([]byte, *romsize)
-		err = d.ReadROM(b)
+		dlog.Printf("Using romfile: %s\n", *romfile)
+		err = ReadRom(mc, *romfile, gbci, *rereads, probedROM)
 		if err != nil {
 			elog.Println(err)
 		}
-		ioutil.WriteFile(*romfile, b, 0644)
 	}
 
 	if *writerom {
-		//WriteRom(mdc, *romfile)
-		elog.Println("writerom not implemented")
+		dlog.Printf("Using romfile: %s\n", *romfile)
+		err = WriteRom(d, dci, *romfile)
+		if err != nil {
+			elog.Println(err)
+			os.Exit(1)
+		}
+	}
+
+	if e := d.Errors(); e.Total() > 0 {
+		elog.Printf("Recovered from transfer errors: %s", e)
+	}
+	if d.Speed() < speed {
+		elog.Printf("Link speed was lowered to %d baud after errors", gbcf.SpeedBauds[d.Speed()])
 	}
 }
@@ -1,11 +1,11 @@
 package main
 
 import (
+	"bytes"
 	//"encoding/hex"
 	"errors"
 	"flag"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"log"
 	"os"
@@ -15,6 +15,7 @@ import (
 	"github.com/grantek/fkmd/krikzz_fkmd"
 	"github.com/grantek/fkmd/mdcart"
 	"github.com/grantek/fkmd/memcart"
+	"github.com/grantek/fkmd/transport"
 	"github.com/jacobsa/go-serial/serial"
 )
 
@@ -30,17 +31,51 @@ func usage() {
 	os.Exit(-1)
 }
 
+// PrintHeader prints every field of a ROM header.
+func PrintHeader(h *mdcart.Header) {
+	if !h.TMSSValid() {
+		elog.Printf("WARNING: system %q doesn't start with SEGA, the console may not boot it", h.System)
+	}
+	fmt.Print(h)
+}
+
+// FileInfo prints the header of the ROM image in romfile, and checks its
+// checksum.
+func FileInfo(romfile string) error {
+	rom, err := ioutil.ReadFile(romfile)
+	if err != nil {
+		return err
+	}
+	h, err := mdcart.ParseHeader(rom)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s header:\n", romfile)
+	PrintHeader(h)
+	if err = h.Verify(rom); err != nil {
+		elog.Printf("WARNING: %v, use -fixchecksum to correct the header", err)
+	} else {
+		fmt.Println("Checksum OK")
+	}
+	return nil
+}
+
+// RAM is read in blocks of this size.
+const RAM_BLOCK_SIZE = 8192
+
 //md specific
-func ReadRom(mdc memcart.MemCart, romfile string, autoname bool) {
+
+// ReadRom dumps the ROM of mdc to romfile, - for stdout, after checking its
+// checksum. Blocks of a dump that fails it are read again up to rereads
+// times.
+func ReadRom(mdc memcart.MemCart, romfile string, autoname bool, rereads int) error {
 	var (
 		romname   string
-		romsize   int64
-		blocksize int64 = 32768
+		blocksize int = 32768
+		buf       bytes.Buffer
 		f         *os.File
-		n         int64 //counter for outer read in bytes
-		m         int   //counter for inner read in bytes
+		n         int64
 		err       error
-		mdr       memcart.MemBank
 	)
 	if autoname {
 		romname, err = mdcart.GetRomName(mdc)
@@ -53,56 +88,70 @@ func ReadRom(mdc memcart.MemCart, romfile string, autoname bool) {
 		romfile = fmt.Sprintf("%s.bin", romname)
 	}
 
-	err = mdc.SwitchBank(0)
+	n, err = memcart.ReadBank(mdc, 0, &buf, blocksize)
+	ilog.Printf("Finished reading, bytes read: %d", n)
+	rom := buf.Bytes()
 	if err != nil {
-		panic(err)
+		elog.Println(err)
+	} else {
+		ilog.Println("Checksum verify...")
+		var blocks []int
+		rom, blocks, err = mdcart.VerifyDump(mdc.CurrentBank(), rom, rereads)
+		if len(blocks) > 0 {
+			elog.Printf("Blocks of %d bytes that changed between reads (check the cart contacts): %v", mdcart.BLOCK_SIZE, blocks)
+		}
+		if err != nil {
+			elog.Printf("WARNING: %v", err)
+		} else {
+			ilog.Println("OK")
+		}
 	}
-	mdr = mdc.CurrentBank()
+
 	if romfile == "-" {
 		f = os.Stdout
 	} else {
 		f, err = os.Create(romfile)
 		if err != nil {
-			panic(err)
+			return err
 		}
 		ilog.Println("Opened", romfile, "for writing")
 		defer f.Close()
 	}
+	_, err = f.Write(rom)
+	return err
+}
 
-	romsize = mdr.Size()
-	mdr.Seek(0, io.SeekStart)
-	buf := make([]byte, blocksize)
-	for n = 0; n < romsize; n += blocksize {
-		dlog.Printf("Bytes read: %d", n)
-		m, err = mdr.Read(buf)
-		if err != nil {
-			panic(err)
-		}
-		if int64(m) < blocksize {
-			elog.Printf("Short read at %d, expected romsize %d", n+int64(m), romsize)
-			break
-		}
-		f.Write(buf[0:m])
+// FixChecksum rewrites the header checksum of the ROM image in romfile to
+// match its contents, for images that have been patched.
+func FixChecksum(romfile string) error {
+	rom, err := ioutil.ReadFile(romfile)
+	if err != nil {
+		return err
 	}
-	ilog.Printf("Finished reading, bytes read: %d", n)
+	old, sum, err := mdcart.FixChecksum(rom)
+	if err != nil {
+		return err
+	}
+	if old == sum {
+		fmt.Printf("%s: checksum 0x%04X is already correct\n", romfile, sum)
+		return nil
+	}
+	if err = ioutil.WriteFile(romfile, rom, 0644); err != nil {
+		return err
+	}
+	fmt.Printf("%s: checksum changed from 0x%04X to 0x%04X\n", romfile, old, sum)
+	return nil
 }
 
 func ReadRam(mdc memcart.MemCart, ramfile string, autoname bool) {
 	var (
-		err  error
-		f    *os.File
-		n, m int
-		mdr  memcart.MemBank
+		err error
+		f   *os.File
+		n   int64
 	)
 
-	err = mdc.SwitchBank(1)
-	if err != nil {
-		panic(err)
-	}
-
-	mdr = mdc.CurrentBank()
-	if mdr == nil {
-		panic("Current Bank is nil")
+	if mdc.NumBanks() < 2 {
+		panic("RAM not detected on cartridge for reading")
 	}
 
 	if ramfile == "" {
@@ -120,33 +169,43 @@ func ReadRam(mdc memcart.MemCart, ramfile string, autoname bool) {
 		defer f.Close()
 	}
 
-	ramsize := mdr.Size()
-	buf := make([]byte, ramsize)
-
-	for n < int(ramsize) {
-		m, err = mdr.Read(buf[n:])
-		n += m
-		if err != nil || m == 0 {
-			panic(fmt.Sprintf("Short RAM read, read %d bytes", n+m))
-		}
+	n, err = memcart.ReadBank(mdc, 1, f, RAM_BLOCK_SIZE)
+	if err != nil {
+		panic(err)
 	}
 	ilog.Printf("Read %d bytes", n)
-	f.Write(buf)
 	ilog.Printf("Ok")
 }
 
-func WriteRam(mdc memcart.MemCart, ramfile string) {
+// VerifyRam checks that the RAM bank of mdc starts with b, a save as read
+// from the bus, skipping the byte of each word 8-bit RAM isn't wired to.
+func VerifyRam(mdc memcart.MemCart, layout mdcart.RAMLayout, b []byte) error {
+	var buf bytes.Buffer
+	if _, err := memcart.ReadBank(mdc, 1, &buf, RAM_BLOCK_SIZE); err != nil {
+		return err
+	}
+	got := buf.Bytes()
+	if len(got) < len(b) {
+		return fmt.Errorf("verify: read %d bytes of RAM, want %d", len(got), len(b))
+	}
+	for i, v := range b {
+		if layout.Wired(i) && got[i] != v {
+			return fmt.Errorf("verify failed at byte %#x of RAM: read %#02x, want %#02x", i, got[i], v)
+		}
+	}
+	return nil
+}
+
+func WriteRam(mdc memcart.MemCart, ramfile string, layout mdcart.RAMLayout) {
 	var (
-		f         *os.File
-		n         int
-		ram, ram2 []byte
-		err       error
+		f   *os.File
+		n   int
+		ram []byte
+		err error
 	)
 	if mdc.NumBanks() < 2 {
 		panic("RAM not detected on cartridge for writing")
 	}
-	mdc.SwitchBank(1)
-	mdr := mdc.CurrentBank()
 
 	if ramfile == "-" {
 		f = os.Stdin
@@ -163,7 +222,7 @@ func WriteRam(mdc memcart.MemCart, ramfile string) {
 	if err != nil {
 		panic(err)
 	}
-	n, err = mdr.Write(ram)
+	n, err = memcart.WriteBank(mdc, 1, ram)
 	if err != nil {
 		panic(err)
 	}
@@ -171,16 +230,12 @@ func WriteRam(mdc memcart.MemCart, ramfile string) {
 	if n < len(ram) {
 		elog.Printf("WARNING: wrote %d bytes, input is %d bytes.\n", n, len(ram))
 	}
-	if int64(n) < mdr.Size() {
-		elog.Printf("WARNING: wrote %d bytes, cartridge RAM is %d bytes.\n", n, len(ram))
+	if ramsize := mdc.CurrentBank().Size(); int64(n) < ramsize {
+		elog.Printf("WARNING: wrote %d bytes, cartridge RAM is %d bytes.\n", n, ramsize)
 	}
 	ilog.Println("Verify...")
-	mdr.Seek(0, io.SeekStart)
-	for i := 0; i < n; i++ {
-		//TODO: check word length here
-		if ram[i] != ram2[i] {
-			panic(fmt.Sprintf("Failed verification at byte %d", i))
-		}
+	if err = VerifyRam(mdc, layout, ram[:n]); err != nil {
+		panic(err)
 	}
 	ilog.Printf("Verified %d bytes", n)
 }
@@ -218,16 +273,16 @@ func WriteRom(mdc memcart.MemCart, romfile string) error {
 	}
 
 	romsize = int64(len(filebuf))
-	ilog.Println("Read %d bytes from file", len(filebuf))
+	ilog.Printf("Read %d bytes from file", len(filebuf))
 
 	if romsize%2 == 1 {
-		elog.Printf("WARNING: file size in bytes is odd", mdcart.MAX_ROM_SIZE, romsize)
+		elog.Printf("WARNING: file size in bytes is odd: %d", romsize)
 		filebuf = append(filebuf, 0)
 		romsize++
 	}
 
 	if romsize > mdcart.MAX_ROM_SIZE {
-		elog.Printf("WARNING: Max ROM data size is %x, cropping input\n", mdcart.MAX_ROM_SIZE, romsize)
+		elog.Printf("WARNING: Max ROM data size is %x, have %x, cropping input\n", mdcart.MAX_ROM_SIZE, romsize)
 		romsize = mdcart.MAX_ROM_SIZE
 	}
 
@@ -236,12 +291,22 @@ func WriteRom(mdc memcart.MemCart, romfile string) error {
 		return errors.New("File size < 32KiB, pad with 0xFF if required")
 	}
 
-	if romsize%0x10000 != 0 {
-		romsize = (romsize/0x10000)*0x10000 + 0x10000
+	if err = mdc.SwitchBank(0); err != nil {
+		return err
 	}
-
-	mdc.SwitchBank(0)
 	mdr := mdc.CurrentBank()
+	if m, ok := mdr.(*krikzz_fkmd.MDROM); ok {
+		chip, err := m.FlashChip()
+		if err != nil {
+			return err
+		}
+		if chip.Known() {
+			ilog.Println("Flash chip:", chip)
+			if fblen > int64(chip.Size) {
+				return fmt.Errorf("%s is %d bytes, larger than the %d byte flash chip %v", romfile, fblen, chip.Size, chip)
+			}
+		}
+	}
 
 	//Going to rely on Write() performing block erasure
 	ilog.Println("Flash write...")
@@ -249,27 +314,15 @@ func WriteRom(mdc memcart.MemCart, romfile string) error {
 		if i+blocklen > fblen {
 			blocklen = fblen - i
 		}
-		//TODO: n, err
-		mdr.Write(filebuf[i : i+blocklen])
+		if _, err = mdr.Write(filebuf[i : i+blocklen]); err != nil {
+			return err
+		}
 		dlog.Printf("Bytes written: %d", i)
 	}
 
 	ilog.Println("Flash verify...")
-	rom2 := make([]byte, romsize)
-
-	mdr.Seek(0, io.SeekStart)
-	for i = 0; i < fblen; i += blocklen {
-		if i+blocklen > fblen {
-			blocklen = fblen - i
-		}
-		mdr.Read(rom2[i : i+blocklen])
-		dlog.Printf("Bytes read: %d", i)
-	}
-
-	for i = 0; i < fblen; i++ {
-		if rom2[i] != filebuf[i] {
-			return errors.New(fmt.Sprintf("Verify error at %x", i))
-		}
+	if err = memcart.VerifyBank(mdc, 0, filebuf[:fblen]); err != nil {
+		return err
 	}
 
 	ilog.Println("OK")
@@ -282,7 +335,8 @@ func main() {
 	)
 
 	//options
-	port := flag.String("port", "/dev/ttyUSB0", "serial port to use (/dev/ttyUSB0, etc)")
+	port := flag.String("port", "/dev/ttyUSB0", "serial port to use (/dev/ttyUSB0, etc), or tcp://host:port for a network bridge")
+	record := flag.String("record", "", "Write a transcript of all serial traffic to this file")
 
 	//serial options, shouldn't be needed
 	/*
@@ -320,15 +374,19 @@ func main() {
 
 	//fkmd options
 	rominfo := flag.Bool("rominfo", false, "Print ROM info")
+	fileinfo := flag.Bool("fileinfo", false, "Print the header of the ROM image in -romfile, without using the device")
+	fixchecksum := flag.Bool("fixchecksum", false, "Rewrite the header checksum of the ROM image in -romfile to match its contents, without using the device")
 	readrom := flag.Bool("readrom", false, "Read and output ROM")
 	writerom := flag.Bool("writerom", false, "(Flash cart only) Write ROM data to flash")
+	flashinfo := flag.Bool("flashinfo", false, "(Flash cart only) Identify the flash chip, by sending it autoselect commands")
 	readram := flag.Bool("readram", false, "Read and output RAM")
 	writeram := flag.Bool("writeram", false, "Write supplied RAM data to cartridge")
 	autoname := flag.Bool("autoname", false, "Read ROM name and generate filenames to save ROM/RAM data")
 	romfile := flag.String("romfile", "", "File to save or read ROM data")
 	ramfile := flag.String("ramfile", "", "File to save or read RAM data")
+	rereads := flag.Int("rereads", 3, "Times to read a block again if a dump fails its checksum")
 	verbose := flag.Bool("verbose", false, "Output info logs to stderr")
-	debug := flag.Bool("debug", false, "Output debug logs to stderr (implies verbose)")
+	debug := flag.Bool("debug", false, "Output debug logs and a protocol trace to stderr (implies verbose)")
 
 	flag.Parse()
 
@@ -374,11 +432,39 @@ func main() {
 		usage()
 	}
 
-	if !*readrom && !*writerom && !*readram && !*writeram && !*rominfo {
+	if !*readrom && !*writerom && !*readram && !*writeram && !*rominfo && !*flashinfo && !*fileinfo && !*fixchecksum {
 		elog.Println("No action specified")
 		usage()
 	}
 
+	if (*fileinfo || *fixchecksum) && *romfile == "" {
+		elog.Println("No ROM file name supplied")
+		usage()
+	}
+
+	if *fixchecksum && *readrom {
+		elog.Println("Can't fix the checksum of a ROM being read")
+		usage()
+	}
+
+	if *fixchecksum {
+		if err := FixChecksum(*romfile); err != nil {
+			elog.Println(err)
+			os.Exit(1)
+		}
+	}
+
+	if *fileinfo {
+		if err := FileInfo(*romfile); err != nil {
+			elog.Println(err)
+			os.Exit(1)
+		}
+	}
+
+	if !*readrom && !*writerom && !*readram && !*writeram && !*rominfo && !*flashinfo {
+		return
+	}
+
 	options := serial.OpenOptions{
 		PortName:               *port,
 		BaudRate:               *baud,
@@ -394,6 +480,20 @@ func main() {
 
 	var d = &krikzz_fkmd.Fkmd{}
 	d.SetOptions(options)
+	opener := transport.ForPort(*port)
+	if *record != "" {
+		tf, err := os.Create(*record)
+		if err != nil {
+			elog.Println("Error creating transcript file: ", err)
+			os.Exit(-1)
+		}
+		defer tf.Close()
+		opener = transport.Record(opener, tf)
+	}
+	if *debug {
+		opener = transport.Trace(opener, krikzz_fkmd.NewDecoder(), dlog.Printf)
+	}
+	d.SetOpener(opener)
 	var mdc memcart.MemCart
 	mdc, err = d.MemCart()
 
@@ -404,24 +504,51 @@ func main() {
 		defer d.Disconnect()
 	}
 
+	var ram mdcart.RAMLayout
+	if m, ok := mdc.(*krikzz_fkmd.MDCart); ok {
+		var note string
+		ram, note = m.RamLayout()
+		if note != "" && (*readram || *writeram || *rominfo) {
+			elog.Printf("WARNING: save RAM: %s", note)
+		}
+	}
+
 	if *readram {
 		ReadRam(mdc, *ramfile, *autoname)
 	}
 
 	if *writeram {
-		WriteRam(mdc, *ramfile)
+		WriteRam(mdc, *ramfile, ram)
 	}
 
 	if *readrom {
-		ReadRom(mdc, *romfile, *autoname)
+		if err = ReadRom(mdc, *romfile, *autoname, *rereads); err != nil {
+			elog.Println(err)
+		}
 	}
 
 	if *writerom {
-		WriteRom(mdc, *romfile)
+		if err = WriteRom(mdc, *romfile); err != nil {
+			elog.Println(err)
+		}
 	}
 
 	if *rominfo {
 		gotromname, _ := mdcart.GetRomName(mdc)
 		fmt.Println(gotromname)
+		if h, err := mdcart.ReadHeader(mdc); err != nil {
+			elog.Println(err)
+		} else {
+			PrintHeader(h)
+		}
+		fmt.Println("Save RAM:", ram)
+	}
+
+	if *flashinfo {
+		if chip, err := d.FlashChip(); err != nil {
+			elog.Println("Flash chip:", err)
+		} else {
+			fmt.Println("Flash chip:", chip)
+		}
 	}
 }
@@ -0,0 +1,185 @@
+package transport
+
+import (
+	"io"
+	"math/rand"
+	"time"
+
+	"github.com/jacobsa/go-serial/serial"
+)
+
+type FaultKind int
+
+const (
+	FAULT_DROP     FaultKind = iota // the byte is lost
+	FAULT_CORRUPT                   // the byte is XORed with Mask
+	FAULT_DELAY                     // wait Delay before the byte, a read returns short as if it timed out
+	FAULT_TRUNCATE                  // the read or write returns short here and the rest of its data is lost, a write with io.ErrShortWrite
+)
+
+// Fault describes a fault to inject at one byte offset, or at random.
+type Fault struct {
+	Kind  FaultKind
+	Write bool // Fault data sent to the device, otherwise data received
+
+	// Offset counts bytes in one direction since the first open. With
+	// Offset -1 each byte is hit with the given Probability instead.
+	Offset      int64
+	Probability float64
+
+	Mask  byte // Bits flipped by FAULT_CORRUPT, 0 for all of them
+	Delay time.Duration
+}
+
+// Faults injects faults into a connection, for exercising driver error
+// handling without a flaky adapter.
+type Faults struct {
+	Faults []Fault
+	Rand   *rand.Rand // Source for random faults, seeded with 1 if nil
+
+	Injected int // Number of faults hit
+
+	sent      int64
+	received  int64
+	held      []byte // received bytes held back by a delay
+	delayedAt int64  // offset of the last delayed byte, so it only waits once
+}
+
+// Inject returns an Opener that opens the device with open and passes its
+// traffic through f.
+func Inject(open Opener, f *Faults) Opener {
+	f.delayedAt = -1
+	return func(opt serial.OpenOptions) (io.ReadWriteCloser, error) {
+		rwc, err := open(opt)
+		if err != nil {
+			return nil, err
+		}
+		f.held = nil
+		return &faultConn{rwc, f}, nil
+	}
+}
+
+// hit returns the fault for the byte at off, or nil.
+func (f *Faults) hit(write bool, off int64) *Fault {
+	for i := range f.Faults {
+		ft := &f.Faults[i]
+		if ft.Write != write {
+			continue
+		}
+		if ft.Offset == off || ft.Offset < 0 && f.rand().Float64() < ft.Probability {
+			f.Injected++
+			return ft
+		}
+	}
+	return nil
+}
+
+func (f *Faults) rand() *rand.Rand {
+	if f.Rand == nil {
+		f.Rand = rand.New(rand.NewSource(1))
+	}
+	return f.Rand
+}
+
+func (ft *Fault) corrupt(b byte) byte {
+	if ft.Mask == 0 {
+		return ^b
+	}
+	return b ^ ft.Mask
+}
+
+type faultConn struct {
+	io.ReadWriteCloser
+	f *Faults
+}
+
+func (c *faultConn) Read(p []byte) (int, error) {
+	f := c.f
+	var (
+		data []byte
+		err  error
+	)
+	if len(f.held) > 0 {
+		n := copy(p, f.held)
+		data = append([]byte{}, f.held[:n]...)
+		f.held = f.held[n:]
+	} else {
+		var n int
+		data = make([]byte, len(p))
+		n, err = c.ReadWriteCloser.Read(data)
+		data = data[:n]
+	}
+
+	out := p[:0]
+	for i := 0; i < len(data); i++ {
+		b := data[i]
+		var ft *Fault
+		if f.delayedAt != f.received {
+			ft = f.hit(false, f.received)
+		}
+		if ft != nil {
+			switch ft.Kind {
+			case FAULT_DROP:
+				f.received++
+				continue
+			case FAULT_CORRUPT:
+				b = ft.corrupt(b)
+			case FAULT_DELAY:
+				f.delayedAt = f.received
+				time.Sleep(ft.Delay)
+				f.held = append(append([]byte{}, data[i:]...), f.held...)
+				return short(len(out))
+			case FAULT_TRUNCATE:
+				f.received += int64(len(data) - i)
+				return short(len(out))
+			}
+		}
+		out = append(out, b)
+		f.received++
+	}
+	if len(out) == 0 && len(data) > 0 && err == nil {
+		// everything was dropped
+		return short(0)
+	}
+	return len(out), err
+}
+
+// short returns the result of a read that stopped early, io.EOF if it got
+// nothing, like a serial read timing out.
+func short(n int) (int, error) {
+	if n == 0 {
+		return 0, io.EOF
+	}
+	return n, nil
+}
+
+func (c *faultConn) Write(p []byte) (int, error) {
+	f := c.f
+	out := make([]byte, 0, len(p))
+	for i, b := range p {
+		ft := f.hit(true, f.sent)
+		if ft != nil {
+			switch ft.Kind {
+			case FAULT_DROP:
+				f.sent++
+				continue
+			case FAULT_CORRUPT:
+				b = ft.corrupt(b)
+			case FAULT_DELAY:
+				time.Sleep(ft.Delay)
+			case FAULT_TRUNCATE:
+				f.sent += int64(len(p) - i)
+				if _, err := c.ReadWriteCloser.Write(out); err != nil {
+					return 0, err
+				}
+				return i, io.ErrShortWrite
+			}
+		}
+		out = append(out, b)
+		f.sent++
+	}
+	if _, err := c.ReadWriteCloser.Write(out); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,56 @@
+package transport
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/jacobsa/go-serial/serial"
+)
+
+func TestFaults(t *testing.T) {
+	e := &echo{}
+	f := &Faults{Faults: []Fault{
+		{Kind: FAULT_DROP, Write: true, Offset: 1},
+		{Kind: FAULT_CORRUPT, Offset: 1, Mask: 0x80},
+		{Kind: FAULT_DELAY, Offset: 2},
+		{Kind: FAULT_TRUNCATE, Write: true, Offset: 7},
+		{Kind: FAULT_TRUNCATE, Offset: 5},
+	}}
+	c, err := Inject(Stream(e), f)(serial.OpenOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := c.Write([]byte{0, 1, 2, 3, 4}); n != 5 || err != nil {
+		t.Fatalf("Write: got %d, %v, want 5, nil", n, err)
+	}
+	b := make([]byte, 8)
+	for _, want := range [][]byte{{1, 0x83}, {4, 5}} {
+		n, err := c.Read(b)
+		if err != nil || !bytes.Equal(b[:n], want) {
+			t.Errorf("Read: got % x, %v, want % x", b[:n], err, want)
+		}
+	}
+	if n, err := c.Write([]byte{5, 6, 7, 8}); n != 2 || err != io.ErrShortWrite {
+		t.Errorf("truncated Write: got %d, %v, want 2, %v", n, err, io.ErrShortWrite)
+	}
+	if n, err := c.Read(b); n != 1 || b[0] != 6 || err != nil {
+		t.Errorf("truncated Read: got % x, %v, want 06", b[:n], err)
+	}
+	if n, err := c.Read(b); err != io.EOF {
+		t.Errorf("Read after truncation: got % x, %v, want EOF", b[:n], err)
+	}
+	if f.Injected != 5 {
+		t.Errorf("Injected: got %d, want 5", f.Injected)
+	}
+}
+
+func TestRandomFaults(t *testing.T) {
+	f := &Faults{Faults: []Fault{{Kind: FAULT_DROP, Write: true, Offset: -1, Probability: 0.5}}}
+	var buf bytes.Buffer
+	c, _ := Inject(Stream(&buf), f)(serial.OpenOptions{})
+	c.Write(make([]byte, 1000))
+	if f.Injected+buf.Len() != 1000 || f.Injected < 400 || f.Injected > 600 {
+		t.Errorf("dropped %d of 1000 bytes with probability 0.5, %d got through", f.Injected, buf.Len())
+	}
+}
@@ -0,0 +1,60 @@
+package transport
+
+import (
+	"io"
+
+	"github.com/jacobsa/go-serial/serial"
+)
+
+// Decoder turns a device protocol into readable lines. Sent and Received are
+// given the bytes of each write and read, and return a line for each command
+// or reply they complete. Bytes of an incomplete command are kept until the
+// rest arrive.
+type Decoder interface {
+	Sent(b []byte) []string
+	Received(b []byte) []string
+}
+
+// Trace returns an Opener that opens the device with open and logs traffic
+// decoded by dec with logf, eg. log.Printf.
+func Trace(open Opener, dec Decoder, logf func(format string, v ...interface{})) Opener {
+	return func(opt serial.OpenOptions) (io.ReadWriteCloser, error) {
+		rwc, err := open(opt)
+		if err != nil {
+			return nil, err
+		}
+		logf("open %s", opt.PortName)
+		return &traceConn{rwc, dec, logf}, nil
+	}
+}
+
+type traceConn struct {
+	io.ReadWriteCloser
+	dec  Decoder
+	logf func(format string, v ...interface{})
+}
+
+func (c *traceConn) Read(p []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Read(p)
+	if n > 0 {
+		for _, l := range c.dec.Received(p[:n]) {
+			c.logf("%s %s", TRANSCRIPT_RECV, l)
+		}
+	}
+	return n, err
+}
+
+func (c *traceConn) Write(p []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Write(p)
+	if n > 0 {
+		for _, l := range c.dec.Sent(p[:n]) {
+			c.logf("%s %s", TRANSCRIPT_SEND, l)
+		}
+	}
+	return n, err
+}
+
+func (c *traceConn) Close() error {
+	c.logf("close")
+	return c.ReadWriteCloser.Close()
+}
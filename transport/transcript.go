@@ -0,0 +1,282 @@
+package transport
+
+// Transcripts are text files with one record per line. Each record starts
+// with a direction marker and the time in seconds since the first open:
+//
+//	open 0.000000
+//	> 0.000012 2100
+//	< 0.000420 0101
+//	close 0.013000
+//
+// ">" is data sent to the device and "<" is data received from it, in hex,
+// split into lines of at most TRANSCRIPT_LINE_BYTES. Blank lines and lines
+// starting with "#" are ignored.
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/jacobsa/go-serial/serial"
+)
+
+const (
+	TRANSCRIPT_SEND       = ">"
+	TRANSCRIPT_RECV       = "<"
+	TRANSCRIPT_OPEN       = "open"
+	TRANSCRIPT_CLOSE      = "close"
+	TRANSCRIPT_LINE_BYTES = 32
+)
+
+// Record returns an Opener that opens the device with open and writes every
+// byte sent and received to w as a transcript.
+func Record(open Opener, w io.Writer) Opener {
+	r := &recorder{w: w}
+	return func(opt serial.OpenOptions) (io.ReadWriteCloser, error) {
+		rwc, err := open(opt)
+		if err != nil {
+			return nil, err
+		}
+		if r.start.IsZero() {
+			r.start = time.Now()
+			fmt.Fprintf(w, "# %s to device, %s from device\n", TRANSCRIPT_SEND, TRANSCRIPT_RECV)
+		}
+		if err = r.log(TRANSCRIPT_OPEN, nil); err != nil {
+			rwc.Close()
+			return nil, err
+		}
+		return &recordConn{rwc, r}, nil
+	}
+}
+
+type recorder struct {
+	w     io.Writer
+	start time.Time
+}
+
+func (r *recorder) log(dir string, b []byte) error {
+	t := time.Since(r.start).Seconds()
+	if b == nil {
+		_, err := fmt.Fprintf(r.w, "%s %.6f\n", dir, t)
+		return err
+	}
+	for len(b) > 0 {
+		n := len(b)
+		if n > TRANSCRIPT_LINE_BYTES {
+			n = TRANSCRIPT_LINE_BYTES
+		}
+		if _, err := fmt.Fprintf(r.w, "%s %.6f %s\n", dir, t, hex.EncodeToString(b[:n])); err != nil {
+			return err
+		}
+		b = b[n:]
+	}
+	return nil
+}
+
+type recordConn struct {
+	io.ReadWriteCloser
+	r *recorder
+}
+
+func (c *recordConn) Read(p []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Read(p)
+	if n > 0 {
+		if lerr := c.r.log(TRANSCRIPT_RECV, p[:n]); lerr != nil && err == nil {
+			err = lerr
+		}
+	}
+	return n, err
+}
+
+func (c *recordConn) Write(p []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Write(p)
+	if n > 0 {
+		if lerr := c.r.log(TRANSCRIPT_SEND, p[:n]); lerr != nil && err == nil {
+			err = lerr
+		}
+	}
+	return n, err
+}
+
+func (c *recordConn) Close() error {
+	err := c.ReadWriteCloser.Close()
+	if lerr := c.r.log(TRANSCRIPT_CLOSE, nil); lerr != nil && err == nil {
+		err = lerr
+	}
+	return err
+}
+
+type transcriptRecord struct {
+	dir  string
+	line int
+	data []byte
+}
+
+// Replayer plays a transcript back in place of the device. Its Open method is
+// an Opener. Data is returned to reads in the order it was received, and
+// writes must match what was sent: the first write that differs fails, as
+// does everything after it. Timing is ignored.
+type Replayer struct {
+	recs []transcriptRecord
+	pos  int // current record
+	off  int // bytes of recs[pos] already used
+	err  error
+}
+
+// NewReplayer reads a transcript from r.
+func NewReplayer(r io.Reader) (*Replayer, error) {
+	p := &Replayer{}
+	s := bufio.NewScanner(r)
+	for line := 1; s.Scan(); line++ {
+		f := strings.Fields(s.Text())
+		if len(f) == 0 || strings.HasPrefix(f[0], "#") {
+			continue
+		}
+		rec := transcriptRecord{dir: f[0], line: line}
+		switch rec.dir {
+		case TRANSCRIPT_OPEN, TRANSCRIPT_CLOSE:
+		case TRANSCRIPT_SEND, TRANSCRIPT_RECV:
+			if len(f) < 3 {
+				return nil, fmt.Errorf("transcript line %d: no data", line)
+			}
+			b, err := hex.DecodeString(f[2])
+			if err != nil {
+				return nil, fmt.Errorf("transcript line %d: %v", line, err)
+			}
+			rec.data = b
+		default:
+			return nil, fmt.Errorf("transcript line %d: unknown record %q", line, rec.dir)
+		}
+		p.recs = append(p.recs, rec)
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Open moves to the next open in the transcript, skipping any data the
+// driver didn't read. Options are ignored.
+func (p *Replayer) Open(opt serial.OpenOptions) (io.ReadWriteCloser, error) {
+	if p.err != nil {
+		return nil, p.err
+	}
+	for rec := p.next(); rec == nil || rec.dir != TRANSCRIPT_OPEN; rec = p.next() {
+		switch {
+		case rec == nil:
+			return nil, p.fail("open past end of transcript")
+		case rec.dir == TRANSCRIPT_SEND:
+			return nil, p.fail("open at transcript line %d, expected write of %x", rec.line, rec.data[p.off:])
+		}
+		p.advance()
+	}
+	p.advance()
+	return p, nil
+}
+
+// Read returns data the device sent at this point in the transcript, or
+// io.EOF, like a serial read timing out, if the device sent nothing.
+func (p *Replayer) Read(b []byte) (int, error) {
+	if p.err != nil {
+		return 0, p.err
+	}
+	n := 0
+	for n < len(b) {
+		rec := p.next()
+		if rec == nil || rec.dir != TRANSCRIPT_RECV {
+			break
+		}
+		c := copy(b[n:], rec.data[p.off:])
+		n += c
+		p.off += c
+	}
+	if n == 0 {
+		return 0, io.EOF
+	}
+	return n, nil
+}
+
+// Write checks b against the data sent at this point in the transcript.
+func (p *Replayer) Write(b []byte) (int, error) {
+	if p.err != nil {
+		return 0, p.err
+	}
+	for n := 0; n < len(b); {
+		rec := p.next()
+		for rec != nil && rec.dir == TRANSCRIPT_RECV {
+			// the driver didn't read all of the reply this time
+			p.advance()
+			rec = p.next()
+		}
+		if rec == nil {
+			return n, p.fail("write of %x past end of transcript", b[n:])
+		}
+		if rec.dir != TRANSCRIPT_SEND {
+			return n, p.fail("write of %x at transcript line %d, expected %s", b[n:], rec.line, rec.dir)
+		}
+		for ; n < len(b) && p.off < len(rec.data); n, p.off = n+1, p.off+1 {
+			if b[n] != rec.data[p.off] {
+				return n, p.fail("write diverged at transcript line %d byte %d: got 0x%02x, expected 0x%02x",
+					rec.line, p.off, b[n], rec.data[p.off])
+			}
+		}
+	}
+	return len(b), nil
+}
+
+// Close moves past the next close in the transcript if there is one.
+func (p *Replayer) Close() error {
+	if p.err != nil {
+		return p.err
+	}
+	rec := p.next()
+	for rec != nil && rec.dir == TRANSCRIPT_RECV {
+		p.advance()
+		rec = p.next()
+	}
+	if rec != nil && rec.dir == TRANSCRIPT_CLOSE {
+		p.advance()
+	}
+	return nil
+}
+
+// Done returns the error that stopped the replay, or an error if the driver
+// hasn't sent everything in the transcript.
+func (p *Replayer) Done() error {
+	if p.err != nil {
+		return p.err
+	}
+	for i := p.pos; i < len(p.recs); i++ {
+		rec := &p.recs[i]
+		if rec.dir == TRANSCRIPT_SEND && (i > p.pos || p.off < len(rec.data)) {
+			return fmt.Errorf("transport: replay stopped before transcript line %d", rec.line)
+		}
+	}
+	return nil
+}
+
+// next returns the current record, skipping ones that are used up, or nil at
+// the end of the transcript.
+func (p *Replayer) next() *transcriptRecord {
+	for p.pos < len(p.recs) {
+		rec := &p.recs[p.pos]
+		if rec.data == nil || p.off < len(rec.data) {
+			return rec
+		}
+		p.advance()
+	}
+	return nil
+}
+
+func (p *Replayer) advance() {
+	p.pos++
+	p.off = 0
+}
+
+func (p *Replayer) fail(format string, a ...interface{}) error {
+	p.err = fmt.Errorf("transport: replay "+format, a...)
+	return p.err
+}
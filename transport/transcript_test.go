@@ -0,0 +1,100 @@
+package transport
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/jacobsa/go-serial/serial"
+)
+
+// echo replies to each write with the bytes incremented by one.
+type echo struct {
+	out []byte
+}
+
+func (e *echo) Read(p []byte) (int, error) {
+	if len(e.out) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, e.out)
+	e.out = e.out[n:]
+	return n, nil
+}
+
+func (e *echo) Write(p []byte) (int, error) {
+	for _, v := range p {
+		e.out = append(e.out, v+1)
+	}
+	return len(p), nil
+}
+
+func session(open Opener, cmds ...[]byte) ([]byte, error) {
+	var got []byte
+	for i := 0; i < 2; i++ {
+		f, err := open(serial.OpenOptions{})
+		if err != nil {
+			return got, err
+		}
+		for _, c := range cmds {
+			if _, err = f.Write(c); err != nil {
+				return got, err
+			}
+			b := make([]byte, 64)
+			n, _ := f.Read(b)
+			got = append(got, b[:n]...)
+		}
+		if err = f.Close(); err != nil {
+			return got, err
+		}
+	}
+	return got, nil
+}
+
+func TestRecordReplay(t *testing.T) {
+	long := bytes.Repeat([]byte{0x10}, TRANSCRIPT_LINE_BYTES+5)
+	var tr bytes.Buffer
+	want, err := session(Record(Stream(&echo{}), &tr), []byte{1, 2}, long)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Logf("transcript:\n%s", tr.String())
+
+	p, err := NewReplayer(strings.NewReader(tr.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := session(p.Open, []byte{1, 2}, long)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("replayed %x, recorded %x", got, want)
+	}
+	if err = p.Done(); err != nil {
+		t.Error(err)
+	}
+
+	p, _ = NewReplayer(strings.NewReader(tr.String()))
+	if _, err = session(p.Open, []byte{1, 3}); err == nil {
+		t.Error("replay accepted a divergent write")
+	}
+	if _, err = p.Read(make([]byte, 1)); err == nil || err == io.EOF {
+		t.Errorf("read after divergence: got %v, want the divergence error", err)
+	}
+
+	p, _ = NewReplayer(strings.NewReader(tr.String()))
+	session(p.Open, []byte{1, 2})
+	if err = p.Done(); err == nil {
+		t.Error("Done didn't report an unfinished replay")
+	}
+}
+
+func TestReplayerParse(t *testing.T) {
+	for _, s := range []string{"> 0.0 zz", "> 0.0", "bogus 0.0"} {
+		if _, err := NewReplayer(strings.NewReader(s)); err == nil {
+			t.Errorf("NewReplayer(%q) didn't fail", s)
+		}
+	}
+}
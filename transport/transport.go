@@ -0,0 +1,102 @@
+// Package transport opens the byte stream a driver uses to talk to its device.
+// Drivers default to a serial port, and can be pointed at anything else that
+// is an io.ReadWriteCloser: a pipe, a pseudo-terminal, a TCP socket or a
+// simulator.
+package transport
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jacobsa/go-serial/serial"
+)
+
+const TCP_PREFIX = "tcp://"
+
+// Opener opens a connection to a device. Drivers call it again with updated
+// options when they need to reopen the port.
+type Opener func(serial.OpenOptions) (io.ReadWriteCloser, error)
+
+// Serial opens the serial port named in the options.
+func Serial(opt serial.OpenOptions) (io.ReadWriteCloser, error) {
+	return serial.Open(opt)
+}
+
+// TCP returns an Opener that connects to addr (host:port), eg. a serial
+// server. Reads time out after InterCharacterTimeout like a serial port's,
+// other serial options are ignored.
+func TCP(addr string) Opener {
+	return func(opt serial.OpenOptions) (io.ReadWriteCloser, error) {
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		return withTimeout(c, c, opt), nil
+	}
+}
+
+// Stream returns an Opener that hands out rw every time it's opened, for
+// pipes and other streams that can't be reopened. Closing the returned
+// connection leaves rw open. If rw can set read deadlines, eg. a net.Conn or
+// an *os.File for a pipe, reads time out after InterCharacterTimeout.
+func Stream(rw io.ReadWriter) Opener {
+	return func(opt serial.OpenOptions) (io.ReadWriteCloser, error) {
+		if d, ok := rw.(deadliner); ok {
+			return withTimeout(nopCloser{rw}, d, opt), nil
+		}
+		return nopCloser{rw}, nil
+	}
+}
+
+// ForPort picks an Opener for a port name given on the command line:
+// tcp://host:port connects over TCP, anything else is a serial device
+// (including pseudo-terminals).
+func ForPort(port string) Opener {
+	if strings.HasPrefix(port, TCP_PREFIX) {
+		return TCP(strings.TrimPrefix(port, TCP_PREFIX))
+	}
+	return Serial
+}
+
+type nopCloser struct {
+	io.ReadWriter
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
+
+type deadliner interface {
+	SetReadDeadline(t time.Time) error
+}
+
+// timeoutConn times out reads the way a serial port does, which the drivers
+// rely on to notice a device that has stopped answering: a Read that gets
+// nothing within timeout returns 0, io.EOF.
+type timeoutConn struct {
+	io.ReadWriteCloser
+	d       deadliner
+	timeout time.Duration
+}
+
+func withTimeout(rwc io.ReadWriteCloser, d deadliner, opt serial.OpenOptions) io.ReadWriteCloser {
+	if opt.InterCharacterTimeout == 0 {
+		return rwc
+	}
+	return timeoutConn{rwc, d, time.Duration(opt.InterCharacterTimeout) * time.Millisecond}
+}
+
+func (c timeoutConn) Read(p []byte) (int, error) {
+	if err := c.d.SetReadDeadline(time.Now().Add(c.timeout)); err != nil {
+		return 0, err
+	}
+	n, err := c.ReadWriteCloser.Read(p)
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return n, io.EOF
+	}
+	return n, err
+}
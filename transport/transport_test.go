@@ -0,0 +1,108 @@
+package transport
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/go-serial/serial"
+)
+
+func TestTCP(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip("can't listen on loopback:", err)
+	}
+	defer l.Close()
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		io.Copy(c, c)
+		c.Close()
+	}()
+
+	f, err := ForPort(TCP_PREFIX + l.Addr().String())(serial.OpenOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err = f.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 4)
+	if _, err = io.ReadFull(f, b); err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "ping" {
+		t.Errorf("echo: got %q, want %q", b, "ping")
+	}
+}
+
+// TestTimeout checks that a peer that doesn't answer makes a read return
+// io.EOF after InterCharacterTimeout, like a serial port, rather than block.
+func TestTimeout(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip("can't listen on loopback:", err)
+	}
+	defer l.Close()
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		io.Copy(io.Discard, c)
+	}()
+	tcp, err := TCP(l.Addr().String())(serial.OpenOptions{InterCharacterTimeout: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcp.Close()
+
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	pipe, err := Stream(a)(serial.OpenOptions{InterCharacterTimeout: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, f := range map[string]io.ReadWriteCloser{"tcp": tcp, "pipe": pipe} {
+		done := make(chan error, 1)
+		go func() {
+			_, err := f.Read(make([]byte, 4))
+			done <- err
+		}()
+		select {
+		case err := <-done:
+			if err != io.EOF {
+				t.Errorf("%s: read from silent peer: got error %v, want io.EOF", name, err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: read from silent peer blocked", name)
+		}
+	}
+}
+
+func TestStream(t *testing.T) {
+	var buf bytes.Buffer
+	open := Stream(&buf)
+	for i := 0; i < 2; i++ {
+		f, err := open(serial.OpenOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write([]byte{byte(i)})
+		if err = f.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !bytes.Equal(buf.Bytes(), []byte{0, 1}) {
+		t.Errorf("stream after reopen: got %v, want [0 1]", buf.Bytes())
+	}
+}